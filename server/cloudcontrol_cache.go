@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
 	"github.com/miekg/dns"
@@ -16,204 +18,421 @@ type ServerMetadata struct {
 	Name             string
 	IPv4ByMACAddress map[string]net.IP
 
+	// The server's state in CloudControl (e.g. "NORMAL", "PENDING_CHANGE", or "FAILED_ADD"); empty if not known.
+	State string
+
+	// Has the server been deployed?
+	Deployed bool
+
+	// Has DHCP been disabled for the server (using the "dhcp_enabled" tag)? If so, the server is ignored entirely.
+	DHCPDisabled bool
+
+	// The name of the CloudControl network domain (if any) that the server belongs to.
+	NetworkDomainName string
+
+	// The DNS domain for the server's records (e.g. a CloudControl target's subdomain); empty to use the service's DNS domain.
+	DNSDomainName string
+
+	// Problems (if any) with the server's tags (e.g. unknown tags or invalid values).
+	TagWarnings []string
+
 	// If specified, overrides the default PXE boot image.
 	PXEBootImage string
 
 	// If specified, overrides the default iPXE boot script URL (and IPXEProfile).
 	IPXEBootScript string
+
+	// Is the server a static reservation (rather than a server in CloudControl)?
+	IsStaticReservation bool
+
+	// If specified, overrides the server name as the server's host name (in DHCP and DNS).
+	DNSName string
+
+	// Additional names (relative to the DNS domain) that are aliases (CNAMEs) for the server's host name.
+	DNSAliases []string
+
+	// Services (SRV records) offered by the server.
+	DNSServices []DNSService
+
+	// If specified, text (TXT record) for the server's host name.
+	DNSText string
+
+	// Group names (relative to the DNS domain) whose records include the server's primary address.
+	DNSGroups []string
+
+	// Names (relative to the DNS domain) whose sub-domains all resolve to the server's primary address (e.g. "apps" for "*.apps.<domain>").
+	DNSWildcards []string
+
+	// If specified, overrides the TTL for the server's DNS records.
+	DNSTTL uint32
+}
+
+// DNSService represents a service (SRV record) offered by a server.
+type DNSService struct {
+	// The service name, relative to the DNS domain (e.g. "_etcd-server._tcp").
+	Name string
+
+	// The port on which the service is offered.
+	Port uint16
+
+	// The priority of the target (lower values are preferred).
+	Priority uint16
+
+	// The relative weight of the target (for targets with the same priority).
+	Weight uint16
+}
+
+// HostName gets the server's host name (the server name, unless overridden by the "dns_name" tag).
+func (serverMetadata *ServerMetadata) HostName() string {
+	if serverMetadata.DNSName != "" {
+		return serverMetadata.DNSName
+	}
+
+	return serverMetadata.Name
+}
+
+// Get the DNS domain for a server's records.
+func (service *Service) serverDNSDomainName(serverMetadata ServerMetadata) string {
+	if serverMetadata.DNSDomainName != "" {
+		return serverMetadata.DNSDomainName
+	}
+
+	return service.DNSDomainName
 }
 
 // RefreshServerMetadata refreshes the map of MAC addresses to server metadata.
 func (service *Service) RefreshServerMetadata() error {
-	return service.refreshServerMetadataInternal(true)
+	return service.refreshServerMetadataInternal(true, nil)
 }
-func (service *Service) refreshServerMetadataInternal(acquireStateLock bool) error {
-	serverMetadataByMACAddress, dnsData, err := service.readServerMetadata()
+func (service *Service) refreshServerMetadataInternal(acquireStateLock bool, providers []MetadataProvider) error {
+	started := time.Now()
+	refreshMetrics.Add("refreshes", 1)
+
+	// If some providers failed, the server metadata read from the others (and last read from the failed ones, if any) is still applied, but the failure is still counted.
+	serverMetadataByMACAddress, dnsData, updated, err := service.readServerMetadata(providers)
 	if err != nil {
-		return err
+		refreshMetrics.Add("refresh_failures", 1)
+
+		if serverMetadataByMACAddress == nil {
+			return err
+		}
+	} else {
+		refreshed := time.Now()
+		refreshMetrics.Set("last_refresh_duration_ms", durationMetric(refreshed.Sub(started)))
+		refreshMetrics.Set("last_refresh_time", timeMetric(refreshed))
+	}
+
+	// A snapshot that is missing providers that have never been read would replace a more complete one.
+	if service.SnapshotFile != "" && !service.isServerMetadataIncomplete() {
+		snapshotErr := service.writeServerMetadataSnapshot(serverMetadataByMACAddress, dnsData, updated)
+		if snapshotErr != nil {
+			log.Printf("Unable to write server metadata snapshot to '%s': %s",
+				service.SnapshotFile,
+				snapshotErr.Error(),
+			)
+		}
 	}
 
 	if acquireStateLock {
 		service.acquireStateLock("refreshServerMetadataInternal")
 		defer service.releaseStateLock("refreshServerMetadataInternal")
 	}
+	service.applyServerMetadata(serverMetadataByMACAddress, dnsData, updated)
+
+	return err
+}
+
+// Apply new server metadata (and DNS data), publishing any changes.
+//
+// The caller must hold the state lock.
+func (service *Service) applyServerMetadata(serverMetadataByMACAddress map[string]ServerMetadata, dnsData *DNSData, updated time.Time) {
+	changes := diffServerMetadata(service.ServerMetadataByMACAddress, serverMetadataByMACAddress)
+
 	service.ServerMetadataByMACAddress = serverMetadataByMACAddress
-	service.DNSData = *dnsData
+	service.ServerMetadataUpdated = updated
+	service.cloudControlDNSData = *dnsData
+	service.publishDNSData()
 
-	return nil
+	service.publishServerMetadataChanges(changes)
 }
 
-// readServerMetadata creates a map of MAC addresses to server metadata from CloudControl.
-func (service *Service) readServerMetadata() (map[string]ServerMetadata, *DNSData, error) {
-	allServerTags, err := service.getAllServerTags()
+// readCloudControlServerMetadata creates a map of MAC addresses to server metadata from the servers in a CloudControl target's network domain.
+func (service *Service) readCloudControlServerMetadata(target *CloudControlTarget) (map[string]ServerMetadata, *DNSData, error) {
+	servers, err := service.listServersInNetworkDomain(target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allServerTags, err := service.getServerTags(target, servers)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	serverMetadataByMACAddress := make(map[string]ServerMetadata)
-	dnsData := NewDNSData(service.DNSTTL)
+	dnsData := service.newDNSData()
+	hostNamesByPrivateIPv4 := make(map[string]string)
 
-	page := compute.DefaultPaging()
-	page.PageSize = 50
+	for _, server := range servers {
+		serverMetadata := &ServerMetadata{
+			ID:       server.ID,
+			Name:     server.Name,
+			State:    server.State,
+			Deployed: server.Deployed,
 
-	for {
-		servers, err := service.Client.ListServersInNetworkDomain(service.NetworkDomain.ID, page)
+			NetworkDomainName: target.NetworkDomain.Name,
+		}
+		if target.Subdomain != "" {
+			serverMetadata.DNSDomainName = target.DNSDomainName(service)
+		}
+		service.parseServerTags(serverMetadata, allServerTags, service.TagPrefix)
+
+		networkAdapters := append(
+			[]compute.VirtualMachineNetworkAdapter{server.Network.PrimaryAdapter},
+			server.Network.AdditionalNetworkAdapters...,
+		)
+		service.addServerMetadata(serverMetadata, networkAdapters, serverMetadataByMACAddress, &dnsData, hostNamesByPrivateIPv4)
+	}
+
+	if service.EnablePublicDNS {
+		err = service.readPublicDNSRecords(target, &dnsData, hostNamesByPrivateIPv4)
 		if err != nil {
 			return nil, nil, err
 		}
-		if servers.IsEmpty() {
-			break
+	}
+
+	return serverMetadataByMACAddress, &dnsData, nil
+}
+
+// Add a server's metadata (keyed by the MAC address of each of its network adapters) and DNS records.
+//
+// The first network adapter is the server's primary network adapter; servers (and network adapters) that are being deployed or destroyed are ignored.
+func (service *Service) addServerMetadata(serverMetadata *ServerMetadata, networkAdapters []compute.VirtualMachineNetworkAdapter, serverMetadataByMACAddress map[string]ServerMetadata, dnsData *DNSData, hostNamesByPrivateIPv4 map[string]string) {
+	if serverMetadata.DHCPDisabled {
+		if service.EnableDebugLogging {
+			log.Printf("\tIgnoring server '%s' (Id = '%s'; DHCP is disabled for this server).",
+				serverMetadata.Name,
+				serverMetadata.ID,
+			)
+		}
+
+		return
+	}
+
+	// Ignore servers that are being deployed or destroyed.
+	primaryNetworkAdapter := networkAdapters[0]
+	if primaryNetworkAdapter.PrivateIPv4Address == nil || primaryNetworkAdapter.MACAddress == nil {
+		return
+	}
+
+	primaryMACAddress := strings.ToLower(
+		*primaryNetworkAdapter.MACAddress,
+	)
+	serverMetadata.IPv4ByMACAddress = map[string]net.IP{
+		primaryMACAddress: net.ParseIP(*primaryNetworkAdapter.PrivateIPv4Address),
+	}
+
+	domainName := service.serverDNSDomainName(*serverMetadata)
+	serverFQDN := dns.Fqdn(serverMetadata.HostName() + "." + domainName)
+	dnsData.AddNetworkAdapter(serverFQDN, primaryNetworkAdapter)
+	serverNames := []string{serverFQDN}
+	serverNames = append(serverNames,
+		service.addDNSSubzoneNames(dnsData, *serverMetadata, serverMetadata.HostName(), primaryNetworkAdapter)...,
+	)
+	hostNamesByPrivateIPv4[*primaryNetworkAdapter.PrivateIPv4Address] = serverMetadata.HostName()
+
+	if service.EnableDebugLogging {
+		log.Printf("\tMAC %s -> %s (%s)\n",
+			primaryMACAddress,
+			*primaryNetworkAdapter.PrivateIPv4Address,
+			serverMetadata.Name,
+		)
+	}
+
+	for additionalNetworkAdapterIndex, additionalNetworkAdapter := range networkAdapters[1:] {
+		// Ignore network adapters that are being deployed or destroyed.
+		if additionalNetworkAdapter.PrivateIPv4Address == nil || additionalNetworkAdapter.MACAddress == nil {
+			continue
 		}
 
-		for _, server := range servers.Items {
-			// Ignore servers that are being deployed or destroyed.
-			primaryNetworkAdapter := server.Network.PrimaryAdapter
-			if primaryNetworkAdapter.PrivateIPv4Address == nil || primaryNetworkAdapter.MACAddress == nil {
-				continue
-			}
+		additionalMACAddress := strings.ToLower(
+			*additionalNetworkAdapter.MACAddress,
+		)
+		serverMetadata.IPv4ByMACAddress[additionalMACAddress] = net.ParseIP(*additionalNetworkAdapter.PrivateIPv4Address)
+
+		// Each additional adapter gets its own name, so its forward and reverse records agree.
+		additionalNetworkAdapterHostName := networkAdapterHostName(serverMetadata.HostName(), additionalNetworkAdapterIndex+1, additionalNetworkAdapter, service.DNSAdapterNaming)
+		dnsData.AddNetworkAdapter(additionalNetworkAdapterHostName+"."+domainName, additionalNetworkAdapter)
+		serverNames = append(serverNames, additionalNetworkAdapterHostName+"."+domainName)
+		serverNames = append(serverNames,
+			service.addDNSSubzoneNames(dnsData, *serverMetadata, additionalNetworkAdapterHostName, additionalNetworkAdapter)...,
+		)
+		hostNamesByPrivateIPv4[*additionalNetworkAdapter.PrivateIPv4Address] = additionalNetworkAdapterHostName
 
-			primaryMACAddress := strings.ToLower(
-				*primaryNetworkAdapter.MACAddress,
+		if service.EnableDebugLogging {
+			log.Printf("\tMAC address %s -> %s (%s)\n",
+				additionalMACAddress,
+				*additionalNetworkAdapter.PrivateIPv4Address,
+				serverMetadata.Name,
 			)
-			serverMetadata := &ServerMetadata{
-				ID:   server.ID,
-				Name: server.Name,
-				IPv4ByMACAddress: map[string]net.IP{
-					primaryMACAddress: net.ParseIP(*primaryNetworkAdapter.PrivateIPv4Address),
-				},
-			}
-			service.parseServerTags(serverMetadata, allServerTags)
-
-			serverFQDN := dns.Fqdn(server.Name + "." + service.DNSDomainName)
-			dnsData.AddNetworkAdapter(serverFQDN, primaryNetworkAdapter)
-
-			if service.EnableDebugLogging {
-				log.Printf("\tMAC %s -> %s (%s)\n",
-					primaryMACAddress,
-					*primaryNetworkAdapter.PrivateIPv4Address,
-					server.Name,
-				)
-			}
-
-			for _, additionalNetworkAdapter := range server.Network.AdditionalNetworkAdapters {
-				// Ignore network adapters that are being deployed or destroyed.
-				if additionalNetworkAdapter.PrivateIPv4Address == nil || additionalNetworkAdapter.MACAddress == nil {
-					continue
-				}
-
-				additionalMACAddress := strings.ToLower(
-					*additionalNetworkAdapter.MACAddress,
-				)
-				serverMetadata.IPv4ByMACAddress[additionalMACAddress] = net.ParseIP(*additionalNetworkAdapter.PrivateIPv4Address)
-				dnsData.AddNetworkAdapter(serverFQDN, additionalNetworkAdapter)
-
-				if service.EnableDebugLogging {
-					log.Printf("\tMAC address %s -> %s (%s)\n",
-						additionalMACAddress,
-						*additionalNetworkAdapter.PrivateIPv4Address,
-						server.Name,
-					)
-				}
-			}
-
-			// Enable lookup by any MAC address.
-			for macAddress := range serverMetadata.IPv4ByMACAddress {
-				serverMetadataByMACAddress[macAddress] = *serverMetadata
-			}
 		}
+	}
 
-		page.Next()
+	for _, dnsService := range serverMetadata.DNSServices {
+		dnsData.AddSRV(dnsService.Name+"."+domainName, serverFQDN,
+			dnsService.Port,
+			dnsService.Priority,
+			dnsService.Weight,
+		)
+	}
+	if serverMetadata.DNSText != "" {
+		dnsData.AddTXT(serverFQDN, serverMetadata.DNSText)
+	}
+	for _, group := range serverMetadata.DNSGroups {
+		dnsData.AddGroupMember(group+"."+domainName, primaryNetworkAdapter)
+	}
+	for _, wildcard := range serverMetadata.DNSWildcards {
+		dnsData.AddGroupMember("*."+wildcard+"."+domainName, primaryNetworkAdapter)
 	}
 
-	return serverMetadataByMACAddress, &dnsData, nil
+	for _, alias := range serverMetadata.DNSAliases {
+		aliasFQDN := dns.Fqdn(alias + "." + domainName)
+		err := dnsData.AddCNAME(aliasFQDN, serverFQDN)
+		if err != nil {
+			log.Printf("Ignoring DNS alias '%s' for server '%s' (Id = '%s'): %s",
+				alias,
+				serverMetadata.Name,
+				serverMetadata.ID,
+				err.Error(),
+			)
+
+			continue // The name belongs to something else (so the server's TTL must not be applied to it).
+		}
+		serverNames = append(serverNames, aliasFQDN)
+	}
+
+	if serverMetadata.DNSTTL != 0 {
+		for _, name := range serverNames {
+			dnsData.SetTTL(name, serverMetadata.DNSTTL)
+		}
+	}
+
+	// Enable lookup by any MAC address.
+	for macAddress := range serverMetadata.IPv4ByMACAddress {
+		serverMetadataByMACAddress[macAddress] = *serverMetadata
+	}
 }
 
-// Get tags for all servers, keyed by server Id.
-func (service *Service) getAllServerTags() (map[string][]compute.TagDetail, error) {
-	allServerTags := make(map[string][]compute.TagDetail)
+// List all servers in a CloudControl target's network domain.
+func (service *Service) listServersInNetworkDomain(target *CloudControlTarget) ([]compute.Server, error) {
+	started := time.Now()
 
-	tagPage := compute.DefaultPaging()
-	tagPage.PageSize = 50
+	var allServers []compute.Server
+
+	page := compute.DefaultPaging()
+	page.PageSize = 50
 
 	for {
-		tags, err := service.Client.GetAssetTagsByType(compute.AssetTypeServer, service.NetworkDomain.DatacenterID, tagPage)
+		servers, err := target.Client.ListServersInNetworkDomain(target.NetworkDomain.ID, page)
 		if err != nil {
 			return nil, err
 		}
-		if tags.IsEmpty() {
-			break // No more tags.
+		if servers.IsEmpty() {
+			break
 		}
 
-		for _, tag := range tags.Items {
-			serverTags, ok := allServerTags[tag.AssetID]
-			if ok {
-				serverTags = append(serverTags, tag)
-			} else {
-				serverTags = []compute.TagDetail{tag}
-			}
-			allServerTags[tag.AssetID] = serverTags
+		allServers = append(allServers, servers.Items...)
+
+		page.Next()
+	}
+
+	refreshMetrics.Set("last_server_list_duration_ms", durationMetric(time.Since(started)))
+
+	return allServers, nil
+}
+
+// Add the names for a server's network adapter in the per-VLAN and per-network-domain subzones (if enabled), returning the names that were added.
+//
+// In its VLAN's subzone, each adapter uses the server's host name ("<hostName>.<vlan-name>.<domain>"); in the network domain's subzone, it uses the adapter's host name ("<adapterHostName>.<network-domain-name>.<domain>").
+func (service *Service) addDNSSubzoneNames(dnsData *DNSData, serverMetadata ServerMetadata, adapterHostName string, networkAdapter compute.VirtualMachineNetworkAdapter) []string {
+	var names []string
+
+	domainName := service.serverDNSDomainName(serverMetadata)
+	if service.EnableDNSVLANSubzones && networkAdapter.VLANName != nil {
+		vlanLabel := toDNSLabel(*networkAdapter.VLANName)
+		if vlanLabel != "" {
+			names = append(names, serverMetadata.HostName()+"."+vlanLabel+"."+domainName)
 		}
+	}
 
-		// CloudControl bug - going past last page of tags returns UNEXPECTED_ERROR (i.e. there are no more tags).
-		// We therefore manually determine whether this is the last page of results.
-		if tags.IsLastPage() {
-			break
+	if service.EnableDNSNetworkDomainSubzones && serverMetadata.NetworkDomainName != "" {
+		networkDomainLabel := toDNSLabel(serverMetadata.NetworkDomainName)
+		if networkDomainLabel != "" {
+			names = append(names, adapterHostName+"."+networkDomainLabel+"."+domainName)
 		}
+	}
 
-		tagPage.Next()
+	for _, name := range names {
+		dnsData.AddGroupMember(name, networkAdapter)
 	}
 
-	return allServerTags, nil
+	return names
 }
 
-// Update server metadata from tags (if any) applied to the specified server.
-func (service *Service) parseServerTags(serverMetadata *ServerMetadata, allServerTags map[string][]compute.TagDetail) {
-	serverTags, ok := allServerTags[serverMetadata.ID]
-	if !ok {
-		if service.EnableDebugLogging {
-			log.Printf("\tNo tags for server '%s' (Id = '%s'); assuming default configuration.",
-				serverMetadata.Name,
-				serverMetadata.ID,
-			)
+// Get the host name for a server's additional network adapter.
+//
+// Depending on naming, this is either "<hostName>-nic<adapterNumber>" (DNSAdapterNamingIndex) or "<vlan-name>.<hostName>" (DNSAdapterNamingVLAN).
+func networkAdapterHostName(hostName string, adapterNumber int, networkAdapter compute.VirtualMachineNetworkAdapter, naming string) string {
+	if naming == DNSAdapterNamingVLAN && networkAdapter.VLANName != nil {
+		vlanLabel := toDNSLabel(*networkAdapter.VLANName)
+		if vlanLabel != "" {
+			return vlanLabel + "." + hostName
 		}
-
-		return
 	}
 
-	for _, tag := range serverTags {
-		switch tag.Name {
-		case "pxe_boot_image":
-			serverMetadata.PXEBootImage = tag.Value
-		case "ipxe_profile":
-			if serverMetadata.IPXEBootScript != "" {
-				continue // ipxe_boot_script overrides ipxe_profile
-			}
-
-			// TODO: Add config item for URL template.
-			serverMetadata.IPXEBootScript = fmt.Sprintf("http://%s:%d/?profile=%s",
-				service.ServiceIP,
-				service.IPXEPort,
-				tag.Value,
-			)
-		case "ipxe_boot_script":
-			serverMetadata.IPXEBootScript = tag.Value
+	return fmt.Sprintf("%s-nic%d", hostName, adapterNumber)
+}
+
+// Convert a name to a valid DNS label (lower-case letters, digits, and hyphens).
+func toDNSLabel(name string) string {
+	label := strings.Map(func(character rune) rune {
+		switch {
+		case character >= 'a' && character <= 'z', character >= '0' && character <= '9':
+			return character
+		case character >= 'A' && character <= 'Z':
+			return character - 'A' + 'a'
+		default:
+			return '-'
 		}
+	}, name)
+
+	return strings.Trim(label, "-")
+}
+
+// Parse a DNS service from a "dns_srv" tag value ("service:port[:priority[:weight]]", e.g. "_etcd-server._tcp:2380").
+func parseDNSService(value string) (*DNSService, error) {
+	fields := strings.Split(strings.TrimSpace(value), ":")
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, fmt.Errorf("expected 'service:port[:priority[:weight]]'")
 	}
 
-	if service.EnableDebugLogging {
-		log.Printf("\t%d tags for server '%s' (Id = '%s'):",
-			len(serverTags),
-			serverMetadata.Name,
-			serverMetadata.ID,
-		)
+	dnsService := &DNSService{
+		Name: fields[0],
+	}
+	if !strings.HasPrefix(dnsService.Name, "_") {
+		return nil, fmt.Errorf("service name '%s' must start with '_' (e.g. '_http._tcp')", dnsService.Name)
+	}
 
-		if serverMetadata.PXEBootImage != "" {
-			log.Printf("\t\tOverride PXE boot image: '%s'", serverMetadata.PXEBootImage)
-		}
-		if serverMetadata.IPXEBootScript != "" {
-			log.Printf("\t\tOverride iPXE boot script: '%s'", serverMetadata.IPXEBootScript)
+	numbers := []*uint16{&dnsService.Port, &dnsService.Priority, &dnsService.Weight}
+	for index, field := range fields[1:] {
+		number, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid number", field)
 		}
+
+		*numbers[index] = uint16(number)
 	}
+
+	return dnsService, nil
 }
 
 // FindServerMetadataByMACAddress finds the metadata for the server (if any) posessing a network adapter with the specified MAC address.
@@ -223,21 +442,6 @@ func (service *Service) FindServerMetadataByMACAddress(macAddress string) *Serve
 
 	macAddress = strings.ToLower(macAddress)
 
-	// Fake up metadata for a matching server if there's a matching static address reservation.
-	staticReservation, ok := service.StaticReservationsByMACAddress[macAddress]
-	if ok {
-		serverMACAddress := macAddress
-		serverPrivateIPv4Address := staticReservation.IPAddress
-
-		return &ServerMetadata{
-			ID:   staticReservation.HostName,
-			Name: staticReservation.HostName,
-			IPv4ByMACAddress: map[string]net.IP{
-				serverMACAddress: serverPrivateIPv4Address,
-			},
-		}
-	}
-
 	serverMetadata, ok := service.ServerMetadataByMACAddress[macAddress]
 	if ok {
 		return &serverMetadata
@@ -245,3 +449,17 @@ func (service *Service) FindServerMetadataByMACAddress(macAddress string) *Serve
 
 	return nil
 }
+
+// FindServerMetadataByServerID finds the metadata for the server with the specified Id (nil if the server is not known).
+func (service *Service) FindServerMetadataByServerID(serverID string) *ServerMetadata {
+	service.acquireStateLock("FindServerMetadataByServerID")
+	defer service.releaseStateLock("FindServerMetadataByServerID")
+
+	for _, serverMetadata := range service.ServerMetadataByMACAddress {
+		if serverMetadata.ID == serverID {
+			return &serverMetadata
+		}
+	}
+
+	return nil
+}
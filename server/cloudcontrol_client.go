@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+)
+
+// CloudControlClient represents the CloudControl API operations used by the service.
+//
+// This is satisfied by *compute.Client (and by the fake in the cloudcontroltest package).
+type CloudControlClient interface {
+	// GetVLAN retrieves the VLAN with the specified Id (nil if not found).
+	GetVLAN(id string) (*compute.VLAN, error)
+
+	// GetNetworkDomain retrieves the network domain with the specified Id (nil if not found).
+	GetNetworkDomain(id string) (*compute.NetworkDomain, error)
+
+	// ListServersInNetworkDomain retrieves a page of servers in the specified network domain.
+	ListServersInNetworkDomain(networkDomainID string, paging *compute.Paging) (*compute.Servers, error)
+
+	// GetAssetTags retrieves a page of tags applied to the specified asset.
+	GetAssetTags(assetID string, assetType string, paging *compute.Paging) (*compute.TagDetails, error)
+
+	// GetAssetTagsByType retrieves a page of tags applied to assets of the specified type in the specified datacenter.
+	GetAssetTagsByType(assetType string, datacenterID string, paging *compute.Paging) (*compute.TagDetails, error)
+
+	// ListNATRules retrieves a page of NAT rules in the specified network domain.
+	ListNATRules(networkDomainID string, paging *compute.Paging) (*compute.NATRules, error)
+
+	// ListVirtualListenersInNetworkDomain retrieves a page of virtual listeners in the specified network domain.
+	ListVirtualListenersInNetworkDomain(networkDomainID string, paging *compute.Paging) (*compute.VirtualListeners, error)
+}
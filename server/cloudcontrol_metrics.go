@@ -0,0 +1,50 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+// Metrics for refreshes of server metadata (published via expvar as "cloudcontrol_refresh").
+//
+//	refreshes                          - the number of refreshes attempted.
+//	refresh_failures                   - the number of refreshes that failed.
+//	tag_requests                       - the number of CloudControl API requests made for server tags.
+//	tag_cache_hits                     - the number of servers whose tags were reused from the tag cache.
+//	last_refresh_duration_ms           - how long the last successful refresh took.
+//	last_server_list_duration_ms       - how long the last successful refresh spent listing servers.
+//	last_tag_fetch_duration_ms         - how long the last successful refresh spent fetching server tags.
+//	last_refresh_time                  - when the last successful refresh completed (RFC 3339).
+//	server_metadata_age_seconds        - the age of the server metadata currently in use.
+//	snapshot_age_seconds               - the time since the server metadata snapshot (if any) was last written or confirmed as current.
+var refreshMetrics = expvar.NewMap("cloudcontrol_refresh")
+
+// Publish metrics that are calculated when they are read (e.g. the age of server metadata).
+func (service *Service) publishRefreshMetrics() {
+	refreshMetrics.Set("server_metadata_age_seconds", expvar.Func(func() interface{} {
+		return service.ServerMetadataAge().Seconds()
+	}))
+	refreshMetrics.Set("snapshot_age_seconds", expvar.Func(func() interface{} {
+		return service.SnapshotAge().Seconds()
+	}))
+}
+
+// Convert a duration into a metric value (in milliseconds).
+func durationMetric(duration time.Duration) *expvar.Float {
+	metric := new(expvar.Float)
+	metric.Set(
+		duration.Seconds() * 1000,
+	)
+
+	return metric
+}
+
+// Convert a date / time into a metric value.
+func timeMetric(value time.Time) *expvar.String {
+	metric := new(expvar.String)
+	metric.Set(
+		value.Format(time.RFC3339),
+	)
+
+	return metric
+}
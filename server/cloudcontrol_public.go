@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+	"github.com/miekg/dns"
+)
+
+// Add records for public (externally-mapped) addresses to the public view of the pseudo-zone.
+//
+// Servers are mapped to public addresses using the network domain's NAT rules (hostNamesByPrivateIPv4 maps private IPv4 addresses to host names); load-balancer virtual listeners are named after the listener.
+func (service *Service) readPublicDNSRecords(target *CloudControlTarget, dnsData *DNSData, hostNamesByPrivateIPv4 map[string]string) error {
+	publicDNSDomain := target.PublicDNSDomainName(service)
+
+	natRules, err := service.getAllNATRules(target)
+	if err != nil {
+		return err
+	}
+
+	for _, natRule := range natRules {
+		hostName, ok := hostNamesByPrivateIPv4[natRule.InternalIPAddress]
+		if !ok {
+			continue // Not a server (e.g. a VIP, or a server that is being deployed).
+		}
+
+		externalIP := net.ParseIP(natRule.ExternalIPAddress)
+		if externalIP == nil {
+			continue
+		}
+
+		publicFQDN := dns.Fqdn(hostName + "." + publicDNSDomain)
+		dnsData.Add(publicFQDN, externalIP)
+
+		if service.EnableDebugLogging {
+			log.Printf("\tNAT %s -> %s (%s)\n",
+				natRule.ExternalIPAddress,
+				natRule.InternalIPAddress,
+				publicFQDN,
+			)
+		}
+	}
+
+	virtualListeners, err := service.getAllVirtualListeners(target)
+	if err != nil {
+		return err
+	}
+
+	for _, virtualListener := range virtualListeners {
+		if virtualListener.ListenerIPAddress == nil {
+			continue // Being deployed or destroyed.
+		}
+
+		listenerIP := net.ParseIP(*virtualListener.ListenerIPAddress)
+		if listenerIP == nil {
+			continue
+		}
+
+		listenerLabel := toDNSLabel(virtualListener.Name)
+		if listenerLabel == "" {
+			continue
+		}
+
+		publicFQDN := dns.Fqdn(listenerLabel + "." + publicDNSDomain)
+		existingRecords := dnsData.FindA(publicFQDN)
+		if len(existingRecords) > 0 && !containsIPv4Address(existingRecords, listenerIP) {
+			log.Printf("Ignoring virtual listener '%s' (Id = '%s'): name '%s' is already in use.",
+				virtualListener.Name,
+				virtualListener.ID,
+				publicFQDN,
+			)
+
+			continue
+		}
+		dnsData.Add(publicFQDN, listenerIP)
+
+		if service.EnableDebugLogging {
+			log.Printf("\tVIP %s (%s)\n",
+				*virtualListener.ListenerIPAddress,
+				publicFQDN,
+			)
+		}
+	}
+
+	return nil
+}
+
+// Get all NAT rules in a CloudControl target's network domain.
+func (service *Service) getAllNATRules(target *CloudControlTarget) ([]compute.NATRule, error) {
+	var allNATRules []compute.NATRule
+
+	page := compute.DefaultPaging()
+	page.PageSize = 50
+
+	for {
+		natRules, err := target.Client.ListNATRules(target.NetworkDomain.ID, page)
+		if err != nil {
+			return nil, err
+		}
+		if natRules.IsEmpty() {
+			break
+		}
+
+		allNATRules = append(allNATRules, natRules.Rules...)
+
+		page.Next()
+	}
+
+	return allNATRules, nil
+}
+
+// Get all load-balancer virtual listeners in a CloudControl target's network domain.
+func (service *Service) getAllVirtualListeners(target *CloudControlTarget) ([]compute.VirtualListener, error) {
+	var allVirtualListeners []compute.VirtualListener
+
+	page := compute.DefaultPaging()
+	page.PageSize = 50
+
+	for {
+		virtualListeners, err := target.Client.ListVirtualListenersInNetworkDomain(target.NetworkDomain.ID, page)
+		if err != nil {
+			return nil, err
+		}
+		if virtualListeners.IsEmpty() {
+			break
+		}
+
+		allVirtualListeners = append(allVirtualListeners, virtualListeners.Items...)
+
+		page.Next()
+	}
+
+	return allVirtualListeners, nil
+}
+
+// Determine whether a set of A records includes the specified address.
+func containsIPv4Address(records []dns.A, ip net.IP) bool {
+	for _, record := range records {
+		if record.A.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// The maximum number of requests for an immediate refresh that can be waiting at any time.
+const maxPendingRefreshRequests = 100
+
+// refreshBackoffError indicates that an immediate refresh was not performed because refreshes are backing off after consecutive failures.
+type refreshBackoffError struct {
+	ConsecutiveFailures int
+	RetryAfter          time.Duration
+}
+
+// A request for an immediate refresh of server metadata.
+type refreshRequest struct {
+	// The providers to refresh (nil to refresh all of them).
+	Providers []MetadataProvider
+
+	// Receives the result of the refresh.
+	Reply chan error
+}
+
+func (err *refreshBackoffError) Error() string {
+	return fmt.Sprintf("refreshes are backing off after %d consecutive failures (next refresh in %s)",
+		err.ConsecutiveFailures,
+		err.RetryAfter/time.Second*time.Second,
+	)
+}
+
+// Start refreshing server metadata in the background (periodically, and on request).
+func (service *Service) startRefreshing(consecutiveFailures int) {
+	service.cancelRefresh = make(chan bool, 1)
+
+	service.fastRefreshLock.Lock()
+	service.fastRefresh = make(chan string, 1)
+	service.refreshRequests = make(chan *refreshRequest, maxPendingRefreshRequests)
+	service.refreshStopped = make(chan struct{})
+	fastRefresh := service.fastRefresh
+	refreshRequests := service.refreshRequests
+	refreshStopped := service.refreshStopped
+	service.fastRefreshLock.Unlock()
+
+	go func() {
+		defer close(refreshStopped)
+
+		service.refreshServerMetadataPeriodically(service.cancelRefresh, fastRefresh, refreshRequests, consecutiveFailures)
+	}()
+}
+
+// Stop refreshing server metadata in the background.
+func (service *Service) stopRefreshing() {
+	if service.cancelRefresh != nil {
+		service.cancelRefresh <- true
+	}
+	service.cancelRefresh = nil
+
+	service.fastRefreshLock.Lock()
+	service.fastRefresh = nil
+	service.refreshRequests = nil
+	service.refreshStopped = nil
+	service.fastRefreshLock.Unlock()
+}
+
+// Periodically refresh server metadata from CloudControl (until the refresh is cancelled).
+//
+// After a failed refresh, the next refresh is delayed using exponential backoff (with jitter) so that CloudControl is not hammered during an outage.
+// If only some providers failed, the refresh does not back off (each failed provider backs off independently; see readServerMetadata).
+// All refreshes (including those requested via RequestRefresh) are performed here, one at a time, so that server metadata is always applied in the order it was read.
+func (service *Service) refreshServerMetadataPeriodically(cancelRefresh <-chan bool, fastRefresh <-chan string, refreshRequests <-chan *refreshRequest, consecutiveFailures int) {
+	nextRefresh := time.Now().Add(
+		service.nextRefreshDelay(consecutiveFailures),
+	)
+	refreshTimer := time.NewTimer(time.Until(nextRefresh))
+	defer refreshTimer.Stop()
+
+	for {
+		var (
+			replies   []chan error
+			providers []MetadataProvider // nil to refresh all providers
+		)
+
+		select {
+		case <-cancelRefresh:
+			return // Stopped
+
+		case macAddress := <-fastRefresh:
+			if consecutiveFailures > 0 {
+				if service.EnableDebugLogging {
+					log.Printf("Ignoring fast-path refresh for MAC address %s (CloudControl refresh is backing off).", macAddress)
+				}
+
+				continue
+			}
+
+			log.Printf("Refreshing server MAC addresses (unknown MAC address %s)...", macAddress)
+
+		case request := <-refreshRequests:
+			// Requests that arrived while the previous refresh was in progress share a single refresh (of all the providers they requested).
+			requests := []*refreshRequest{request}
+			for pending := len(refreshRequests); pending > 0; pending-- {
+				requests = append(requests, <-refreshRequests)
+			}
+			for _, request := range requests {
+				replies = append(replies, request.Reply)
+			}
+			providers = combineRefreshProviders(requests)
+
+			if consecutiveFailures > 0 {
+				err := &refreshBackoffError{
+					ConsecutiveFailures: consecutiveFailures,
+					RetryAfter:          time.Until(nextRefresh),
+				}
+				for _, reply := range replies {
+					reply <- err
+				}
+
+				continue
+			}
+
+			if service.EnableDebugLogging {
+				log.Printf("Refreshing server MAC addresses (%d requests)...", len(replies))
+			}
+
+		case <-refreshTimer.C:
+			if service.EnableDebugLogging {
+				log.Printf("Refreshing server MAC addresses...")
+			}
+		}
+
+		err := service.refreshServerMetadataInternal(true, providers)
+		if _, isPartial := err.(*partialRefreshError); isPartial {
+			// Providers that failed back off independently; the others are still refreshed as usual.
+			consecutiveFailures = 0
+
+			log.Printf("Refreshed servers, but some providers failed (server metadata is %s old): %s",
+				service.ServerMetadataAge()/time.Second*time.Second,
+				err.Error(),
+			)
+		} else if err != nil {
+			consecutiveFailures++
+
+			log.Printf("Error refreshing servers (%d consecutive failures; server metadata is %s old): %s",
+				consecutiveFailures,
+				service.ServerMetadataAge()/time.Second*time.Second,
+				err.Error(),
+			)
+		} else {
+			consecutiveFailures = 0
+
+			if service.EnableDebugLogging {
+				log.Printf("Refreshed server MAC addresses.")
+			}
+		}
+		for _, reply := range replies {
+			reply <- err
+		}
+
+		// Restart the timer (it may or may not have already fired).
+		if !refreshTimer.Stop() {
+			select {
+			case <-refreshTimer.C:
+			default:
+			}
+		}
+		nextRefresh = time.Now().Add(
+			service.nextRefreshDelay(consecutiveFailures),
+		)
+		refreshTimer.Reset(time.Until(nextRefresh))
+	}
+}
+
+// RequestRefresh requests an immediate refresh of server metadata from the specified providers (or from all providers, if none are specified), and waits for it to complete.
+//
+// Requests that arrive while a refresh is in progress share a single follow-up refresh.
+// If refreshes are backing off after consecutive failures, no refresh is performed and a *refreshBackoffError is returned.
+func (service *Service) RequestRefresh(providers ...MetadataProvider) error {
+	service.fastRefreshLock.Lock()
+	refreshRequests := service.refreshRequests
+	refreshStopped := service.refreshStopped
+	service.fastRefreshLock.Unlock()
+
+	if refreshRequests == nil {
+		return fmt.Errorf("server metadata is not being refreshed (the service is not running)")
+	}
+
+	reply := make(chan error, 1)
+	request := &refreshRequest{
+		Providers: providers,
+		Reply:     reply,
+	}
+	select {
+	case refreshRequests <- request:
+	case <-refreshStopped:
+		return fmt.Errorf("server metadata is no longer being refreshed (the service has stopped)")
+	default:
+		return fmt.Errorf("too many pending refresh requests")
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-refreshStopped:
+		return fmt.Errorf("server metadata is no longer being refreshed (the service has stopped)")
+	}
+}
+
+// Combine the providers requested by a set of refresh requests (nil if any of them requested all providers).
+func combineRefreshProviders(requests []*refreshRequest) []MetadataProvider {
+	var providers []MetadataProvider
+	requested := make(map[MetadataProvider]bool)
+	for _, request := range requests {
+		if len(request.Providers) == 0 {
+			return nil
+		}
+
+		for _, provider := range request.Providers {
+			if !requested[provider] {
+				requested[provider] = true
+				providers = append(providers, provider)
+			}
+		}
+	}
+
+	return providers
+}
+
+// Determine the delay before the next refresh of server metadata.
+func (service *Service) nextRefreshDelay(consecutiveFailures int) time.Duration {
+	if consecutiveFailures == 0 {
+		return service.RefreshInterval
+	}
+
+	delay := service.RefreshInterval
+	for failure := 0; failure < consecutiveFailures && delay < service.MaxRefreshBackoff; failure++ {
+		delay *= 2
+	}
+	if delay > service.MaxRefreshBackoff {
+		delay = service.MaxRefreshBackoff
+	}
+
+	// Jitter (between 50% and 100% of the delay) prevents multiple instances from retrying in lock-step.
+	halfDelay := delay / 2
+
+	return halfDelay + time.Duration(rand.Int63n(int64(halfDelay)+1))
+}
+
+// RequestFastRefresh requests an immediate refresh of server metadata because a DHCP client with an unknown MAC address has been seen (e.g. a newly-deployed server).
+//
+// Fast-path refreshes are rate-limited (at most one per cloudcontrol.fast_refresh_interval).
+func (service *Service) RequestFastRefresh(macAddress string) {
+	service.fastRefreshLock.Lock()
+	defer service.fastRefreshLock.Unlock()
+
+	if service.fastRefresh == nil || service.FastRefreshInterval <= 0 {
+		return // Fast-path refresh is disabled (or the service is not running).
+	}
+
+	now := time.Now()
+	if now.Sub(service.lastFastRefresh) < service.FastRefreshInterval {
+		if service.EnableDebugLogging {
+			log.Printf("Not refreshing server MAC addresses for unknown MAC address %s (last fast-path refresh was %s ago).",
+				macAddress,
+				now.Sub(service.lastFastRefresh),
+			)
+		}
+
+		return
+	}
+
+	select {
+	case service.fastRefresh <- macAddress:
+		service.lastFastRefresh = now
+	default:
+		// A refresh is already pending.
+	}
+}
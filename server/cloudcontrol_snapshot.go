@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The current version of the server metadata snapshot format.
+const serverMetadataSnapshotVersion = 1
+
+// ServerMetadataSnapshot represents a snapshot of server metadata (and the corresponding DNS data) read from CloudControl.
+//
+// If CloudControl is unreachable at startup, the last snapshot is used instead (so existing servers can still boot).
+type ServerMetadataSnapshot struct {
+	// The snapshot format version.
+	Version int `json:"version"`
+
+	// The date and time when the server metadata was read from CloudControl.
+	Created time.Time `json:"created"`
+
+	// Server metadata, keyed by MAC address.
+	ServerMetadataByMACAddress map[string]ServerMetadata `json:"servers_by_mac_address"`
+
+	// DNS records (in zone-file format).
+	DNSRecords []string `json:"dns_records"`
+}
+
+// ServerMetadataAge gets the age of the server metadata currently in use (i.e. the time since it was read from CloudControl).
+func (service *Service) ServerMetadataAge() time.Duration {
+	service.acquireStateLock("ServerMetadataAge")
+	defer service.releaseStateLock("ServerMetadataAge")
+
+	if service.ServerMetadataUpdated.IsZero() {
+		return 0
+	}
+
+	return time.Since(service.ServerMetadataUpdated)
+}
+
+// SnapshotAge gets the time since the server metadata snapshot was last written (or confirmed as current); 0 if there is no snapshot.
+func (service *Service) SnapshotAge() time.Duration {
+	service.snapshotLock.Lock()
+	defer service.snapshotLock.Unlock()
+
+	if service.snapshotUpdated.IsZero() {
+		return 0
+	}
+
+	return time.Since(service.snapshotUpdated)
+}
+
+// Get the contents of a snapshot, excluding its creation date (used to determine whether the snapshot has changed).
+func serverMetadataSnapshotContents(snapshot ServerMetadataSnapshot) ([]byte, error) {
+	snapshot.Created = time.Time{}
+
+	return json.Marshal(snapshot)
+}
+
+// Write a snapshot of server metadata (and DNS data) to the snapshot file.
+//
+// If the server metadata has not changed since the snapshot was last written, the snapshot file is not rewritten (only its modification time is updated, to show that it is still current).
+func (service *Service) writeServerMetadataSnapshot(serverMetadataByMACAddress map[string]ServerMetadata, dnsData *DNSData, created time.Time) error {
+	snapshot := ServerMetadataSnapshot{
+		Version:                    serverMetadataSnapshotVersion,
+		Created:                    created.UTC(),
+		ServerMetadataByMACAddress: make(map[string]ServerMetadata),
+	}
+	for macAddress, serverMetadata := range serverMetadataByMACAddress {
+		if serverMetadata.IsStaticReservation {
+			continue // Static reservations always come from configuration.
+		}
+
+		snapshot.ServerMetadataByMACAddress[macAddress] = serverMetadata
+	}
+	for _, record := range dnsData.ZoneRecords() {
+		snapshot.DNSRecords = append(snapshot.DNSRecords, record.String())
+	}
+	for _, record := range dnsData.ReverseRecords() {
+		snapshot.DNSRecords = append(snapshot.DNSRecords, record.String())
+	}
+
+	snapshotContents, err := serverMetadataSnapshotContents(snapshot)
+	if err != nil {
+		return err
+	}
+
+	service.snapshotLock.Lock()
+	defer service.snapshotLock.Unlock()
+
+	if bytes.Equal(snapshotContents, service.snapshotContents) {
+		err = os.Chtimes(service.SnapshotFile, created, created)
+		if err != nil {
+			return err
+		}
+		service.snapshotUpdated = created
+
+		return nil
+	}
+
+	snapshotData, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a partially-written snapshot never replaces the last good one.
+	snapshotFile, err := ioutil.TempFile(
+		filepath.Dir(service.SnapshotFile),
+		filepath.Base(service.SnapshotFile)+".tmp",
+	)
+	if err != nil {
+		return err
+	}
+	_, err = snapshotFile.Write(snapshotData)
+	if err == nil {
+		err = snapshotFile.Sync()
+	}
+	closeErr := snapshotFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(snapshotFile.Name())
+
+		return err
+	}
+
+	err = os.Rename(snapshotFile.Name(), service.SnapshotFile)
+	if err != nil {
+		return err
+	}
+	service.snapshotContents = snapshotContents
+	service.snapshotUpdated = created
+
+	return nil
+}
+
+// Read a snapshot of server metadata (and DNS data) from the snapshot file.
+//
+// The snapshot's creation date is advanced to the file's modification time if the snapshot was confirmed as current after it was written.
+func (service *Service) readServerMetadataSnapshot() (*ServerMetadataSnapshot, *DNSData, error) {
+	snapshotInfo, err := os.Stat(service.SnapshotFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshotData, err := ioutil.ReadFile(service.SnapshotFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snapshot := &ServerMetadataSnapshot{}
+	err = json.Unmarshal(snapshotData, snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+	if snapshot.Version != serverMetadataSnapshotVersion {
+		return nil, nil, fmt.Errorf("unsupported snapshot version %d (expected %d)", snapshot.Version, serverMetadataSnapshotVersion)
+	}
+	if snapshotInfo.ModTime().After(snapshot.Created) {
+		snapshot.Created = snapshotInfo.ModTime()
+	}
+
+	dnsData := service.newDNSData()
+	for _, recordText := range snapshot.DNSRecords {
+		record, err := dns.NewRR(recordText)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid DNS record '%s': %s", recordText, err.Error())
+		}
+		if record == nil {
+			continue
+		}
+
+		err = dnsData.AddRecord(record)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid DNS record '%s': %s", recordText, err.Error())
+		}
+	}
+
+	return snapshot, &dnsData, nil
+}
+
+// Load server metadata (and DNS data) from the snapshot file (used when CloudControl is unreachable).
+//
+// The caller must hold the state lock.
+func (service *Service) loadServerMetadataSnapshot() error {
+	snapshot, dnsData, err := service.readServerMetadataSnapshot()
+	if err != nil {
+		return err
+	}
+
+	// Avoid rewriting the snapshot if CloudControl returns the same server metadata later.
+	snapshotContents, err := serverMetadataSnapshotContents(*snapshot)
+	if err != nil {
+		return err
+	}
+	service.snapshotLock.Lock()
+	service.snapshotContents = snapshotContents
+	service.snapshotUpdated = snapshot.Created
+	service.snapshotLock.Unlock()
+
+	// The snapshot stands in for providers that have not been read successfully (server metadata from providers that have been read, including static reservations, takes precedence).
+	service.metadataProviderResultsLock.Lock()
+	service.snapshotResult = &metadataProviderResult{
+		ServerMetadataByMACAddress: snapshot.ServerMetadataByMACAddress,
+		DNSData:                    dnsData,
+		Read:                       snapshot.Created,
+	}
+	serverMetadataByMACAddress, mergedDNSData, updated := service.mergeServerMetadata()
+	service.metadataProviderResultsLock.Unlock()
+
+	service.applyServerMetadata(serverMetadataByMACAddress, mergedDNSData, updated)
+
+	log.Printf("Loaded server metadata snapshot from '%s' (%d network adapters, %s old).",
+		service.SnapshotFile,
+		len(snapshot.ServerMetadataByMACAddress),
+		time.Since(snapshot.Created)/time.Second*time.Second,
+	)
+
+	return nil
+}
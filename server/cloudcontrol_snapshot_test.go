@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/DimensionDataResearch/mcp2-dhcp-server/server/cloudcontroltest"
+)
+
+// Read the snapshot file's creation date.
+func readSnapshotCreated(t *testing.T, snapshotFile string) string {
+	snapshotData, err := ioutil.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot ServerMetadataSnapshot
+	err = json.Unmarshal(snapshotData, &snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return snapshot.Created.String()
+}
+
+func TestServerMetadataSnapshot(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"cloudcontrol.snapshot_file": snapshotFile,
+	})
+
+	err := service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := readSnapshotCreated(t, snapshotFile)
+	if service.SnapshotAge() <= 0 {
+		t.Fatalf("expected snapshot age to be known")
+	}
+
+	// Unchanged server metadata does not rewrite the snapshot.
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readSnapshotCreated(t, snapshotFile) != created {
+		t.Fatalf("expected snapshot not to be rewritten when server metadata is unchanged")
+	}
+
+	// Move db1 to a new IPv4 address.
+	fixture, err := cloudcontroltest.LoadFixture("testdata/cloudcontrol/basic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := range fixture.Servers {
+		if fixture.Servers[index].Name == "db1" {
+			newIPv4 := "192.168.70.21"
+			fixture.Servers[index].Network.PrimaryAdapter.PrivateIPv4Address = &newIPv4
+		}
+	}
+	client.SetFixture(fixture)
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readSnapshotCreated(t, snapshotFile) == created {
+		t.Fatalf("expected snapshot to be rewritten when server metadata changes")
+	}
+
+	// A new instance can start from the snapshot.
+	restartedService, _ := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"cloudcontrol.snapshot_file": snapshotFile,
+	})
+	err = restartedService.loadServerMetadataSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverMetadata := restartedService.FindServerMetadataByMACAddress("00:50:56:00:00:01"); serverMetadata == nil || serverMetadata.Name != "web1" {
+		t.Fatalf("expected server 'web1' from snapshot, got %#v", serverMetadata)
+	}
+	if restartedService.SnapshotAge() <= 0 || restartedService.ServerMetadataAge() <= 0 {
+		t.Fatalf("expected snapshot and server metadata ages to be known")
+	}
+}
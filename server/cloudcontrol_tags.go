@@ -0,0 +1,185 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+)
+
+// Tags for a server (as last fetched from CloudControl).
+type cachedServerTags struct {
+	Tags    []compute.TagDetail
+	Fetched time.Time
+}
+
+// Get tags for the specified servers (in a CloudControl target's network domain), keyed by server Id.
+//
+// Tags are fetched for each server (up to TagFetchConcurrency servers at a time), rather than for every server in the datacenter.
+// If tags must be fetched for more than TagFetchMaxServers servers, tags for every server in the datacenter are listed instead (which takes fewer API calls).
+// CloudControl does not support conditional requests for tags, so if TagCacheTTL is non-zero, tags fetched less than TagCacheTTL ago are reused as-is.
+func (service *Service) getServerTags(target *CloudControlTarget, servers []compute.Server) (map[string][]compute.TagDetail, error) {
+	started := time.Now()
+
+	target.serverTagCacheLock.Lock()
+	defer target.serverTagCacheLock.Unlock()
+
+	serverTags := make(map[string][]compute.TagDetail)
+	var uncachedServerIDs []string
+	for _, server := range servers {
+		cachedTags, ok := target.serverTagCache[server.ID]
+		if ok && service.TagCacheTTL > 0 && started.Sub(cachedTags.Fetched) < service.TagCacheTTL {
+			serverTags[server.ID] = cachedTags.Tags
+			refreshMetrics.Add("tag_cache_hits", 1)
+
+			continue
+		}
+
+		uncachedServerIDs = append(uncachedServerIDs, server.ID)
+	}
+
+	var err error
+	if len(uncachedServerIDs) > service.TagFetchMaxServers {
+		err = service.fetchDatacenterServerTags(target, uncachedServerIDs, serverTags)
+	} else {
+		err = service.fetchServerTagsConcurrently(target, uncachedServerIDs, serverTags)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Forget about servers that no longer exist.
+	for serverID := range target.serverTagCache {
+		if _, ok := serverTags[serverID]; !ok {
+			delete(target.serverTagCache, serverID)
+		}
+	}
+
+	refreshMetrics.Set("last_tag_fetch_duration_ms", durationMetric(time.Since(started)))
+
+	return serverTags, nil
+}
+
+// Fetch tags for the specified servers (up to TagFetchConcurrency servers at a time), adding them to serverTags (and the target's tag cache).
+//
+// The caller must hold the target's tag cache lock.
+func (service *Service) fetchServerTagsConcurrently(target *CloudControlTarget, serverIDs []string, serverTags map[string][]compute.TagDetail) error {
+	serverIDQueue := make(chan string, len(serverIDs))
+	for _, serverID := range serverIDs {
+		serverIDQueue <- serverID
+	}
+	close(serverIDQueue)
+
+	workerCount := service.TagFetchConcurrency
+	if workerCount > len(serverIDQueue) {
+		workerCount = len(serverIDQueue)
+	}
+
+	var (
+		resultLock = &sync.Mutex{}
+		firstError error
+		workers    sync.WaitGroup
+	)
+	for worker := 0; worker < workerCount; worker++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+
+			for serverID := range serverIDQueue {
+				tags, err := service.fetchServerTags(target, serverID)
+
+				resultLock.Lock()
+				if err != nil {
+					if firstError == nil {
+						firstError = err
+					}
+				} else {
+					serverTags[serverID] = tags
+					target.serverTagCache[serverID] = cachedServerTags{
+						Tags:    tags,
+						Fetched: time.Now(),
+					}
+				}
+				resultLock.Unlock()
+			}
+		}()
+	}
+	workers.Wait()
+
+	return firstError
+}
+
+// Fetch tags for the specified servers by listing the tags for every server in the target's datacenter, adding them to serverTags (and the target's tag cache).
+//
+// The caller must hold the target's tag cache lock.
+func (service *Service) fetchDatacenterServerTags(target *CloudControlTarget, serverIDs []string, serverTags map[string][]compute.TagDetail) error {
+	datacenterServerTags := make(map[string][]compute.TagDetail)
+
+	tagPage := compute.DefaultPaging()
+	tagPage.PageSize = 250
+
+	for {
+		refreshMetrics.Add("tag_requests", 1)
+		tags, err := target.Client.GetAssetTagsByType(compute.AssetTypeServer, target.NetworkDomain.DatacenterID, tagPage)
+		if err != nil {
+			return err
+		}
+		if tags.IsEmpty() {
+			break // No more tags.
+		}
+
+		for _, tag := range tags.Items {
+			datacenterServerTags[tag.AssetID] = append(datacenterServerTags[tag.AssetID], tag)
+		}
+
+		// CloudControl bug - going past last page of tags returns UNEXPECTED_ERROR (i.e. there are no more tags).
+		if tags.IsLastPage() {
+			break
+		}
+
+		tagPage.Next()
+	}
+
+	fetched := time.Now()
+	for _, serverID := range serverIDs {
+		tags := datacenterServerTags[serverID]
+		serverTags[serverID] = tags
+		target.serverTagCache[serverID] = cachedServerTags{
+			Tags:    tags,
+			Fetched: fetched,
+		}
+	}
+
+	return nil
+}
+
+// Fetch all tags applied to the specified server.
+func (service *Service) fetchServerTags(target *CloudControlTarget, serverID string) ([]compute.TagDetail, error) {
+	var serverTags []compute.TagDetail
+
+	tagPage := compute.DefaultPaging()
+	tagPage.PageSize = 50
+
+	for {
+		refreshMetrics.Add("tag_requests", 1)
+		tags, err := target.Client.GetAssetTags(serverID, compute.AssetTypeServer, tagPage)
+		if err != nil {
+			return nil, err
+		}
+		if tags.IsEmpty() {
+			break // No more tags.
+		}
+
+		serverTags = append(serverTags, tags.Items...)
+
+		// CloudControl bug - going past last page of tags returns UNEXPECTED_ERROR (i.e. there are no more tags).
+		// We therefore manually determine whether this is the last page of results.
+		if tags.IsLastPage() {
+			break
+		}
+
+		tagPage.Next()
+	}
+
+	return serverTags, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+	"github.com/miekg/dns"
+)
+
+// CloudControlTarget represents a CloudControl network domain (identified by one of its VLANs) whose servers are served by the service.
+//
+// The primary target is the one identified by network.vlan_id (its VLAN is the network that the service is attached to); additional targets (e.g. network domains in other regions) only contribute server metadata and DNS records.
+type CloudControlTarget struct {
+	// A name for the target (used in log messages).
+	Name string
+
+	// The CloudControl region (and credentials) for the target.
+	Region   string
+	User     string
+	Password string
+
+	// The Id of the target VLAN.
+	VLANID string
+
+	// The subdomain (relative to the service's DNS domain) for the target's DNS records; empty to use the service's DNS domain itself.
+	Subdomain string
+
+	// Is this the primary target?
+	IsPrimary bool
+
+	Client        CloudControlClient
+	VLAN          *compute.VLAN
+	NetworkDomain *compute.NetworkDomain
+
+	serverTagCache     map[string]cachedServerTags
+	serverTagCacheLock *sync.Mutex
+}
+
+// NewCloudControlTarget creates a new CloudControlTarget.
+func NewCloudControlTarget(name string, region string, user string, password string, vlanID string, subdomain string) *CloudControlTarget {
+	return &CloudControlTarget{
+		Name:               name,
+		Region:             region,
+		User:               user,
+		Password:           password,
+		VLANID:             vlanID,
+		Subdomain:          subdomain,
+		serverTagCache:     make(map[string]cachedServerTags),
+		serverTagCacheLock: &sync.Mutex{},
+	}
+}
+
+// DNSDomainName gets the DNS domain for the target's records.
+func (target *CloudControlTarget) DNSDomainName(service *Service) string {
+	if target.Subdomain == "" {
+		return service.DNSDomainName
+	}
+
+	return dns.Fqdn(target.Subdomain + "." + service.DNSDomainName)
+}
+
+// PublicDNSDomainName gets the DNS domain for the target's public (externally-mapped) records.
+//
+// The target's subdomain goes below the public subdomain (e.g. "<server>.<target-subdomain>.public.<domain>"), so that split-horizon views can map public names back to private ones.
+func (target *CloudControlTarget) PublicDNSDomainName(service *Service) string {
+	if target.Subdomain == "" {
+		return service.PublicDNSDomain
+	}
+
+	return dns.Fqdn(target.Subdomain + "." + service.PublicDNSDomain)
+}
+
+// Connect to CloudControl and resolve the target's VLAN and network domain.
+func (service *Service) connectCloudControlTarget(target *CloudControlTarget) error {
+	if target.Client == nil {
+		target.Client = service.newCloudControlClient(target.Region, target.User, target.Password)
+	}
+
+	var err error
+	target.VLAN, err = target.Client.GetVLAN(target.VLANID)
+	if err != nil {
+		return err
+	} else if target.VLAN == nil {
+		return fmt.Errorf("Cannot find VLAN with Id '%s'", target.VLANID)
+	}
+	target.NetworkDomain, err = target.Client.GetNetworkDomain(target.VLAN.NetworkDomain.ID)
+	if err != nil {
+		return err
+	} else if target.NetworkDomain == nil {
+		return fmt.Errorf("Cannot find network domain with Id '%s'", target.VLAN.NetworkDomain.ID)
+	}
+
+	return nil
+}
+
+// Get the CloudControl targets whose servers are served by the service.
+func (service *Service) cloudControlTargets() []*CloudControlTarget {
+	var targets []*CloudControlTarget
+	for _, provider := range service.MetadataProviders {
+		if cloudControlProvider, ok := provider.(*CloudControlMetadataProvider); ok {
+			targets = append(targets, cloudControlProvider.target)
+		}
+	}
+
+	return targets
+}
+
+// Get the primary CloudControl target (nil if there is no primary target).
+func (service *Service) primaryCloudControlTarget() *CloudControlTarget {
+	return service.primaryCloudControlTargetIn(service.MetadataProviders)
+}
+
+// Create a new CloudControl API client (the default for Service.newCloudControlClient).
+func defaultCloudControlClient(region string, user string, password string) CloudControlClient {
+	return compute.NewClient(region, user, password)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/miekg/dns"
+)
+
+// Settings for a service with 2 CloudControl targets (the primary target, and network domain "Prod" in region "NA").
+var multiTargetSettings = map[string]interface{}{
+	"metadata.providers": []interface{}{
+		map[interface{}]interface{}{
+			"type": "cloudcontrol",
+		},
+		map[interface{}]interface{}{
+			"type":      "cloudcontrol",
+			"region":    "NA",
+			"vlan_id":   "vlan-na",
+			"subdomain": "na",
+		},
+	},
+}
+
+// Get the current value of a refresh metric ("" if it has not been set).
+func refreshMetricValue(name string) string {
+	value := refreshMetrics.Get(name)
+	if value == nil {
+		return ""
+	}
+
+	return value.String()
+}
+
+func TestMultipleCloudControlTargets(t *testing.T) {
+	clientsByRegion := newTestClients(t, map[string]string{
+		"":   "testdata/cloudcontrol/basic.json",
+		"NA": "testdata/cloudcontrol/na.json",
+	})
+	service := newTestServiceWithClients(t, clientsByRegion, multiTargetSettings)
+
+	// The primary target configures the network.
+	if service.VLAN == nil || service.VLAN.ID != "vlan-1" {
+		t.Fatalf("expected VLAN 'vlan-1', got %#v", service.VLAN)
+	}
+
+	targets := service.cloudControlTargets()
+	if len(targets) != 2 || targets[1].NetworkDomain == nil || targets[1].NetworkDomain.ID != "nd-na" {
+		t.Fatalf("expected network domain 'nd-na' for the second target, got %#v", targets)
+	}
+
+	// Servers from both targets share one MAC index; on conflict, the first target wins.
+	expectedIPsByMACAddress := map[string]string{
+		"00:50:56:00:00:01": "192.168.70.10",
+		"00:50:56:00:00:03": "192.168.70.20",
+		"00:50:56:00:01:01": "10.1.0.10",
+	}
+	for macAddress, expectedIP := range expectedIPsByMACAddress {
+		response := sendDHCP(t, service, dhcp.Discover, macAddress)
+		if dhcpMessageType(response) != dhcp.Offer || !response.YIAddr().Equal(net.ParseIP(expectedIP)) {
+			t.Errorf("%s: expected offer of %s, got %s %s", macAddress, expectedIP, dhcpMessageType(response), response.YIAddr())
+		}
+	}
+
+	// Each target's records are in its own subdomain.
+	testCases := []struct {
+		name            string
+		qtype           uint16
+		expectedAnswers []string
+	}{
+		{"web1.lab.mcp", dns.TypeA, []string{"web1.lab.mcp. A 192.168.70.10"}},
+		{"app1.na.lab.mcp", dns.TypeA, []string{"app1.na.lab.mcp. A 10.1.0.10"}},
+		{"api.na.lab.mcp", dns.TypeA, []string{"api.na.lab.mcp. CNAME app1.na.lab.mcp.", "app1.na.lab.mcp. A 10.1.0.10"}},
+		{"10.0.1.10.in-addr.arpa", dns.TypePTR, []string{"10.0.1.10.in-addr.arpa. PTR app1.na.lab.mcp."}},
+		{"clone.na.lab.mcp", dns.TypeA, []string{"clone.na.lab.mcp. A 10.1.0.11"}},
+	}
+	for _, testCase := range testCases {
+		answers := dnsAnswers(queryDNS(t, service, testCase.name, testCase.qtype))
+		if strings.Join(answers, "\n") != strings.Join(testCase.expectedAnswers, "\n") {
+			t.Errorf("%s %s: expected answers %q, got %q", testCase.name, dns.TypeToString[testCase.qtype], testCase.expectedAnswers, answers)
+		}
+	}
+}
+
+func TestMultipleCloudControlTargetsRefreshIndependently(t *testing.T) {
+	clientsByRegion := newTestClients(t, map[string]string{
+		"":   "testdata/cloudcontrol/basic.json",
+		"NA": "testdata/cloudcontrol/na.json",
+	})
+	service := newTestServiceWithClients(t, clientsByRegion, multiTargetSettings)
+
+	// If one target fails, the server metadata last read from it is still used (but the refresh still counts as failed).
+	naProvider := service.MetadataProviders[1]
+	previouslyRead := service.metadataProviderResults[naProvider].Read
+	failures := refreshMetricValue("refresh_failures")
+	clientsByRegion["NA"].SetError(fmt.Errorf("region unavailable"))
+	err := service.RefreshServerMetadata()
+	if err == nil || !strings.Contains(err.Error(), "region unavailable") {
+		t.Fatalf("expected the refresh to fail, got %v", err)
+	}
+	if refreshMetricValue("refresh_failures") == failures {
+		t.Errorf("expected refresh_failures to be incremented")
+	}
+	if !service.ServerMetadataUpdated.Equal(previouslyRead) {
+		t.Errorf("expected server metadata to be as old as the last successful read from the failed target (%s), got %s", previouslyRead, service.ServerMetadataUpdated)
+	}
+	if serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:01:01"); serverMetadata == nil || serverMetadata.Name != "app1" {
+		t.Fatalf("expected server 'app1' to be retained, got %#v", serverMetadata)
+	}
+	if calls := clientsByRegion[""].Calls("ListServersInNetworkDomain"); calls != 6 {
+		t.Fatalf("expected the primary target to be refreshed, got %d calls to ListServersInNetworkDomain", calls)
+	}
+}
+
+func TestMultipleCloudControlTargetsPartialFailure(t *testing.T) {
+	clientsByRegion := newTestClients(t, map[string]string{
+		"":   "testdata/cloudcontrol/basic.json",
+		"NA": "testdata/cloudcontrol/na.json",
+	})
+	service := newTestServiceWithClients(t, clientsByRegion, multiTargetSettings)
+
+	// A target that has never been read successfully contributes nothing, but does not prevent the other target from being refreshed.
+	naProvider := service.MetadataProviders[1]
+	delete(service.metadataProviderResults, naProvider)
+	clientsByRegion["NA"].SetError(fmt.Errorf("region unavailable"))
+	err := service.RefreshServerMetadata()
+	if _, isPartial := err.(*partialRefreshError); !isPartial || !strings.Contains(err.Error(), "region unavailable") {
+		t.Fatalf("expected a partial failure, got %v", err)
+	}
+	if serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:00:01"); serverMetadata == nil || serverMetadata.Name != "web1" {
+		t.Fatalf("expected server 'web1' from the primary target, got %#v", serverMetadata)
+	}
+	if serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:01:01"); serverMetadata != nil {
+		t.Fatalf("expected no server metadata from the failed target, got %#v", serverMetadata)
+	}
+
+	// The failed target backs off (without affecting the primary target).
+	naCalls := clientsByRegion["NA"].Calls("ListServersInNetworkDomain")
+	primaryCalls := clientsByRegion[""].Calls("ListServersInNetworkDomain")
+	err = service.RefreshServerMetadata()
+	if _, isPartial := err.(*partialRefreshError); !isPartial || !strings.Contains(err.Error(), "backing off") {
+		t.Fatalf("expected a partial failure while the failed target backs off, got %v", err)
+	}
+	if calls := clientsByRegion["NA"].Calls("ListServersInNetworkDomain"); calls != naCalls {
+		t.Fatalf("expected the failed target not to be read while it backs off, got %d calls to ListServersInNetworkDomain", calls-naCalls)
+	}
+	if calls := clientsByRegion[""].Calls("ListServersInNetworkDomain"); calls == primaryCalls {
+		t.Fatalf("expected the primary target to be refreshed while the failed target backs off")
+	}
+
+	// Once its backoff has elapsed, the target is read again.
+	clientsByRegion["NA"].SetError(nil)
+	service.metadataProviderBackoffs[naProvider].RetryAt = time.Now()
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:01:01"); serverMetadata == nil || serverMetadata.Name != "app1" {
+		t.Fatalf("expected server 'app1' once the target recovers, got %#v", serverMetadata)
+	}
+	if _, ok := service.metadataProviderBackoffs[naProvider]; ok {
+		t.Errorf("expected the target to stop backing off once it recovers")
+	}
+}
+
+func TestPartialFailureDoesNotBackOffRefreshes(t *testing.T) {
+	clientsByRegion := newTestClients(t, map[string]string{
+		"":   "testdata/cloudcontrol/basic.json",
+		"NA": "testdata/cloudcontrol/na.json",
+	})
+	service := newTestServiceWithClients(t, clientsByRegion, multiTargetSettings)
+	service.startRefreshing(0)
+	t.Cleanup(service.stopRefreshing)
+
+	clientsByRegion["NA"].SetError(fmt.Errorf("region unavailable"))
+	for attempt := 1; attempt <= 2; attempt++ {
+		err := service.RequestRefresh()
+		if _, isPartial := err.(*partialRefreshError); !isPartial {
+			t.Fatalf("attempt %d: expected a partial failure (not backoff), got %v", attempt, err)
+		}
+	}
+}
+
+func TestSnapshotStandsInForUnreadTarget(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	settings := map[string]interface{}{
+		"cloudcontrol.snapshot_file": snapshotFile,
+	}
+	for key, value := range multiTargetSettings {
+		settings[key] = value
+	}
+	clientsByRegion := newTestClients(t, map[string]string{
+		"":   "testdata/cloudcontrol/basic.json",
+		"NA": "testdata/cloudcontrol/na.json",
+	})
+	newTestServiceWithClients(t, clientsByRegion, settings) // Writes the snapshot.
+
+	// The restarted service has never read the NA target successfully.
+	restartedClientsByRegion := newTestClients(t, map[string]string{
+		"":   "testdata/cloudcontrol/basic.json",
+		"NA": "testdata/cloudcontrol/na.json",
+	})
+	restartedService := newTestServiceWithClients(t, restartedClientsByRegion, settings)
+	naProvider := restartedService.MetadataProviders[1]
+	delete(restartedService.metadataProviderResults, naProvider)
+	restartedClientsByRegion["NA"].SetError(fmt.Errorf("region unavailable"))
+	err := restartedService.RefreshServerMetadata()
+	if _, isPartial := err.(*partialRefreshError); !isPartial {
+		t.Fatalf("expected a partial failure, got %v", err)
+	}
+
+	err = restartedService.loadServerMetadataSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverMetadata := restartedService.FindServerMetadataByMACAddress("00:50:56:00:01:01"); serverMetadata == nil || serverMetadata.Name != "app1" {
+		t.Fatalf("expected server 'app1' from the snapshot, got %#v", serverMetadata)
+	}
+
+	// The snapshot keeps standing in for the target while it backs off.
+	err = restartedService.RefreshServerMetadata()
+	if _, isPartial := err.(*partialRefreshError); !isPartial {
+		t.Fatalf("expected a partial failure, got %v", err)
+	}
+	if serverMetadata := restartedService.FindServerMetadataByMACAddress("00:50:56:00:01:01"); serverMetadata == nil || serverMetadata.Name != "app1" {
+		t.Fatalf("expected server 'app1' from the snapshot, got %#v", serverMetadata)
+	}
+
+	// Once every target has been read, the snapshot is no longer used.
+	restartedClientsByRegion["NA"].SetError(nil)
+	restartedService.metadataProviderBackoffs[naProvider].RetryAt = time.Now()
+	err = restartedService.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restartedService.snapshotResult != nil {
+		t.Errorf("expected the snapshot to be discarded once every target has been read")
+	}
+}
@@ -0,0 +1,283 @@
+// Package cloudcontroltest provides an in-process stand-in for the CloudControl API (for testing).
+package cloudcontroltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+)
+
+// Fixture represents the CloudControl resources (in CloudControl API format) exposed by a FakeClient.
+type Fixture struct {
+	// The largest page size that the fake API will return (like CloudControl, larger requested page sizes are capped); 0 means no limit.
+	MaxPageSize int `json:"maxPageSize"`
+
+	VLANs            []compute.VLAN            `json:"vlans"`
+	NetworkDomains   []compute.NetworkDomain   `json:"networkDomains"`
+	Servers          []compute.Server          `json:"servers"`
+	Tags             []compute.TagDetail       `json:"tags"`
+	NATRules         []compute.NATRule         `json:"natRules"`
+	VirtualListeners []compute.VirtualListener `json:"virtualListeners"`
+}
+
+// LoadFixture loads a Fixture from a JSON file.
+func LoadFixture(fileName string) (*Fixture, error) {
+	fixtureData, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fixture := &Fixture{}
+	err = json.Unmarshal(fixtureData, fixture)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fixture '%s': %s", fileName, err.Error())
+	}
+
+	return fixture, nil
+}
+
+// FakeClient is an in-process stand-in for the CloudControl API client, whose responses come from a Fixture.
+//
+// Like the real API, requesting tags beyond the last page results in an error (rather than an empty page).
+type FakeClient struct {
+	fixture   *Fixture
+	err       error
+	calls     map[string]int
+	stateLock *sync.Mutex
+}
+
+// NewFakeClient creates a new FakeClient for the specified fixture.
+func NewFakeClient(fixture *Fixture) *FakeClient {
+	return &FakeClient{
+		fixture:   fixture,
+		calls:     make(map[string]int),
+		stateLock: &sync.Mutex{},
+	}
+}
+
+// SetFixture replaces the client's fixture (e.g. to simulate changes in CloudControl).
+func (client *FakeClient) SetFixture(fixture *Fixture) {
+	client.stateLock.Lock()
+	defer client.stateLock.Unlock()
+
+	client.fixture = fixture
+}
+
+// SetError causes all subsequent API calls to fail with the specified error (nil to simulate recovery).
+func (client *FakeClient) SetError(err error) {
+	client.stateLock.Lock()
+	defer client.stateLock.Unlock()
+
+	client.err = err
+}
+
+// Calls gets the number of calls made to the specified API operation (e.g. "ListServersInNetworkDomain").
+func (client *FakeClient) Calls(operation string) int {
+	client.stateLock.Lock()
+	defer client.stateLock.Unlock()
+
+	return client.calls[operation]
+}
+
+// GetVLAN retrieves the VLAN with the specified Id (nil if not found).
+func (client *FakeClient) GetVLAN(id string) (*compute.VLAN, error) {
+	fixture, err := client.beginCall("GetVLAN")
+	if err != nil {
+		return nil, err
+	}
+
+	for index := range fixture.VLANs {
+		if fixture.VLANs[index].ID == id {
+			vlan := fixture.VLANs[index]
+
+			return &vlan, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// GetNetworkDomain retrieves the network domain with the specified Id (nil if not found).
+func (client *FakeClient) GetNetworkDomain(id string) (*compute.NetworkDomain, error) {
+	fixture, err := client.beginCall("GetNetworkDomain")
+	if err != nil {
+		return nil, err
+	}
+
+	for index := range fixture.NetworkDomains {
+		if fixture.NetworkDomains[index].ID == id {
+			networkDomain := fixture.NetworkDomains[index]
+
+			return &networkDomain, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ListServersInNetworkDomain retrieves a page of servers in the specified network domain.
+func (client *FakeClient) ListServersInNetworkDomain(networkDomainID string, paging *compute.Paging) (*compute.Servers, error) {
+	fixture, err := client.beginCall("ListServersInNetworkDomain")
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []compute.Server
+	for _, server := range fixture.Servers {
+		if server.Network.NetworkDomainID == networkDomainID {
+			servers = append(servers, server)
+		}
+	}
+
+	start, end, pagedResult := fixture.page(len(servers), paging)
+
+	return &compute.Servers{
+		Items:       servers[start:end],
+		PagedResult: pagedResult,
+	}, nil
+}
+
+// GetAssetTags retrieves a page of tags applied to the specified asset.
+func (client *FakeClient) GetAssetTags(assetID string, assetType string, paging *compute.Paging) (*compute.TagDetails, error) {
+	fixture, err := client.beginCall("GetAssetTags")
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []compute.TagDetail
+	for _, tag := range fixture.Tags {
+		if tag.AssetType == assetType && tag.AssetID == assetID {
+			tags = append(tags, tag)
+		}
+	}
+
+	start, end, pagedResult := fixture.page(len(tags), paging)
+	if start > 0 && start >= len(tags) {
+		// CloudControl bug - going past the last page of tags returns UNEXPECTED_ERROR.
+		return nil, fmt.Errorf("UNEXPECTED_ERROR: an unexpected error has occurred (page %d of tags does not exist)", paging.PageNumber)
+	}
+
+	return &compute.TagDetails{
+		Items:       tags[start:end],
+		PagedResult: pagedResult,
+	}, nil
+}
+
+// GetAssetTagsByType retrieves a page of tags applied to assets of the specified type in the specified datacenter.
+func (client *FakeClient) GetAssetTagsByType(assetType string, datacenterID string, paging *compute.Paging) (*compute.TagDetails, error) {
+	fixture, err := client.beginCall("GetAssetTagsByType")
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []compute.TagDetail
+	for _, tag := range fixture.Tags {
+		if tag.AssetType == assetType && tag.DatacenterID == datacenterID {
+			tags = append(tags, tag)
+		}
+	}
+
+	start, end, pagedResult := fixture.page(len(tags), paging)
+	if start > 0 && start >= len(tags) {
+		// CloudControl bug - going past the last page of tags returns UNEXPECTED_ERROR.
+		return nil, fmt.Errorf("UNEXPECTED_ERROR: an unexpected error has occurred (page %d of tags does not exist)", paging.PageNumber)
+	}
+
+	return &compute.TagDetails{
+		Items:       tags[start:end],
+		PagedResult: pagedResult,
+	}, nil
+}
+
+// ListNATRules retrieves a page of NAT rules in the specified network domain.
+func (client *FakeClient) ListNATRules(networkDomainID string, paging *compute.Paging) (*compute.NATRules, error) {
+	fixture, err := client.beginCall("ListNATRules")
+	if err != nil {
+		return nil, err
+	}
+
+	var natRules []compute.NATRule
+	for _, natRule := range fixture.NATRules {
+		if natRule.NetworkDomainID == networkDomainID {
+			natRules = append(natRules, natRule)
+		}
+	}
+
+	start, end, pagedResult := fixture.page(len(natRules), paging)
+
+	return &compute.NATRules{
+		Rules:       natRules[start:end],
+		PagedResult: pagedResult,
+	}, nil
+}
+
+// ListVirtualListenersInNetworkDomain retrieves a page of virtual listeners in the specified network domain.
+func (client *FakeClient) ListVirtualListenersInNetworkDomain(networkDomainID string, paging *compute.Paging) (*compute.VirtualListeners, error) {
+	fixture, err := client.beginCall("ListVirtualListenersInNetworkDomain")
+	if err != nil {
+		return nil, err
+	}
+
+	var virtualListeners []compute.VirtualListener
+	for _, virtualListener := range fixture.VirtualListeners {
+		if virtualListener.NetworkDomainID == networkDomainID {
+			virtualListeners = append(virtualListeners, virtualListener)
+		}
+	}
+
+	start, end, pagedResult := fixture.page(len(virtualListeners), paging)
+
+	return &compute.VirtualListeners{
+		Items:       virtualListeners[start:end],
+		PagedResult: pagedResult,
+	}, nil
+}
+
+// Record a call to the specified operation, returning the current fixture (or the simulated error, if any).
+func (client *FakeClient) beginCall(operation string) (*Fixture, error) {
+	client.stateLock.Lock()
+	defer client.stateLock.Unlock()
+
+	client.calls[operation]++
+	if client.err != nil {
+		return nil, client.err
+	}
+
+	return client.fixture, nil
+}
+
+// Determine the range of items (and the paging details) for the requested page.
+func (fixture *Fixture) page(totalCount int, paging *compute.Paging) (start int, end int, pagedResult compute.PagedResult) {
+	pageNumber := paging.PageNumber
+	if pageNumber < 1 {
+		pageNumber = 1
+	}
+	pageSize := paging.PageSize
+	if fixture.MaxPageSize > 0 && (pageSize < 1 || pageSize > fixture.MaxPageSize) {
+		pageSize = fixture.MaxPageSize
+	}
+	if pageSize < 1 {
+		pageSize = totalCount
+	}
+
+	start = (pageNumber - 1) * pageSize
+	if start > totalCount {
+		start = totalCount
+	}
+	end = start + pageSize
+	if end > totalCount {
+		end = totalCount
+	}
+
+	pagedResult = compute.PagedResult{
+		PageNumber: pageNumber,
+		PageCount:  end - start,
+		PageSize:   pageSize,
+		TotalCount: totalCount,
+	}
+
+	return
+}
@@ -8,6 +8,17 @@ import (
 	"time"
 
 	dhcp "github.com/krolaw/dhcp4"
+	"github.com/miekg/dns"
+)
+
+// The Client FQDN option (RFC 4702).
+const dhcpOptionClientFQDN dhcp.OptionCode = 81
+
+// Flags for the Client FQDN option.
+const (
+	clientFQDNFlagServerUpdate byte = 0x01 // S: the server should perform (or has performed) the A record update.
+	clientFQDNFlagOverride     byte = 0x02 // O: the server has overridden the client's preference.
+	clientFQDNFlagEncoded      byte = 0x04 // E: the name is in canonical wire format.
 )
 
 // StaticReservation represents a static DHCP address reservation.
@@ -86,6 +97,21 @@ func (service *Service) handleDiscover(request dhcp.Packet, requestOptions dhcp.
 			clientMACAddress,
 		)
 
+		// It may be a newly-deployed server that we haven't seen yet.
+		service.RequestFastRefresh(clientMACAddress)
+
+		return service.noReply()
+	}
+
+	allowed, reason := service.isDHCPAllowed(*serverMetadata)
+	if !allowed {
+		log.Printf("[TXN: %s] Ignoring Discover from server %s (MAC address %s): %s (no reply will be sent).",
+			transactionID,
+			serverMetadata.Name,
+			clientMACAddress,
+			reason,
+		)
+
 		return service.noReply()
 	}
 
@@ -125,6 +151,18 @@ func (service *Service) handleRequest(request dhcp.Packet, requestOptions dhcp.O
 		return service.replyNAK(request)
 	}
 
+	allowed, reason := service.isDHCPAllowed(*serverMetadata)
+	if !allowed {
+		log.Printf("[TXN: %s] Refusing Request from server %s (MAC address %s): %s; send NAK reply.",
+			transactionID,
+			serverMetadata.Name,
+			clientMACAddress,
+			reason,
+		)
+
+		return service.replyNAK(request)
+	}
+
 	// Is this a renewal?
 	existingLease, ok := service.LeasesByMACAddress[clientMACAddress]
 	if ok && !existingLease.IsExpired() {
@@ -136,7 +174,10 @@ func (service *Service) handleRequest(request dhcp.Packet, requestOptions dhcp.O
 
 		service.renewLease(existingLease)
 
-		return service.replyACK(request, existingLease.IPAddress, requestOptions, *serverMetadata)
+		response = service.replyACK(request, existingLease.IPAddress, requestOptions, *serverMetadata)
+		service.registerClientDNSName(request, requestOptions, *serverMetadata, *existingLease, response)
+
+		return response
 	}
 
 	// New lease
@@ -152,6 +193,20 @@ func (service *Service) handleRequest(request dhcp.Packet, requestOptions dhcp.O
 		return service.replyNAK(request)
 	}
 
+	// A client renewing (or rebinding) a lease on an address that is no longer the server's address (e.g. after its lease was revoked) must start again.
+	requestedIP := requestedIPAddress(request, requestOptions)
+	if requestedIP != nil && !requestedIP.Equal(targetIP) {
+		log.Printf("[TXN: %s] Server %s (MAC address %s) requested IPv4 address %s, but its IPv4 address is %s; send NAK reply.",
+			transactionID,
+			serverMetadata.Name,
+			clientMACAddress,
+			requestedIP.String(),
+			targetIP.String(),
+		)
+
+		return service.replyNAK(request)
+	}
+
 	log.Printf("[TXN: %s] Create lease on IPv4 address %s for server %s (MAC address %s) and send ACK reply.",
 		transactionID,
 		serverMetadata.Name,
@@ -160,7 +215,25 @@ func (service *Service) handleRequest(request dhcp.Packet, requestOptions dhcp.O
 	)
 	newLease := service.createLease(clientMACAddress, targetIP)
 
-	return service.replyACK(request, newLease.IPAddress, requestOptions, *serverMetadata)
+	response = service.replyACK(request, newLease.IPAddress, requestOptions, *serverMetadata)
+	service.registerClientDNSName(request, requestOptions, *serverMetadata, newLease, response)
+
+	return response
+}
+
+// Get the IPv4 address requested by a client (the Requested IP Address option, or the client's current address when renewing), or nil if it did not request a specific address.
+func requestedIPAddress(request dhcp.Packet, requestOptions dhcp.Options) net.IP {
+	requestedIP := net.IP(requestOptions[dhcp.OptionRequestedIPAddress])
+	if len(requestedIP) == net.IPv4len {
+		return requestedIP
+	}
+
+	clientIP := request.CIAddr()
+	if clientIP != nil && !clientIP.Equal(net.IPv4zero) {
+		return clientIP
+	}
+
+	return nil
 }
 
 // Handle a DHCP Release packet.
@@ -193,6 +266,10 @@ func (service *Service) handleRelease(request dhcp.Packet, requestOptions dhcp.O
 		)
 
 		service.expireLease(existingLease)
+
+		if service.EnableDNSRegistration {
+			service.unregisterDHCPClient(transactionID, clientMACAddress)
+		}
 	} else {
 		log.Printf("[TXN: %s] Server '%s' (%s) requested requested termination of expired or non-existent lease; request ignored.",
 			transactionID,
@@ -204,9 +281,37 @@ func (service *Service) handleRelease(request dhcp.Packet, requestOptions dhcp.O
 	return service.noReply() // No reply is necessary for Release.
 }
 
+// Register a DNS name for a client that is not a server in CloudControl (if enabled).
+//
+// The name comes from the Client FQDN (option 81) or Host Name (option 12) in the request, or the static reservation's host name.
+func (service *Service) registerClientDNSName(request dhcp.Packet, requestOptions dhcp.Options, serverMetadata ServerMetadata, lease Lease, response dhcp.Packet) {
+	if !service.EnableDNS || !service.EnableDNSRegistration || !serverMetadata.IsStaticReservation {
+		return
+	}
+
+	clientFQDN, clientFQDNFlags, hasClientFQDN := getClientFQDN(requestOptions)
+	hostName := clientFQDN
+	if hostName == "" {
+		hostName = getClientHostName(requestOptions)
+	}
+	if hostName == "" {
+		hostName = serverMetadata.HostName()
+	}
+
+	fqdn := service.registerDHCPClient(
+		getTransactionID(request),
+		request.CHAddr().String(),
+		hostName,
+		lease,
+	)
+	if fqdn != "" && hasClientFQDN {
+		addClientFQDNOption(response, clientFQDNFlags, fqdn)
+	}
+}
+
 // Create an empty reply packet (i.e. no reply should be sent)
 func (service *Service) noReply() dhcp.Packet {
-	return dhcp.Packet{}
+	return nil // A non-nil (even if empty) packet would be padded and sent.
 }
 
 // Create an Offer reply packet (in response to Discover packet).
@@ -217,9 +322,9 @@ func (service *Service) replyOffer(request dhcp.Packet, targetIP net.IP, request
 		service.DHCPOptions.SelectOrderOrAll(requestOptions[dhcp.OptionParameterRequestList]),
 	)
 
-	// Configure host name from server name.
+	// Configure host name from server name (or DNS name, if overridden).
 	reply.AddOption(dhcp.OptionHostName,
-		[]byte(serverMetadata.Name),
+		[]byte(serverMetadata.HostName()),
 	)
 
 	// Add DHCP options for PXE / iPXE, if required.
@@ -241,9 +346,9 @@ func (service *Service) replyACK(request dhcp.Packet, targetIP net.IP, requestOp
 		service.DHCPOptions.SelectOrderOrAll(requestOptions[dhcp.OptionParameterRequestList]),
 	)
 
-	// Configure host name from server name.
+	// Configure host name from server name (or DNS name, if overridden).
 	reply.AddOption(dhcp.OptionHostName,
-		[]byte(serverMetadata.Name),
+		[]byte(serverMetadata.HostName()),
 	)
 
 	// Add DHCP options for PXE / iPXE, if required.
@@ -398,6 +503,60 @@ func getUserClass(requestOptions dhcp.Options) string {
 	return ""
 }
 
+// Get the client's host name (option 12) from the request options.
+func getClientHostName(requestOptions dhcp.Options) string {
+	hostName, ok := requestOptions[dhcp.OptionHostName]
+	if ok {
+		return strings.TrimRight(string(hostName), "\x00")
+	}
+
+	return ""
+}
+
+// Get the client's fully-qualified domain name and flags (option 81, RFC 4702) from the request options.
+func getClientFQDN(requestOptions dhcp.Options) (fqdn string, flags byte, ok bool) {
+	clientFQDN, ok := requestOptions[dhcpOptionClientFQDN]
+	if !ok || len(clientFQDN) < 3 {
+		return "", 0, false
+	}
+
+	flags = clientFQDN[0]
+	if flags&clientFQDNFlagEncoded != 0 {
+		// Canonical wire format.
+		name, _, err := dns.UnpackDomainName(clientFQDN, 3)
+		if err != nil {
+			return "", flags, true
+		}
+
+		return strings.TrimSuffix(name, "."), flags, true
+	}
+
+	// Deprecated ASCII encoding.
+	return strings.TrimRight(string(clientFQDN[3:]), "\x00."), flags, true
+}
+
+// Add a Client FQDN option (option 81, RFC 4702) to a DHCP response, indicating that the server has registered the client's name.
+func addClientFQDNOption(response dhcp.Packet, requestFlags byte, fqdn string) {
+	flags := clientFQDNFlagServerUpdate | (requestFlags & clientFQDNFlagEncoded)
+	if requestFlags&clientFQDNFlagServerUpdate == 0 {
+		flags |= clientFQDNFlagOverride // Client asked to perform the update itself, but we did it.
+	}
+
+	value := []byte{flags, 255, 255}
+	if flags&clientFQDNFlagEncoded != 0 {
+		encodedName := make([]byte, 256)
+		length, err := dns.PackDomainName(fqdn, encodedName, 0, nil, false)
+		if err != nil {
+			return
+		}
+		value = append(value, encodedName[:length]...)
+	} else {
+		value = append(value, []byte(fqdn)...)
+	}
+
+	response.AddOption(dhcpOptionClientFQDN, value)
+}
+
 // Get the DHCP vendor class identifier from the request options.
 func getVendorClassIdentifier(requestOptions dhcp.Options) string {
 	vendorClassIdentifier, ok := requestOptions[dhcp.OptionVendorClassIdentifier]
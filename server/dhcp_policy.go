@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The default server states (in CloudControl) for which DHCP requests are refused.
+var defaultDeniedServerStates = []string{
+	"PENDING_DELETE",
+	"FAILED_ADD",
+	"FAILED_CHANGE",
+	"FAILED_DELETE",
+	"REQUIRES_SUPPORT",
+}
+
+// Determine whether DHCP requests from the specified server should be answered.
+//
+// If not, returns the reason why.
+func (service *Service) isDHCPAllowed(serverMetadata ServerMetadata) (allowed bool, reason string) {
+	if serverMetadata.State == "" {
+		return true, "" // Server state is not known (e.g. a static reservation).
+	}
+
+	if service.DeniedServerStates[strings.ToUpper(serverMetadata.State)] {
+		return false, fmt.Sprintf("server is in state '%s'", serverMetadata.State)
+	}
+
+	if service.RequireDeployedServers && !serverMetadata.Deployed {
+		return false, "server has not been deployed"
+	}
+
+	return true, ""
+}
+
+// Parse the server states for which DHCP requests are refused.
+//
+// Each value can itself be a comma-separated list of states (e.g. from MCP_DHCP_DENY_SERVER_STATES).
+func parseDeniedServerStates(values []string) map[string]bool {
+	deniedServerStates := make(map[string]bool)
+	for _, value := range values {
+		for _, state := range strings.Split(value, ",") {
+			state = strings.ToUpper(
+				strings.TrimSpace(state),
+			)
+			if state != "" {
+				deniedServerStates[state] = true
+			}
+		}
+	}
+
+	return deniedServerStates
+}
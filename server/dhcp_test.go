@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+	"github.com/DimensionDataResearch/mcp2-dhcp-server/server/cloudcontroltest"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/miekg/dns"
+)
+
+// Send a DHCP message from the specified MAC address to the service.
+func sendDHCP(t *testing.T, service *Service, messageType dhcp.MessageType, macAddress string) dhcp.Packet {
+	hardwareAddress, err := net.ParseMAC(macAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := dhcp.RequestPacket(messageType, hardwareAddress, net.IPv4zero, []byte{1, 2, 3, 4}, false, nil)
+
+	return service.ServeDHCP(request, messageType, request.ParseOptions())
+}
+
+// Get the message type of a DHCP response.
+func dhcpMessageType(response dhcp.Packet) dhcp.MessageType {
+	messageType := response.ParseOptions()[dhcp.OptionDHCPMessageType]
+	if len(messageType) != 1 {
+		return 0
+	}
+
+	return dhcp.MessageType(messageType[0])
+}
+
+func TestDHCPDiscover(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	testCases := []struct {
+		macAddress       string
+		expectedIP       string
+		expectedHostName string
+	}{
+		{"00:50:56:00:00:01", "192.168.70.10", "web1"},
+		{"00:50:56:00:00:02", "192.168.71.10", "web1"},
+		{"00:50:56:00:00:03", "192.168.70.20", "database"},
+	}
+	for _, testCase := range testCases {
+		response := sendDHCP(t, service, dhcp.Discover, testCase.macAddress)
+		if dhcpMessageType(response) != dhcp.Offer {
+			t.Errorf("%s: expected Offer, got %s", testCase.macAddress, dhcpMessageType(response))
+
+			continue
+		}
+		if !response.YIAddr().Equal(net.ParseIP(testCase.expectedIP)) {
+			t.Errorf("%s: expected offer of %s, got %s", testCase.macAddress, testCase.expectedIP, response.YIAddr())
+		}
+		if hostName := string(response.ParseOptions()[dhcp.OptionHostName]); hostName != testCase.expectedHostName {
+			t.Errorf("%s: expected host name '%s', got '%s'", testCase.macAddress, testCase.expectedHostName, hostName)
+		}
+	}
+}
+
+func TestDHCPDiscoverUnknownMACAddress(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	// Servers in other network domains are not known.
+	response := sendDHCP(t, service, dhcp.Discover, "00:50:56:00:00:09")
+	if len(response) != 0 {
+		t.Fatalf("expected no reply, got %s", dhcpMessageType(response))
+	}
+}
+
+func TestDHCPRequest(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	response := sendDHCP(t, service, dhcp.Request, "00:50:56:00:00:01")
+	if dhcpMessageType(response) != dhcp.ACK {
+		t.Fatalf("expected ACK, got %s", dhcpMessageType(response))
+	}
+	if !response.YIAddr().Equal(net.ParseIP("192.168.70.10")) {
+		t.Fatalf("expected lease on 192.168.70.10, got %s", response.YIAddr())
+	}
+
+	lease, ok := service.LeasesByMACAddress["00:50:56:00:00:01"]
+	if !ok || !lease.IPAddress.Equal(net.ParseIP("192.168.70.10")) {
+		t.Fatalf("expected lease on 192.168.70.10, got %#v", lease)
+	}
+
+	// Renewal.
+	response = sendDHCP(t, service, dhcp.Request, "00:50:56:00:00:01")
+	if dhcpMessageType(response) != dhcp.ACK {
+		t.Fatalf("expected ACK for renewal, got %s", dhcpMessageType(response))
+	}
+
+	response = sendDHCP(t, service, dhcp.Request, "00:50:56:00:00:09")
+	if dhcpMessageType(response) != dhcp.NAK {
+		t.Fatalf("expected NAK for unknown MAC address, got %s", dhcpMessageType(response))
+	}
+}
+
+func TestDHCPServerStatePolicy(t *testing.T) {
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	response := sendDHCP(t, service, dhcp.Request, "00:50:56:00:00:03")
+	if dhcpMessageType(response) != dhcp.ACK {
+		t.Fatalf("expected ACK, got %s", dhcpMessageType(response))
+	}
+
+	// db1 fails to change, and web1 opts out of DHCP.
+	fixture, err := cloudcontroltest.LoadFixture("testdata/cloudcontrol/basic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := range fixture.Servers {
+		if fixture.Servers[index].Name == "db1" {
+			fixture.Servers[index].State = "FAILED_CHANGE"
+		}
+	}
+	fixture.Tags = append(fixture.Tags, compute.TagDetail{
+		AssetType:    compute.AssetTypeServer,
+		AssetID:      "server-web1",
+		AssetName:    "web1",
+		DatacenterID: "AU9",
+		Name:         "dhcp_enabled",
+		Value:        "false",
+	})
+	client.SetFixture(fixture)
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:00:03")
+	if serverMetadata == nil || serverMetadata.State != "FAILED_CHANGE" {
+		t.Fatalf("expected server 'db1' to be in state FAILED_CHANGE, got %#v", serverMetadata)
+	}
+	if response := sendDHCP(t, service, dhcp.Discover, "00:50:56:00:00:03"); len(response) != 0 {
+		t.Fatalf("expected no reply to Discover, got %s", dhcpMessageType(response))
+	}
+	if response := sendDHCP(t, service, dhcp.Request, "00:50:56:00:00:03"); dhcpMessageType(response) != dhcp.NAK {
+		t.Fatalf("expected NAK for renewal, got %s", dhcpMessageType(response))
+	}
+
+	if serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:00:01"); serverMetadata != nil {
+		t.Fatalf("expected server 'web1' to be ignored, got %#v", serverMetadata)
+	}
+	if response := queryDNS(t, service, "web1.lab.mcp", dns.TypeA); response.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN for server 'web1', got %s", dns.RcodeToString[response.Rcode])
+	}
+
+	// The policy is configurable.
+	service.DeniedServerStates = parseDeniedServerStates([]string{"pending_delete"})
+	if response := sendDHCP(t, service, dhcp.Discover, "00:50:56:00:00:03"); dhcpMessageType(response) != dhcp.Offer {
+		t.Fatalf("expected Offer, got %s", dhcpMessageType(response))
+	}
+}
+
+func TestDHCPRequireDeployed(t *testing.T) {
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"network.require_deployed": true,
+	})
+
+	// Only web1 has been deployed.
+	fixture, err := cloudcontroltest.LoadFixture("testdata/cloudcontrol/basic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := range fixture.Servers {
+		fixture.Servers[index].Deployed = fixture.Servers[index].Name == "web1"
+	}
+	client.SetFixture(fixture)
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response := sendDHCP(t, service, dhcp.Discover, "00:50:56:00:00:01"); dhcpMessageType(response) != dhcp.Offer {
+		t.Fatalf("expected Offer for deployed server 'web1', got %s", dhcpMessageType(response))
+	}
+	if response := sendDHCP(t, service, dhcp.Discover, "00:50:56:00:00:03"); len(response) != 0 {
+		t.Fatalf("expected no reply to Discover from undeployed server 'db1', got %s", dhcpMessageType(response))
+	}
+	if response := sendDHCP(t, service, dhcp.Request, "00:50:56:00:00:03"); dhcpMessageType(response) != dhcp.NAK {
+		t.Fatalf("expected NAK for undeployed server 'db1', got %s", dhcpMessageType(response))
+	}
+}
+
+func TestParseDeniedServerStates(t *testing.T) {
+	// From a list in the configuration file, or a comma- (or space-) separated environment variable.
+	for _, states := range [][]string{
+		{"PENDING_DELETE", "failed_add"},
+		{"PENDING_DELETE,failed_add"},
+		{"PENDING_DELETE,", "failed_add"},
+	} {
+		deniedServerStates := parseDeniedServerStates(states)
+		if len(deniedServerStates) != 2 || !deniedServerStates["PENDING_DELETE"] || !deniedServerStates["FAILED_ADD"] {
+			t.Errorf("%q: expected PENDING_DELETE and FAILED_ADD, got %v", states, deniedServerStates)
+		}
+	}
+}
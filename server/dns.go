@@ -2,88 +2,225 @@ package main
 
 import (
 	"log"
-
-	"strings"
+	"math/rand"
 
 	"github.com/miekg/dns"
 )
 
+// A stage in the DNS resolver pipeline.
+//
+// Returns true if the stage sent a response, or false if the request should be passed on to the next stage.
+type dnsResolverStage func(service *Service, question dns.Question, view *DNSView, send dns.ResponseWriter, request *dns.Msg) bool
+
+// The DNS resolver pipeline (local zones, then overrides, then the upstream resolver).
+var dnsResolverPipeline = []dnsResolverStage{
+	(*Service).dnsResolveLocal,
+	(*Service).dnsResolveOverride,
+	(*Service).dnsResolveForward,
+}
+
 // ServeDNS handles an incoming DNS request.
 func (service *Service) ServeDNS(send dns.ResponseWriter, request *dns.Msg) {
-	data := service.DNSData
+	view := service.selectDNSView(send)
+
+	// Apply response-rate limiting and query logging (if enabled).
+	if writer := service.wrapDNSResponseWriter(send, request, view); writer != nil {
+		defer writer.logQuery()
+		send = writer
+	}
 
 	if service.EnableDebugLogging {
-		log.Printf("Received DNS query %d: %s", request.Id, request)
+		log.Printf("Received DNS query %d (view '%s'): %s", request.Id, view.Name, request)
+	}
+
+	switch request.Opcode {
+	case dns.OpcodeQuery:
+		break
+
+	case dns.OpcodeUpdate:
+		service.dnsUpdate(send, request)
+
+		return
+
+	default:
+		service.dnsSendRcode(dns.RcodeNotImplemented, send, request)
+
+		return
 	}
 
+	// In practice, no DNS server supports more than one question per request.
 	if len(request.Question) != 1 {
-		// Anything we don't know how to handle, we just pass on to the fallback server.
-		service.dnsFallback(send, request)
+		service.dnsSendRcode(dns.RcodeFormatError, send, request)
 
 		return
 	}
 
 	question := request.Question[0]
-	if service.shouldForward(question) {
-		// Anything we don't know how to handle, we just pass on to the fallback server.
-		service.dnsFallback(send, request)
+	if question.Qclass != dns.ClassINET && question.Qclass != dns.ClassANY {
+		service.dnsSendRcode(dns.RcodeNotImplemented, send, request)
+
+		return
+	}
+
+	switch question.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		service.dnsTransfer(send, request)
+
+		return
+
+	case dns.TypeMAILA, dns.TypeMAILB:
+		service.dnsSendRcode(dns.RcodeNotImplemented, send, request)
+
+		return
+	}
+
+	// The final stage (forwarding) always sends a response.
+	for _, resolve := range dnsResolverPipeline {
+		if resolve(service, question, view, send, request) {
+			return
+		}
+	}
+}
+
+// Answer a request from the local zone (the pseudo-zone, plus reverse lookups for its addresses).
+//
+// Requests for names in the pseudo-zone are always answered locally.
+func (service *Service) dnsResolveLocal(question dns.Question, view *DNSView, send dns.ResponseWriter, request *dns.Msg) bool {
+	data := view.DNSData
+
+	if !service.isInDNSZone(question.Name) {
+		// For PTR (reverse-lookup), we answer locally if there's a match; otherwise, it's passed on.
+		if question.Qtype != dns.TypePTR {
+			return false
+		}
+
+		typePTRRecord := data.FindPTR(question.Name)
+		if typePTRRecord == nil {
+			return false
+		}
+		service.dnsSendResourceRecord(typePTRRecord, view, send, request)
+
+		return true
 	}
 
 	switch question.Qtype {
-	case dns.TypeA:
-		typeARecord := data.FindA(question.Name)
-		if typeARecord != nil {
-			service.dnsSendResourceRecord(typeARecord, send, request)
+	case dns.TypeA, dns.TypeAAAA:
+		addressRecords := data.FindAddresses(question.Name, question.Qtype)
+		if len(addressRecords) > 0 {
+			shuffleResourceRecords(addressRecords)
+
+			service.dnsSendResourceRecords(addressRecords, nil, view, send, request)
+		} else if typeCNAMERecord := data.FindCNAME(question.Name); typeCNAMERecord != nil {
+			service.dnsSendAlias(typeCNAMERecord, question.Qtype, view, send, request)
 		} else {
-			service.dnsSendNonExistentDomain(send, request)
+			service.dnsSendNonExistentDomain(view, send, request)
 		}
 
 		break
 
-	case dns.TypeAAAA:
-		typeAAAARecord := data.FindAAAA(question.Name)
-		if typeAAAARecord != nil {
-			service.dnsSendResourceRecord(typeAAAARecord, send, request)
+	case dns.TypeSOA:
+		if service.isDNSZoneApex(question.Name) {
+			service.dnsSendResourceRecord(service.dnsZoneSOA(&data), view, send, request)
 		} else {
-			service.dnsSendNonExistentDomain(send, request)
+			service.dnsSendNonExistentDomain(view, send, request)
 		}
 
 		break
 
-	case dns.TypePTR:
-		typePTRRecord := data.FindPTR(question.Name)
-		if typePTRRecord != nil {
-			service.dnsSendResourceRecord(typePTRRecord, send, request)
+	case dns.TypeNS:
+		if service.isDNSZoneApex(question.Name) {
+			apexRecords := service.dnsZoneApexRecords(&data)
+			service.dnsSendResourceRecords(apexRecords[:1], apexRecords[1:], view, send, request)
+		} else {
+			service.dnsSendNonExistentDomain(view, send, request)
+		}
+
+		break
+
+	case dns.TypeDNSKEY:
+		if service.dnsSigner != nil && service.isDNSZoneApex(question.Name) {
+			service.dnsSendResourceRecords(service.dnsSigner.DNSKEYs(), nil, view, send, request)
+		} else {
+			service.dnsSendNonExistentDomain(view, send, request)
+		}
+
+		break
+
+	case dns.TypeCNAME:
+		typeCNAMERecord := data.FindCNAME(question.Name)
+		if typeCNAMERecord != nil {
+			service.dnsSendResourceRecord(typeCNAMERecord, view, send, request)
+		} else {
+			service.dnsSendNonExistentDomain(view, send, request)
+		}
+
+		break
+
+	case dns.TypeSRV:
+		typeSRVRecords := data.FindSRV(question.Name)
+		if len(typeSRVRecords) > 0 {
+			var answers, extras []dns.RR
+			for index := range typeSRVRecords {
+				answers = append(answers, &typeSRVRecords[index])
+
+				// Include target addresses so clients don't need a second round-trip.
+				extras = append(extras, data.FindAddresses(typeSRVRecords[index].Target, dns.TypeA)...)
+				extras = append(extras, data.FindAddresses(typeSRVRecords[index].Target, dns.TypeAAAA)...)
+			}
+			shuffleResourceRecords(answers)
+
+			service.dnsSendResourceRecords(answers, extras, view, send, request)
+		} else {
+			service.dnsSendNonExistentDomain(view, send, request)
+		}
+
+		break
+
+	case dns.TypeTXT:
+		typeTXTRecords := data.FindTXT(question.Name)
+		if len(typeTXTRecords) > 0 {
+			var answers []dns.RR
+			for index := range typeTXTRecords {
+				answers = append(answers, &typeTXTRecords[index])
+			}
+
+			service.dnsSendResourceRecords(answers, nil, view, send, request)
 		} else {
-			// For PTR (reverse-lookup), we pass it on to the fallback server if there's no match locally.
-			service.dnsFallback(send, request)
+			service.dnsSendNonExistentDomain(view, send, request)
 		}
 
 		break
 
 	default:
-		// Anything we don't know how to handle, we just pass on to the fallback server.
-		service.dnsFallback(send, request)
+		// We are authoritative for the pseudo-zone, so there's no point asking anyone else.
+		service.dnsSendNonExistentDomain(view, send, request)
 
 		break
 	}
+
+	return true
 }
 
-func (service *Service) shouldForward(question dns.Question) bool {
-	if question.Qtype == dns.TypePTR {
-		log.Printf("shouldForward = false (question.Qtype == dns.TypePTR))")
-		return false // We always have a go at satisfying PTR queries, and only forward if we can't answer them.
+// Answer a request using a local override (if one exists for the requested name).
+func (service *Service) dnsResolveOverride(question dns.Question, view *DNSView, send dns.ResponseWriter, request *dns.Msg) bool {
+	override := service.findDNSOverride(question.Name)
+	if override == nil {
+		return false
 	}
 
-	isExternalDomain := !strings.HasSuffix(question.Name, service.DNSDomainName)
-	log.Printf("shouldForward = %t ('%s', '%s'))",
-		isExternalDomain, question.Name, service.DNSDomainName,
-	)
+	service.dnsSendOverride(override, view, send, request)
+
+	return true
+}
+
+// Answer a request by forwarding it to the upstream resolver.
+func (service *Service) dnsResolveForward(question dns.Question, view *DNSView, send dns.ResponseWriter, request *dns.Msg) bool {
+	service.dnsFallback(view, send, request)
 
-	return isExternalDomain
+	return true
 }
 
-func (service *Service) dnsSendResourceRecord(record dns.RR, send dns.ResponseWriter, request *dns.Msg) {
+func (service *Service) dnsSendResourceRecord(record dns.RR, view *DNSView, send dns.ResponseWriter, request *dns.Msg) {
 	if service.EnableDebugLogging {
 		log.Printf("Replied with resource record to DNS query %d: %s", request.Id, record.Header())
 	}
@@ -93,50 +230,156 @@ func (service *Service) dnsSendResourceRecord(record dns.RR, send dns.ResponseWr
 	response.Authoritative = true
 	response.Answer = []dns.RR{record}
 
-	send.WriteMsg(response)
+	service.dnsWriteResponse(response, view, send, request)
+}
+
+func (service *Service) dnsSendResourceRecords(records []dns.RR, extras []dns.RR, view *DNSView, send dns.ResponseWriter, request *dns.Msg) {
+	if service.EnableDebugLogging {
+		log.Printf("Replied with %d resource records to DNS query %d.", len(records), request.Id)
+	}
+
+	response := new(dns.Msg)
+	response.SetReply(request)
+	response.Authoritative = true
+	response.Answer = records
+	response.Extra = extras
+
+	service.dnsWriteResponse(response, view, send, request)
+}
+
+// Send a CNAME record, followed by the target's record (if it has one of the requested type).
+func (service *Service) dnsSendAlias(alias *dns.CNAME, qtype uint16, view *DNSView, send dns.ResponseWriter, request *dns.Msg) {
+	if service.EnableDebugLogging {
+		log.Printf("Replied with alias to DNS query %d: %s", request.Id, alias.Header())
+	}
+
+	response := new(dns.Msg)
+	response.SetReply(request)
+	response.Authoritative = true
+	targetRecords := view.DNSData.FindAddresses(alias.Target, qtype)
+	shuffleResourceRecords(targetRecords)
+
+	response.Answer = append([]dns.RR{alias}, targetRecords...)
+
+	service.dnsWriteResponse(response, view, send, request)
 }
 
 func (service *Service) dnsSendServerFailure(send dns.ResponseWriter, request *dns.Msg) {
+	service.dnsSendRcode(dns.RcodeServerFailure, send, request)
+}
+
+func (service *Service) dnsSendRefused(send dns.ResponseWriter, request *dns.Msg) {
+	service.dnsSendRcode(dns.RcodeRefused, send, request)
+}
+
+// Send a response with the specified result code (signed, if the request was signed).
+func (service *Service) dnsSendRcode(rcode int, send dns.ResponseWriter, request *dns.Msg) {
 	if service.EnableDebugLogging {
-		log.Printf("Replied SERVFAIL to DNS query %d.", request.Id)
+		log.Printf("Replied %s to DNS query %d.", dns.RcodeToString[rcode], request.Id)
 	}
 
 	response := new(dns.Msg)
-	response.SetRcode(request, dns.RcodeServerFailure)
+	response.SetRcode(request, rcode)
+	signDNSResponse(response, request)
 
 	send.WriteMsg(response)
 }
 
-func (service *Service) dnsSendNonExistentDomain(send dns.ResponseWriter, request *dns.Msg) {
+// Send a negative response (NXDOMAIN if the name does not exist, otherwise an empty NOERROR response), with the zone's SOA record for negative caching.
+func (service *Service) dnsSendNonExistentDomain(view *DNSView, send dns.ResponseWriter, request *dns.Msg) {
+	data := view.DNSData
+
+	rcode := dns.RcodeNameError
+	if len(request.Question) == 1 && (service.isDNSZoneApex(request.Question[0].Name) || data.NameExists(request.Question[0].Name) || data.FindWildcard(request.Question[0].Name) != "") {
+		rcode = dns.RcodeSuccess // Name exists (or is an empty non-terminal), but has no records of the requested type.
+	}
+
 	if service.EnableDebugLogging {
-		log.Printf("Replied NXDOMAIN to DNS query %d.", request.Id)
+		log.Printf("Replied %s (no records) to DNS query %d.", dns.RcodeToString[rcode], request.Id)
 	}
 
 	response := new(dns.Msg)
-	response.SetRcode(request, dns.RcodeServerFailure)
+	response.SetRcode(request, rcode)
+	response.Authoritative = true
+	if len(request.Question) == 1 && service.isInDNSZone(request.Question[0].Name) {
+		// Negative responses are cached for the lesser of the SOA's TTL and its minimum (RFC 2308).
+		soa := service.dnsZoneSOA(&data)
+		if soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+		response.Ns = []dns.RR{soa}
+	}
+
+	service.dnsWriteResponse(response, view, send, request)
+}
+
+// Write a response from the local zone (adding DNSSEC records, if required).
+func (service *Service) dnsWriteResponse(response *dns.Msg, view *DNSView, send dns.ResponseWriter, request *dns.Msg) {
+	service.dnssecAddRecords(response, request, &view.DNSData)
+
+	// Responses that are too large for the client's UDP buffer are truncated (the client will retry using TCP).
+	if isUDPRequest(send) {
+		maxSize := dns.MinMsgSize
+		if requestOPT := request.IsEdns0(); requestOPT != nil && int(requestOPT.UDPSize()) > maxSize {
+			maxSize = int(requestOPT.UDPSize())
+		}
+
+		if response.Len() > maxSize {
+			response.Truncated = true
+			response.Answer = nil
+			response.Ns = nil
+			response.Extra = nil
+		}
+	}
 
 	send.WriteMsg(response)
 }
 
-func (service *Service) dnsFallback(send dns.ResponseWriter, request *dns.Msg) {
-	// TODO: Consider implementing a basic cache for forwarded requests / responses.
+func (service *Service) dnsFallback(view *DNSView, send dns.ResponseWriter, request *dns.Msg) {
+	if !view.EnableForwarding {
+		service.dnsSendRefused(send, request)
+
+		return
+	}
+
+	if service.dnsCache != nil {
+		cachedResponse := service.dnsCache.Get(view.Name, request)
+		if cachedResponse != nil {
+			if service.EnableDebugLogging {
+				log.Printf("Replied with cached response to DNS query %d.", request.Id)
+			}
+
+			send.WriteMsg(cachedResponse)
+
+			return
+		}
+	}
 
 	if service.EnableDebugLogging {
-		log.Printf("Forwarding unhandled DNS query %d to %s...", request.Id, service.DNSFallbackAddress)
+		log.Printf("Forwarding unhandled DNS query %d to %s...", request.Id, view.forwarder.Upstream())
 	}
+	markDNSQueryForwarded(send)
 
-	response, _, err := service.dnsFallbackClient.Exchange(request, service.DNSFallbackAddress)
+	response, err := view.forwarder.Forward(request)
 	if err != nil {
 		log.Printf("Unable to forward DNS request %d to '%s': %s ",
-			request.Id, service.DNSFallbackAddress, err.Error(),
+			request.Id, view.forwarder.Upstream(), err.Error(),
 		)
+
+		service.dnsSendServerFailure(send, request)
+
+		return
 	}
 	response.Authoritative = false
 
+	if service.dnsCache != nil {
+		service.dnsCache.Put(view.Name, request, response)
+	}
+
 	err = send.WriteMsg(response)
 	if err != nil {
 		log.Printf("Unable to forward DNS response %d to '%s': %s ",
-			response.Id, service.DNSFallbackAddress, err.Error(),
+			response.Id, view.forwarder.Upstream(), err.Error(),
 		)
 	}
 
@@ -144,3 +387,11 @@ func (service *Service) dnsFallback(send dns.ResponseWriter, request *dns.Msg) {
 		log.Printf("Forwarded unhandled DNS query %d.", request.Id)
 	}
 }
+
+// Shuffle resource records (so that clients which use the first record are spread across all targets).
+func shuffleResourceRecords(records []dns.RR) {
+	for index := len(records) - 1; index > 0; index-- {
+		swapIndex := rand.Intn(index + 1)
+		records[index], records[swapIndex] = records[swapIndex], records[index]
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSCache caches responses from upstream resolvers.
+//
+// Cached responses report each record's remaining lifetime (their TTLs decrease as they age).
+type DNSCache struct {
+	// The maximum number of cached responses.
+	MaxEntries int
+
+	// The maximum time that a response will be cached (regardless of its TTLs).
+	MaxTTL time.Duration
+
+	entriesByKey map[string]*dnsCacheEntry
+	stateLock    *sync.Mutex
+}
+
+// A cached response.
+type dnsCacheEntry struct {
+	response *dns.Msg
+	cached   time.Time
+	expires  time.Time
+}
+
+// NewDNSCache creates a new DNSCache.
+func NewDNSCache(maxEntries int, maxTTL time.Duration) *DNSCache {
+	return &DNSCache{
+		MaxEntries:   maxEntries,
+		MaxTTL:       maxTTL,
+		entriesByKey: make(map[string]*dnsCacheEntry),
+		stateLock:    &sync.Mutex{},
+	}
+}
+
+// Get the cached response (if any) for a request, with TTLs adjusted to reflect the time it has spent in the cache.
+func (cache *DNSCache) Get(viewName string, request *dns.Msg) *dns.Msg {
+	key := dnsCacheKey(viewName, request)
+	now := time.Now()
+
+	cache.stateLock.Lock()
+	entry, ok := cache.entriesByKey[key]
+	if ok && !now.Before(entry.expires) {
+		delete(cache.entriesByKey, key)
+		ok = false
+	}
+	cache.stateLock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	response := entry.response.Copy()
+	response.Id = request.Id
+	response.Question = request.Question
+
+	elapsed := uint32(now.Sub(entry.cached) / time.Second)
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range section {
+			header := record.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue // TTL field holds extended flags.
+			}
+
+			if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+
+	return response
+}
+
+// Put a response from an upstream resolver into the cache (if it can be cached).
+func (cache *DNSCache) Put(viewName string, request *dns.Msg, response *dns.Msg) {
+	ttl, ok := dnsCacheTTL(response)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	cacheDuration := time.Duration(ttl) * time.Second
+	if cacheDuration > cache.MaxTTL {
+		cacheDuration = cache.MaxTTL
+	}
+
+	now := time.Now()
+	entry := &dnsCacheEntry{
+		response: response.Copy(),
+		cached:   now,
+		expires:  now.Add(cacheDuration),
+	}
+
+	cache.stateLock.Lock()
+	defer cache.stateLock.Unlock()
+
+	if len(cache.entriesByKey) >= cache.MaxEntries {
+		cache.evict(now)
+	}
+	cache.entriesByKey[dnsCacheKey(viewName, request)] = entry
+}
+
+// Evict expired entries (or, if there are none, an arbitrary entry) to make room for a new entry.
+//
+// The caller must hold the state lock.
+func (cache *DNSCache) evict(now time.Time) {
+	evicted := false
+	for key, entry := range cache.entriesByKey {
+		if !now.Before(entry.expires) {
+			delete(cache.entriesByKey, key)
+			evicted = true
+		}
+	}
+	if evicted {
+		return
+	}
+
+	for key := range cache.entriesByKey {
+		delete(cache.entriesByKey, key)
+
+		return
+	}
+}
+
+// Determine how long a response can be cached (the lowest TTL of its records or, for negative responses, the SOA minimum as per RFC 2308).
+func dnsCacheTTL(response *dns.Msg) (uint32, bool) {
+	if response.Truncated || (response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	var soa *dns.SOA
+	for _, record := range response.Ns {
+		if soaRecord, ok := record.(*dns.SOA); ok {
+			soa = soaRecord
+		}
+	}
+
+	if len(response.Answer) == 0 {
+		// Negative responses can only be cached if they include an SOA record.
+		if soa == nil {
+			return 0, false
+		}
+
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+
+		return ttl, true
+	}
+
+	ttl := ^uint32(0)
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range section {
+			header := record.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl < ttl {
+				ttl = header.Ttl
+			}
+		}
+	}
+
+	return ttl, true
+}
+
+// The key used to identify a cached response.
+func dnsCacheKey(viewName string, request *dns.Msg) string {
+	question := request.Question[0]
+
+	dnssecOK := false
+	if requestOPT := request.IsEdns0(); requestOPT != nil {
+		dnssecOK = requestOPT.Do()
+	}
+
+	return fmt.Sprintf("%s/%s/%d/%d/%t/%t",
+		viewName,
+		strings.ToLower(question.Name),
+		question.Qtype,
+		question.Qclass,
+		dnssecOK,
+		request.CheckingDisabled,
+	)
+}
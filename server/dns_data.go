@@ -3,57 +3,267 @@ package main
 import (
 	"fmt"
 	"net"
+	"sort"
+	"strings"
 
 	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
 	"github.com/miekg/dns"
 )
 
+const (
+	// DNSAdapterNamingIndex names additional network adapters "<name>-nicN" (N starts at 1).
+	DNSAdapterNamingIndex = "index"
+
+	// DNSAdapterNamingVLAN names additional network adapters "<vlan-name>.<name>".
+	DNSAdapterNamingVLAN = "vlan"
+)
+
 // DNSData holds all data required for handling DNS requests.
 type DNSData struct {
-	v4Addresses    map[string]dns.A
-	v6Addresses    map[string]dns.AAAA
+	v4Addresses    map[string][]dns.A
+	v6Addresses    map[string][]dns.AAAA
 	reverseLookups map[string]dns.PTR
+	aliases        map[string]dns.CNAME
+	services       map[string][]dns.SRV
+	texts          map[string][]dns.TXT
+
+	// The number of names with records below each name (names that only appear here are empty non-terminals).
+	descendantCounts map[string]int
 
+	// The TTL for forward (e.g. A, AAAA, CNAME) records.
 	DefaultTTL uint32
+
+	// The TTL for reverse-lookup (PTR) records.
+	ReverseTTL uint32
+
+	// The TTL for negative responses (the SOA minimum).
+	NegativeTTL uint32
+
+	// The zone serial number (changes whenever the zone's records change).
+	Serial uint32
+
+	// DNSSEC signatures for the zone (if it is signed).
+	SignedZone *SignedZone
 }
 
 // NewDNSData creates a new DNSData.
 func NewDNSData(defaultTTL uint32) DNSData {
 	return DNSData{
-		v4Addresses:       make(map[string]dns.A),
-		v6Addresses:       make(map[string]dns.AAAA),
-		reverseLookups:    make(map[string]dns.PTR),
-		DefaultTTL: defaultTTL,
+		v4Addresses:    make(map[string][]dns.A),
+		v6Addresses:    make(map[string][]dns.AAAA),
+		reverseLookups: make(map[string]dns.PTR),
+		aliases:        make(map[string]dns.CNAME),
+		services:       make(map[string][]dns.SRV),
+		texts:          make(map[string][]dns.TXT),
+
+		descendantCounts: make(map[string]int),
+
+		DefaultTTL:  defaultTTL,
+		ReverseTTL:  defaultTTL,
+		NegativeTTL: defaultTTL,
 	}
 }
 
-// FindA retrieves the A record (if one exists) for the specified name.
-func (data *DNSData) FindA(name string) *dns.A {
-	fqdn := dns.Fqdn(name)
+// Normalise a DNS name (names are stored, and matched, in lower case).
+func dnsName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
 
-	record, ok := data.v4Addresses[fqdn]
-	if ok {
-		return &record
+// Create a new DNSData using the configured TTLs.
+func (service *Service) newDNSData() DNSData {
+	data := NewDNSData(service.DNSTTL)
+	data.ReverseTTL = service.DNSReverseTTL
+	data.NegativeTTL = service.DNSNegativeTTL
+
+	return data
+}
+
+// Clone creates a copy of the DNSData (so it can be modified without affecting the original).
+func (data *DNSData) Clone() DNSData {
+	clone := NewDNSData(data.DefaultTTL)
+	clone.ReverseTTL = data.ReverseTTL
+	clone.NegativeTTL = data.NegativeTTL
+	clone.Serial = data.Serial
+
+	for name, records := range data.v4Addresses {
+		clone.v4Addresses[name] = append([]dns.A(nil), records...)
+	}
+	for name, records := range data.v6Addresses {
+		clone.v6Addresses[name] = append([]dns.AAAA(nil), records...)
+	}
+	for arpa, record := range data.reverseLookups {
+		clone.reverseLookups[arpa] = record
+	}
+	for alias, record := range data.aliases {
+		clone.aliases[alias] = record
+	}
+	for name, records := range data.services {
+		clone.services[name] = append([]dns.SRV(nil), records...)
+	}
+	for name, records := range data.texts {
+		clone.texts[name] = append([]dns.TXT(nil), records...)
+	}
+	for name, count := range data.descendantCounts {
+		clone.descendantCounts[name] = count
 	}
 
-	return nil
+	return clone
 }
 
-// FindAAAA retrieves the AAAA record (if one exists) for the specified name.
-func (data *DNSData) FindAAAA(name string) *dns.AAAA {
-	fqdn := dns.Fqdn(name)
+// Merge adds records from other DNSData for names (and reverse-lookup addresses) that do not already have records.
+//
+// Returns the names whose records were not added (because they already have records).
+func (data *DNSData) Merge(other *DNSData) (conflictingNames []string) {
+	// Determine the new names up-front (since adding records for a name changes the outcome of HasName).
+	newNames := make(map[string]bool)
+	seenNames := make(map[string]bool)
+	for _, record := range other.ZoneRecords() {
+		name := dnsName(record.Header().Name)
+		if seenNames[name] {
+			continue
+		}
+		seenNames[name] = true
 
-	record, ok := data.v6Addresses[fqdn]
-	if ok {
-		return &record
+		if data.HasName(name) {
+			conflictingNames = append(conflictingNames, name)
+		} else {
+			newNames[name] = true
+		}
+	}
+
+	for _, record := range other.ZoneRecords() {
+		if newNames[dnsName(record.Header().Name)] {
+			data.AddRecord(record)
+		}
+	}
+	for arpa, record := range other.reverseLookups {
+		// Only add reverse-lookups for the new names (otherwise, they may not agree with the forward records).
+		if _, ok := data.reverseLookups[arpa]; !ok && newNames[dnsName(record.Ptr)] {
+			data.reverseLookups[arpa] = record
+		}
+	}
+	sort.Strings(conflictingNames)
+
+	return
+}
+
+// HasName determines whether any records exist for the specified name.
+func (data *DNSData) HasName(name string) bool {
+	fqdn := dnsName(name)
+
+	return data.hasAddresses(fqdn) || data.FindCNAME(fqdn) != nil || len(data.FindSRV(fqdn)) > 0 || len(data.FindTXT(fqdn)) > 0
+}
+
+// NameExists determines whether the specified name exists in the zone (i.e. it has records, or is an empty non-terminal with records below it).
+func (data *DNSData) NameExists(name string) bool {
+	fqdn := dnsName(name)
+
+	return data.HasName(fqdn) || data.descendantCounts[fqdn] > 0
+}
+
+// FindWildcard finds the wildcard name (if any) whose records apply to the specified name (RFC 4592).
+//
+// A wildcard only applies to names that do not exist, and only if it is a child of the name's closest existing ancestor (which may be an empty non-terminal).
+func (data *DNSData) FindWildcard(name string) string {
+	fqdn := dnsName(name)
+	if data.NameExists(fqdn) {
+		return ""
+	}
+
+	labelIndexes := dns.Split(fqdn)
+	for index := 1; index < len(labelIndexes); index++ {
+		ancestor := fqdn[labelIndexes[index]:]
+
+		wildcard := "*." + ancestor
+		if data.HasName(wildcard) {
+			return wildcard
+		}
+		if data.NameExists(ancestor) {
+			return "" // The closest encloser has no wildcard.
+		}
+	}
+
+	return ""
+}
+
+// FindRecords retrieves the records (if any exist) of the specified type for the specified name.
+func (data *DNSData) FindRecords(name string, rrtype uint16) []dns.RR {
+	fqdn := dnsName(name)
+
+	switch rrtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return data.FindAddresses(fqdn, rrtype)
+	case dns.TypeCNAME:
+		typeCNAMERecord := data.FindCNAME(fqdn)
+		if typeCNAMERecord != nil {
+			return []dns.RR{typeCNAMERecord}
+		}
+	case dns.TypeSRV:
+		var records []dns.RR
+		typeSRVRecords := data.FindSRV(fqdn)
+		for index := range typeSRVRecords {
+			records = append(records, &typeSRVRecords[index])
+		}
+
+		return records
+	case dns.TypeTXT:
+		var records []dns.RR
+		typeTXTRecords := data.FindTXT(fqdn)
+		for index := range typeTXTRecords {
+			records = append(records, &typeTXTRecords[index])
+		}
+
+		return records
 	}
 
 	return nil
 }
 
+// FindA retrieves the A records (if any exist) for the specified name.
+func (data *DNSData) FindA(name string) []dns.A {
+	return data.v4Addresses[dnsName(name)]
+}
+
+// FindAAAA retrieves the AAAA records (if any exist) for the specified name.
+func (data *DNSData) FindAAAA(name string) []dns.AAAA {
+	return data.v6Addresses[dnsName(name)]
+}
+
+// FindAddresses retrieves the A or AAAA records (depending on qtype) for the specified name.
+func (data *DNSData) FindAddresses(name string, qtype uint16) []dns.RR {
+	var records []dns.RR
+
+	switch qtype {
+	case dns.TypeA:
+		typeARecords := data.FindA(name)
+		for index := range typeARecords {
+			records = append(records, &typeARecords[index])
+		}
+	case dns.TypeAAAA:
+		typeAAAARecords := data.FindAAAA(name)
+		for index := range typeAAAARecords {
+			records = append(records, &typeAAAARecords[index])
+		}
+	}
+
+	// Synthesise records from a matching wildcard (if any).
+	if len(records) == 0 {
+		wildcard := data.FindWildcard(name)
+		if wildcard != "" {
+			for _, wildcardRecord := range data.FindAddresses(wildcard, qtype) {
+				record := dns.Copy(wildcardRecord)
+				record.Header().Name = dns.Fqdn(name)
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records
+}
+
 // FindPTR retrieves the PTR record (if one exists) for the specified ".arpa" address.
 func (data *DNSData) FindPTR(arpa string) *dns.PTR {
-	fqdn := dns.Fqdn(arpa)
+	fqdn := dnsName(arpa)
 
 	record, ok := data.reverseLookups[fqdn]
 	if ok {
@@ -63,9 +273,142 @@ func (data *DNSData) FindPTR(arpa string) *dns.PTR {
 	return nil
 }
 
+// ZoneRecords retrieves all forward (i.e. non-PTR) records, ordered by name and type.
+func (data *DNSData) ZoneRecords() []dns.RR {
+	var records []dns.RR
+	for name := range data.v4Addresses {
+		records = append(records, data.FindAddresses(name, dns.TypeA)...)
+	}
+	for name := range data.v6Addresses {
+		records = append(records, data.FindAddresses(name, dns.TypeAAAA)...)
+	}
+	for alias := range data.aliases {
+		records = append(records, data.FindCNAME(alias))
+	}
+	for name := range data.services {
+		serviceRecords := data.services[name]
+		for index := range serviceRecords {
+			records = append(records, &serviceRecords[index])
+		}
+	}
+	for name := range data.texts {
+		textRecords := data.texts[name]
+		for index := range textRecords {
+			records = append(records, &textRecords[index])
+		}
+	}
+
+	sort.Slice(records, func(index1 int, index2 int) bool {
+		return records[index1].String() < records[index2].String()
+	})
+
+	return records
+}
+
+// ReverseRecords retrieves all reverse-lookup (PTR) records, ordered by name.
+func (data *DNSData) ReverseRecords() []dns.RR {
+	var records []dns.RR
+	for arpa := range data.reverseLookups {
+		records = append(records, data.FindPTR(arpa))
+	}
+
+	sort.Slice(records, func(index1 int, index2 int) bool {
+		return records[index1].Header().Name < records[index2].Header().Name
+	})
+
+	return records
+}
+
+// FindCNAME retrieves the CNAME record (if one exists) for the specified alias.
+func (data *DNSData) FindCNAME(alias string) *dns.CNAME {
+	fqdn := dnsName(alias)
+
+	record, ok := data.aliases[fqdn]
+	if ok {
+		return &record
+	}
+
+	return nil
+}
+
+// FindSRV retrieves the SRV records (if any exist) for the specified service name.
+func (data *DNSData) FindSRV(name string) []dns.SRV {
+	return data.services[dnsName(name)]
+}
+
+// FindTXT retrieves the TXT records (if any exist) for the specified name.
+func (data *DNSData) FindTXT(name string) []dns.TXT {
+	return data.texts[dnsName(name)]
+}
+
+// AddSRV adds an SRV record for the specified service name that refers to the target name.
+//
+// All targets that offer the same service are aggregated into a single set of records.
+func (data *DNSData) AddSRV(name string, target string, port uint16, priority uint16, weight uint16) {
+	fqdn := dnsName(name)
+	defer data.trackName(fqdn, data.HasName(fqdn))
+
+	data.services[fqdn] = append(data.services[fqdn], dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    data.DefaultTTL,
+		},
+		Priority: priority,
+		Weight:   weight,
+		Port:     port,
+		Target:   dnsName(target),
+	})
+}
+
+// AddTXT adds a TXT record for the specified name.
+func (data *DNSData) AddTXT(name string, text string) {
+	fqdn := dnsName(name)
+	defer data.trackName(fqdn, data.HasName(fqdn))
+
+	data.texts[fqdn] = append(data.texts[fqdn], dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    data.DefaultTTL,
+		},
+		Txt: splitTXT(text),
+	})
+}
+
+// AddCNAME adds a CNAME record that makes the specified alias refer to the target name.
+//
+// An alias cannot be added for a name that already has address records.
+func (data *DNSData) AddCNAME(alias string, target string) error {
+	aliasFQDN := dnsName(alias)
+	targetFQDN := dnsName(target)
+
+	if data.hasAddresses(aliasFQDN) {
+		return fmt.Errorf("cannot add alias '%s' for '%s' (name already has address records)", aliasFQDN, targetFQDN)
+	}
+	if aliasFQDN == targetFQDN {
+		return fmt.Errorf("cannot add alias '%s' for itself", aliasFQDN)
+	}
+	defer data.trackName(aliasFQDN, data.HasName(aliasFQDN))
+
+	data.aliases[aliasFQDN] = dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   aliasFQDN,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    data.DefaultTTL,
+		},
+		Target: targetFQDN,
+	}
+
+	return nil
+}
+
 // Add a new set of records for the specified name and IPv4 / IPv6 address.
 func (data *DNSData) Add(name string, ip net.IP) error {
-	fqdn := dns.Fqdn(name)
+	fqdn := dnsName(name)
 
 	if ip.To4() != nil {
 		data.addA(fqdn, ip)
@@ -82,12 +425,63 @@ func (data *DNSData) Add(name string, ip net.IP) error {
 	return fmt.Errorf("IP address '%s' has unexpected length (%d)", ip, len(ip))
 }
 
+// AddRecord adds an existing record (e.g. one loaded from a snapshot), retaining its name and TTL.
+func (data *DNSData) AddRecord(record dns.RR) error {
+	record = dns.Copy(record)
+	record.Header().Name = dnsName(record.Header().Name)
+	if record.Header().Rrtype != dns.TypePTR {
+		defer data.trackName(record.Header().Name, data.HasName(record.Header().Name))
+	}
+
+	switch typedRecord := record.(type) {
+	case *dns.A:
+		data.v4Addresses[typedRecord.Hdr.Name] = append(data.v4Addresses[typedRecord.Hdr.Name], *typedRecord)
+	case *dns.AAAA:
+		data.v6Addresses[typedRecord.Hdr.Name] = append(data.v6Addresses[typedRecord.Hdr.Name], *typedRecord)
+	case *dns.PTR:
+		data.reverseLookups[typedRecord.Hdr.Name] = *typedRecord
+	case *dns.CNAME:
+		data.aliases[typedRecord.Hdr.Name] = *typedRecord
+	case *dns.SRV:
+		data.services[typedRecord.Hdr.Name] = append(data.services[typedRecord.Hdr.Name], *typedRecord)
+	case *dns.TXT:
+		data.texts[typedRecord.Hdr.Name] = append(data.texts[typedRecord.Hdr.Name], *typedRecord)
+	default:
+		return fmt.Errorf("unsupported record type (%s)", dns.TypeToString[record.Header().Rrtype])
+	}
+
+	return nil
+}
+
+// AddGroupMember adds the addresses of the specified CloudControl virtual network adapter to a group name.
+//
+// Unlike AddNetworkAdapter, no reverse-lookup (PTR) records are created for the group name.
+func (data *DNSData) AddGroupMember(groupName string, networkAdapter compute.VirtualMachineNetworkAdapter) {
+	fqdn := dnsName(groupName)
+
+	if networkAdapter.PrivateIPv4Address != nil {
+		data.addA(fqdn,
+			net.ParseIP(*networkAdapter.PrivateIPv4Address),
+		)
+	}
+	if networkAdapter.PrivateIPv6Address != nil {
+		data.addAAAA(fqdn,
+			net.ParseIP(*networkAdapter.PrivateIPv6Address),
+		)
+	}
+}
+
 // AddServer adds or updates the records for the specified CloudControl server.
+//
+// The primary network adapter uses the server name; additional network adapters use "<name>-nicN".
 func (data *DNSData) AddServer(server compute.Server) {
 	data.AddNetworkAdapter(server.Name, server.Network.PrimaryAdapter)
 
-	for _, additionalNetworkAdapter := range server.Network.AdditionalNetworkAdapters {
-		data.AddNetworkAdapter(server.Name, additionalNetworkAdapter)
+	for index, additionalNetworkAdapter := range server.Network.AdditionalNetworkAdapters {
+		data.AddNetworkAdapter(
+			networkAdapterHostName(server.Name, index+1, additionalNetworkAdapter, DNSAdapterNamingIndex),
+			additionalNetworkAdapter,
+		)
 	}
 }
 
@@ -105,31 +499,120 @@ func (data *DNSData) AddNetworkAdapter(name string, networkAdapter compute.Virtu
 	}
 }
 
+// UsePublicAddresses replaces the addresses for names in the zone with those of the corresponding names in the public subdomain (e.g. "server1.public.<zone>" -> "server1.<zone>").
+//
+// Both A and AAAA records are replaced, so a name with only public IPv4 (NAT) addresses has no AAAA records rather than its private ones.
+func (data *DNSData) UsePublicAddresses(zone string, publicZone string) {
+	zone = dnsName(zone)
+	publicZone = dnsName(publicZone)
+
+	publicNames := make(map[string]bool)
+	for publicName := range data.v4Addresses {
+		publicNames[publicName] = true
+	}
+	for publicName := range data.v6Addresses {
+		publicNames[publicName] = true
+	}
+
+	for publicName := range publicNames {
+		if !strings.HasSuffix(publicName, "."+publicZone) {
+			continue
+		}
+
+		name := strings.TrimSuffix(publicName, publicZone) + zone
+		if !data.hasAddresses(name) {
+			continue
+		}
+
+		var v4Records []dns.A
+		for _, publicRecord := range data.v4Addresses[publicName] {
+			record := publicRecord
+			record.Hdr.Name = name
+			v4Records = append(v4Records, record)
+		}
+		var v6Records []dns.AAAA
+		for _, publicRecord := range data.v6Addresses[publicName] {
+			record := publicRecord
+			record.Hdr.Name = name
+			v6Records = append(v6Records, record)
+		}
+
+		if len(v4Records) > 0 {
+			data.v4Addresses[name] = v4Records
+		} else {
+			delete(data.v4Addresses, name)
+		}
+		if len(v6Records) > 0 {
+			data.v6Addresses[name] = v6Records
+		} else {
+			delete(data.v6Addresses, name)
+		}
+	}
+}
+
+// SetTTL overrides the TTL for the address, alias, and text records for the specified name.
+//
+// Reverse-lookup (PTR) records for its addresses keep the reverse TTL.
+func (data *DNSData) SetTTL(name string, ttl uint32) {
+	fqdn := dnsName(name)
+
+	for index := range data.v4Addresses[fqdn] {
+		data.v4Addresses[fqdn][index].Hdr.Ttl = ttl
+	}
+	for index := range data.v6Addresses[fqdn] {
+		data.v6Addresses[fqdn][index].Hdr.Ttl = ttl
+	}
+	for index := range data.texts[fqdn] {
+		data.texts[fqdn][index].Hdr.Ttl = ttl
+	}
+	if alias, ok := data.aliases[fqdn]; ok {
+		alias.Hdr.Ttl = ttl
+		data.aliases[fqdn] = alias
+	}
+}
+
 // Remove any records that exist for the specified name.
 func (data *DNSData) Remove(name string) error {
-	fqdn := dns.Fqdn(name)
+	fqdn := dnsName(name)
+	hadRecords := data.HasName(fqdn)
 
-	aRecord, ok := data.v4Addresses[fqdn]
-	if ok {
-		arpa, err := dns.ReverseAddr(aRecord.A.String())
+	for _, aRecord := range data.v4Addresses[fqdn] {
+		err := data.removePTR(fqdn, aRecord.A)
 		if err != nil {
 			return err
 		}
-
-		delete(data.reverseLookups, arpa)
 	}
 	delete(data.v4Addresses, fqdn)
 
-	aaaaRecord, ok := data.v6Addresses[fqdn]
-	if ok {
-		arpa, err := dns.ReverseAddr(aaaaRecord.AAAA.String())
+	for _, aaaaRecord := range data.v6Addresses[fqdn] {
+		err := data.removePTR(fqdn, aaaaRecord.AAAA)
 		if err != nil {
 			return err
 		}
-
-		delete(data.reverseLookups, arpa)
 	}
 	delete(data.v6Addresses, fqdn)
+	delete(data.aliases, fqdn)
+	delete(data.texts, fqdn)
+	data.trackName(fqdn, hadRecords)
+
+	// Remove the name from any services that it offers.
+	for serviceName, serviceRecords := range data.services {
+		hadRecords := data.HasName(serviceName)
+
+		var remainingRecords []dns.SRV
+		for _, serviceRecord := range serviceRecords {
+			if dnsName(serviceRecord.Target) != fqdn {
+				remainingRecords = append(remainingRecords, serviceRecord)
+			}
+		}
+
+		if len(remainingRecords) > 0 {
+			data.services[serviceName] = remainingRecords
+		} else {
+			delete(data.services, serviceName)
+		}
+		data.trackName(serviceName, hadRecords)
+	}
 
 	return nil
 }
@@ -137,11 +620,31 @@ func (data *DNSData) Remove(name string) error {
 // RemoveServer removes any records that exist for the specified CloudControl server.
 func (data *DNSData) RemoveServer(server compute.Server) {
 	data.Remove(server.Name)
+
+	for index, additionalNetworkAdapter := range server.Network.AdditionalNetworkAdapters {
+		data.Remove(
+			networkAdapterHostName(server.Name, index+1, additionalNetworkAdapter, DNSAdapterNamingIndex),
+		)
+	}
 }
 
-// Add an A record.
+// Determine whether the specified name has any A / AAAA records.
+func (data *DNSData) hasAddresses(name string) bool {
+	return len(data.v4Addresses[name]) > 0 || len(data.v6Addresses[name]) > 0
+}
+
+// Add an A record (unless the name already has an A record for the same address).
 func (data *DNSData) addA(name string, ip net.IP) {
-	data.v4Addresses[name] = dns.A{
+	defer data.trackName(name, data.HasName(name))
+	delete(data.aliases, name) // Address records take precedence over aliases.
+
+	for _, existingRecord := range data.v4Addresses[name] {
+		if existingRecord.A.Equal(ip) {
+			return
+		}
+	}
+
+	data.v4Addresses[name] = append(data.v4Addresses[name], dns.A{
 		Hdr: dns.RR_Header{
 			Name:   name,
 			Rrtype: dns.TypeA,
@@ -149,12 +652,21 @@ func (data *DNSData) addA(name string, ip net.IP) {
 			Ttl:    data.DefaultTTL,
 		},
 		A: ip,
-	}
+	})
 }
 
-// Add an AAAA record.
+// Add an AAAA record (unless the name already has an AAAA record for the same address).
 func (data *DNSData) addAAAA(name string, ip net.IP) {
-	data.v6Addresses[name] = dns.AAAA{
+	defer data.trackName(name, data.HasName(name))
+	delete(data.aliases, name) // Address records take precedence over aliases.
+
+	for _, existingRecord := range data.v6Addresses[name] {
+		if existingRecord.AAAA.Equal(ip) {
+			return
+		}
+	}
+
+	data.v6Addresses[name] = append(data.v6Addresses[name], dns.AAAA{
 		Hdr: dns.RR_Header{
 			Name:   name,
 			Rrtype: dns.TypeAAAA,
@@ -162,6 +674,31 @@ func (data *DNSData) addAAAA(name string, ip net.IP) {
 			Ttl:    data.DefaultTTL,
 		},
 		AAAA: ip,
+	})
+}
+
+// Track the ancestors of a name as (possibly empty) non-terminals while the name has records.
+//
+// hadRecords indicates whether the name had any records before it was changed.
+func (data *DNSData) trackName(name string, hadRecords bool) {
+	hasRecords := data.HasName(name)
+	if hasRecords == hadRecords {
+		return
+	}
+
+	delta := 1
+	if !hasRecords {
+		delta = -1
+	}
+
+	labelIndexes := dns.Split(name)
+	for index := 1; index < len(labelIndexes); index++ {
+		ancestor := name[labelIndexes[index]:]
+
+		data.descendantCounts[ancestor] += delta
+		if data.descendantCounts[ancestor] <= 0 {
+			delete(data.descendantCounts, ancestor)
+		}
 	}
 }
 
@@ -177,10 +714,36 @@ func (data *DNSData) addPTR(name string, ip net.IP) error {
 			Name:   arpa,
 			Rrtype: dns.TypePTR,
 			Class:  dns.ClassINET,
-			Ttl:    data.DefaultTTL,
+			Ttl:    data.ReverseTTL,
 		},
 		Ptr: name,
 	}
 
 	return nil
 }
+
+// Remove the PTR record for the specified IP address (if it refers to the specified name).
+func (data *DNSData) removePTR(name string, ip net.IP) error {
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return err
+	}
+
+	record, ok := data.reverseLookups[arpa]
+	if ok && dnsName(record.Ptr) == name {
+		delete(data.reverseLookups, arpa)
+	}
+
+	return nil
+}
+
+// Split text into character-strings for a TXT record (each character-string can be at most 255 bytes).
+func splitTXT(text string) []string {
+	var chunks []string
+	for len(text) > 255 {
+		chunks = append(chunks, text[:255])
+		text = text[255:]
+	}
+
+	return append(chunks, text)
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// The EDNS0 UDP buffer size advertised in DNSSEC responses.
+const dnssecUDPBufferSize = 4096
+
+// DNSSigner signs the pseudo-zone using a key-signing key (KSK) and zone-signing key (ZSK).
+type DNSSigner struct {
+	KSK        *dns.DNSKEY
+	kskPrivate crypto.Signer
+
+	ZSK        *dns.DNSKEY
+	zskPrivate crypto.Signer
+
+	// How long signatures remain valid.
+	SignatureValidity time.Duration
+}
+
+// LoadDNSSigner loads the KSK and ZSK for a zone from disk.
+//
+// Each key file is a BIND-style file name prefix (e.g. "Kmcp.+013+12345"); the public key is read from "<prefix>.key" and the private key from "<prefix>.private".
+func LoadDNSSigner(zone string, kskFile string, zskFile string, signatureValidity time.Duration) (*DNSSigner, error) {
+	ksk, kskPrivate, err := loadDNSKey(zone, kskFile)
+	if err != nil {
+		return nil, err
+	}
+	if ksk.Flags&dns.SEP == 0 {
+		log.Printf("Warning: DNSSEC key-signing key '%s' does not have the SEP flag set.", kskFile)
+	}
+
+	zsk, zskPrivate, err := loadDNSKey(zone, zskFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DNSSigner{
+		KSK:               ksk,
+		kskPrivate:        kskPrivate,
+		ZSK:               zsk,
+		zskPrivate:        zskPrivate,
+		SignatureValidity: signatureValidity,
+	}, nil
+}
+
+// Load the DNSSEC signer for a zone using the current configuration.
+func loadDNSSigner(zone string) (*DNSSigner, error) {
+	kskFile := viper.GetString("dns.dnssec.ksk")
+	if len(kskFile) == 0 {
+		return nil, fmt.Errorf("dns.dnssec.ksk / MCP_DNS_DNSSEC_KSK must be set if dns.dnssec.enable / MCP_DNS_DNSSEC_ENABLE is true")
+	}
+	zskFile := viper.GetString("dns.dnssec.zsk")
+	if len(zskFile) == 0 {
+		return nil, fmt.Errorf("dns.dnssec.zsk / MCP_DNS_DNSSEC_ZSK must be set if dns.dnssec.enable / MCP_DNS_DNSSEC_ENABLE is true")
+	}
+	signatureValidity := viper.GetDuration("dns.dnssec.signature_validity")
+	if signatureValidity < 2*time.Hour {
+		return nil, fmt.Errorf("dns.dnssec.signature_validity (%s) is invalid (must be at least 2h)", signatureValidity)
+	}
+
+	return LoadDNSSigner(zone, kskFile, zskFile, signatureValidity)
+}
+
+// PrintDNSSECDelegation prints the DS record for the configured zone (to be added to the parent zone).
+func PrintDNSSECDelegation() error {
+	err := loadConfiguration()
+	if err != nil {
+		return err
+	}
+
+	signer, err := loadDNSSigner(
+		dns.Fqdn(viper.GetString("dns.domain_name")),
+	)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(signer.DS().String())
+
+	return nil
+}
+
+// DNSKEYs retrieves the DNSKEY records for the zone.
+func (signer *DNSSigner) DNSKEYs() []dns.RR {
+	return []dns.RR{signer.KSK, signer.ZSK}
+}
+
+// DS creates the DS record (SHA-256 digest of the KSK) used to delegate the zone to its parent.
+func (signer *DNSSigner) DS() *dns.DS {
+	return signer.KSK.ToDS(dns.SHA256)
+}
+
+// Sign an RRset (DNSKEY RRsets are signed with the KSK; all others are signed with the ZSK).
+func (signer *DNSSigner) Sign(rrset []dns.RR, inception time.Time) (*dns.RRSIG, error) {
+	key := signer.ZSK
+	privateKey := signer.zskPrivate
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key = signer.KSK
+		privateKey = signer.kskPrivate
+	}
+
+	signature := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: rrset[0].Header().Ttl,
+		},
+		Algorithm:  key.Algorithm,
+		KeyTag:     key.KeyTag(),
+		SignerName: key.Hdr.Name,
+		Inception:  uint32(inception.Add(-1 * time.Hour).Unix()), // Allow for clock skew.
+		Expiration: uint32(inception.Add(signer.SignatureValidity).Unix()),
+	}
+
+	err := signature.Sign(privateKey, rrset)
+	if err != nil {
+		return nil, err
+	}
+
+	return signature, nil
+}
+
+// SignedZone holds the DNSSEC signatures and denial-of-existence (NSEC) records for the pseudo-zone.
+type SignedZone struct {
+	// The zone serial number that was signed.
+	Serial uint32
+
+	// When the zone should be re-signed (before its signatures expire).
+	RefreshAfter time.Time
+
+	signatures  map[string][]dns.RR
+	nsecRecords map[string]*dns.NSEC
+	owners      []string
+}
+
+// NeedsRefresh determines whether the zone should be re-signed.
+func (signedZone *SignedZone) NeedsRefresh() bool {
+	return time.Now().After(signedZone.RefreshAfter)
+}
+
+// FindSignatures retrieves the signatures (if any) for the RRset with the specified name and type.
+func (signedZone *SignedZone) FindSignatures(name string, rrtype uint16) []dns.RR {
+	return signedZone.signatures[rrsetKey(name, rrtype)]
+}
+
+// FindNSEC retrieves the NSEC record (and its signatures) whose owner is the specified name.
+func (signedZone *SignedZone) FindNSEC(name string) []dns.RR {
+	nsec, ok := signedZone.nsecRecords[strings.ToLower(dns.Fqdn(name))]
+	if !ok {
+		return nil
+	}
+
+	return append([]dns.RR{nsec}, signedZone.FindSignatures(nsec.Hdr.Name, dns.TypeNSEC)...)
+}
+
+// FindCoveringNSEC retrieves the NSEC record (and its signatures) that proves the specified name does not exist.
+func (signedZone *SignedZone) FindCoveringNSEC(name string) []dns.RR {
+	if len(signedZone.owners) == 0 {
+		return nil
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	nextOwner := sort.Search(len(signedZone.owners), func(index int) bool {
+		return canonicalNameLess(name, signedZone.owners[index])
+	})
+	if nextOwner == 0 {
+		nextOwner = len(signedZone.owners) // Wrap around.
+	}
+
+	return signedZone.FindNSEC(signedZone.owners[nextOwner-1])
+}
+
+// Sign the pseudo-zone.
+func (service *Service) signDNSZone(data *DNSData) (*SignedZone, error) {
+	signer := service.dnsSigner
+	now := time.Now()
+
+	signedZone := &SignedZone{
+		Serial:       data.Serial,
+		RefreshAfter: now.Add(signer.SignatureValidity / 2),
+		signatures:   make(map[string][]dns.RR),
+		nsecRecords:  make(map[string]*dns.NSEC),
+	}
+
+	// Group all authoritative records into RRsets.
+	var records []dns.RR
+	records = append(records, service.dnsZoneSOA(data))
+	records = append(records, service.dnsZoneApexRecords(data)...)
+	records = append(records, signer.DNSKEYs()...)
+	records = append(records, data.ZoneRecords()...)
+
+	rrsets := make(map[string][]dns.RR)
+	typesByOwner := make(map[string]map[uint16]bool)
+	for _, record := range records {
+		header := record.Header()
+		owner := strings.ToLower(header.Name)
+
+		key := rrsetKey(owner, header.Rrtype)
+		rrsets[key] = append(rrsets[key], record)
+
+		if typesByOwner[owner] == nil {
+			typesByOwner[owner] = make(map[uint16]bool)
+		}
+		typesByOwner[owner][header.Rrtype] = true
+	}
+
+	for key, rrset := range rrsets {
+		signature, err := signer.Sign(rrset, now)
+		if err != nil {
+			return nil, fmt.Errorf("unable to sign RRset '%s': %s", key, err.Error())
+		}
+		signedZone.signatures[key] = append(signedZone.signatures[key], signature)
+	}
+
+	// Build the NSEC chain (in canonical order).
+	for owner := range typesByOwner {
+		signedZone.owners = append(signedZone.owners, owner)
+	}
+	sort.Slice(signedZone.owners, func(index1 int, index2 int) bool {
+		return canonicalNameLess(signedZone.owners[index1], signedZone.owners[index2])
+	})
+
+	for index, owner := range signedZone.owners {
+		nextOwner := signedZone.owners[(index+1)%len(signedZone.owners)]
+
+		typeBitMap := []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+		for rrtype := range typesByOwner[owner] {
+			typeBitMap = append(typeBitMap, rrtype)
+		}
+		sort.Slice(typeBitMap, func(index1 int, index2 int) bool {
+			return typeBitMap[index1] < typeBitMap[index2]
+		})
+
+		nsec := &dns.NSEC{
+			Hdr: dns.RR_Header{
+				Name:   owner,
+				Rrtype: dns.TypeNSEC,
+				Class:  dns.ClassINET,
+				Ttl:    data.NegativeTTL, // SOA minimum
+			},
+			NextDomain: nextOwner,
+			TypeBitMap: typeBitMap,
+		}
+		signedZone.nsecRecords[owner] = nsec
+
+		signature, err := signer.Sign([]dns.RR{nsec}, now)
+		if err != nil {
+			return nil, fmt.Errorf("unable to sign NSEC record for '%s': %s", owner, err.Error())
+		}
+		signedZone.signatures[rrsetKey(owner, dns.TypeNSEC)] = []dns.RR{signature}
+	}
+
+	log.Printf("Signed DNS zone '%s' (serial %d, %d RRsets, %d names).",
+		service.DNSDomainName,
+		data.Serial,
+		len(rrsets),
+		len(signedZone.owners),
+	)
+
+	return signedZone, nil
+}
+
+// Sign new DNS data (re-using the current signatures if the zone has not changed and they are not due to be refreshed).
+//
+// The caller must hold the state lock.
+func (service *Service) updateZoneSignatures(data *DNSData, currentSignedZone *SignedZone) {
+	if service.dnsSigner == nil {
+		return
+	}
+
+	if currentSignedZone != nil && currentSignedZone.Serial == data.Serial && !currentSignedZone.NeedsRefresh() {
+		data.SignedZone = currentSignedZone
+
+		return
+	}
+
+	signedZone, err := service.signDNSZone(data)
+	if err != nil {
+		log.Printf("Unable to sign DNS zone '%s': %s", service.DNSDomainName, err.Error())
+
+		return
+	}
+	data.SignedZone = signedZone
+}
+
+// Add DNSSEC records (signatures and proof of non-existence) to a response, if the client requested them.
+func (service *Service) dnssecAddRecords(response *dns.Msg, request *dns.Msg, data *DNSData) {
+	requestOPT := request.IsEdns0()
+	if service.dnsSigner == nil || data.SignedZone == nil || requestOPT == nil || !requestOPT.Do() {
+		return
+	}
+	signedZone := data.SignedZone
+
+	response.Answer = append(response.Answer, findSignaturesForRecords(signedZone, data, response.Answer)...)
+	response.Ns = append(response.Ns, findSignaturesForRecords(signedZone, data, response.Ns)...)
+	response.Extra = append(response.Extra, findSignaturesForRecords(signedZone, data, response.Extra)...)
+
+	// Authenticated denial of existence.
+	if len(response.Question) == 1 && service.isInDNSZone(response.Question[0].Name) {
+		qname := response.Question[0].Name
+		wildcard := data.FindWildcard(qname)
+
+		switch {
+		case response.Rcode == dns.RcodeNameError:
+			response.Ns = append(response.Ns, signedZone.FindCoveringNSEC(qname)...)
+
+			// Also prove there is no wildcard at the closest encloser.
+			wildcard := "*." + closestEncloser(signedZone, data, qname)
+			if !isSameNSEC(signedZone.FindCoveringNSEC(wildcard), signedZone.FindCoveringNSEC(qname)) {
+				response.Ns = append(response.Ns, signedZone.FindCoveringNSEC(wildcard)...)
+			}
+
+		case wildcard != "":
+			// The response comes from a wildcard, so prove that the name itself does not exist.
+			response.Ns = append(response.Ns, signedZone.FindCoveringNSEC(qname)...)
+			if len(response.Answer) == 0 {
+				response.Ns = append(response.Ns, signedZone.FindNSEC(wildcard)...)
+			}
+
+		case response.Rcode == dns.RcodeSuccess && len(response.Answer) == 0:
+			if nsec := signedZone.FindNSEC(qname); len(nsec) > 0 {
+				response.Ns = append(response.Ns, nsec...)
+			} else {
+				// Empty non-terminals have no NSEC record of their own (the covering NSEC proves they have no records).
+				response.Ns = append(response.Ns, signedZone.FindCoveringNSEC(qname)...)
+			}
+		}
+	}
+
+	response.SetEdns0(dnssecUDPBufferSize, true)
+}
+
+// Find the signatures for the RRsets in a set of records (including records synthesised from wildcards).
+func findSignaturesForRecords(signedZone *SignedZone, data *DNSData, records []dns.RR) []dns.RR {
+	var signatures []dns.RR
+
+	seen := make(map[string]bool)
+	for _, record := range records {
+		header := record.Header()
+		if header.Rrtype == dns.TypeRRSIG || header.Rrtype == dns.TypeNSEC || header.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		key := rrsetKey(header.Name, header.Rrtype)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		rrsetSignatures := signedZone.FindSignatures(header.Name, header.Rrtype)
+		if wildcard := data.FindWildcard(header.Name); len(rrsetSignatures) == 0 && wildcard != "" {
+			for _, wildcardSignature := range signedZone.FindSignatures(wildcard, header.Rrtype) {
+				signature := dns.Copy(wildcardSignature)
+				signature.Header().Name = header.Name
+				rrsetSignatures = append(rrsetSignatures, signature)
+			}
+		}
+		signatures = append(signatures, rrsetSignatures...)
+	}
+
+	return signatures
+}
+
+// Find the closest existing ancestor of a name (which may be an empty non-terminal).
+func closestEncloser(signedZone *SignedZone, data *DNSData, name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+	for {
+		if _, ok := signedZone.nsecRecords[name]; ok || data.NameExists(name) {
+			return name
+		}
+
+		labelIndexes := dns.Split(name)
+		if len(labelIndexes) < 2 {
+			return name
+		}
+		name = name[labelIndexes[1]:]
+	}
+}
+
+// Determine whether two NSEC responses (from FindCoveringNSEC) refer to the same NSEC record.
+func isSameNSEC(nsec1 []dns.RR, nsec2 []dns.RR) bool {
+	if len(nsec1) == 0 || len(nsec2) == 0 {
+		return len(nsec1) == len(nsec2)
+	}
+
+	return nsec1[0].Header().Name == nsec2[0].Header().Name
+}
+
+// Compare names using canonical DNS name order (RFC 4034, section 6.1).
+func canonicalNameLess(name1 string, name2 string) bool {
+	labels1 := dns.SplitDomainName(strings.ToLower(name1))
+	labels2 := dns.SplitDomainName(strings.ToLower(name2))
+
+	for index := 1; index <= len(labels1) && index <= len(labels2); index++ {
+		label1 := labels1[len(labels1)-index]
+		label2 := labels2[len(labels2)-index]
+		if label1 != label2 {
+			return label1 < label2
+		}
+	}
+
+	return len(labels1) < len(labels2)
+}
+
+// The key used to identify an RRset.
+func rrsetKey(name string, rrtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + "/" + dns.TypeToString[rrtype]
+}
+
+// Load a DNSSEC key pair from "<filePrefix>.key" and "<filePrefix>.private".
+func loadDNSKey(zone string, filePrefix string) (*dns.DNSKEY, crypto.Signer, error) {
+	filePrefix = strings.TrimSuffix(strings.TrimSuffix(filePrefix, ".key"), ".private")
+
+	publicKeyFile, err := os.Open(filePrefix + ".key")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer publicKeyFile.Close()
+
+	publicKey, err := dns.ReadRR(publicKeyFile, filePrefix+".key")
+	if err != nil {
+		return nil, nil, err
+	}
+	dnsKey, ok := publicKey.(*dns.DNSKEY)
+	if !ok {
+		return nil, nil, fmt.Errorf("'%s.key' does not contain a DNSKEY record", filePrefix)
+	}
+	if !strings.EqualFold(dnsKey.Hdr.Name, zone) {
+		return nil, nil, fmt.Errorf("DNSSEC key '%s' is for zone '%s' (expected '%s')", filePrefix, dnsKey.Hdr.Name, zone)
+	}
+
+	privateKeyFile, err := os.Open(filePrefix + ".private")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer privateKeyFile.Close()
+
+	privateKey, err := dnsKey.ReadPrivateKey(privateKeyFile, filePrefix+".private")
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("DNSSEC key '%s' uses an unsupported algorithm (%s)", filePrefix, dns.AlgorithmToString[dnsKey.Algorithm])
+	}
+
+	return dnsKey, signer, nil
+}
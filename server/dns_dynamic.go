@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DynamicDNSRecord represents an address record registered by a DHCP client or a dynamic update (RFC 2136), rather than one that comes from CloudControl.
+type DynamicDNSRecord struct {
+	// The record's fully-qualified name.
+	Name string
+
+	// The record's IPv4 / IPv6 address.
+	IPAddress net.IP
+
+	// The MAC address of the DHCP client that registered the record (if any).
+	MACAddress string
+
+	// The date and time when the record expires (zero if the record does not expire).
+	Expires time.Time
+}
+
+// IsExpired determines whether the record has expired.
+func (record DynamicDNSRecord) IsExpired() bool {
+	return !record.Expires.IsZero() && time.Now().Sub(record.Expires) >= 0
+}
+
+// The key used to identify the record.
+func (record DynamicDNSRecord) key() string {
+	return record.Name + "/" + record.IPAddress.String()
+}
+
+// Publish new DNS data, made up of the records from CloudControl plus any dynamic records.
+//
+// The caller must hold the state lock.
+func (service *Service) publishDNSData() {
+	data := service.cloudControlDNSData.Clone()
+	service.applyDynamicDNSRecords(&data)
+
+	zoneChanged := service.EnableDNS && service.updateZoneSerial(&data)
+	service.updateZoneSignatures(&data, service.DNSData.SignedZone)
+
+	service.publishDNSViews(&data)
+
+	if zoneChanged && service.EnableDNSTransfer {
+		service.dnsNotifySecondaries(data)
+	}
+}
+
+// Add dynamic records to DNS data (removing any that have expired).
+//
+// Dynamic records never override names or addresses that come from CloudControl.
+//
+// The caller must hold the state lock.
+func (service *Service) applyDynamicDNSRecords(data *DNSData) {
+	for key, record := range service.DynamicDNSRecords {
+		if record.IsExpired() {
+			if service.EnableDebugLogging {
+				log.Printf("Dynamic DNS record %s -> %s has expired.", record.Name, record.IPAddress)
+			}
+
+			delete(service.DynamicDNSRecords, key)
+
+			continue
+		}
+
+		if service.isCloudControlDNSName(record.Name) || service.isCloudControlIPAddress(record.IPAddress) {
+			if service.EnableDebugLogging {
+				log.Printf("Ignoring dynamic DNS record %s -> %s (conflicts with a record from CloudControl).", record.Name, record.IPAddress)
+			}
+
+			continue
+		}
+
+		err := data.Add(record.Name, record.IPAddress)
+		if err != nil {
+			log.Printf("Unable to add dynamic DNS record %s -> %s: %s", record.Name, record.IPAddress, err.Error())
+		}
+	}
+}
+
+// Determine whether the specified name belongs to a record that comes from CloudControl.
+func (service *Service) isCloudControlDNSName(name string) bool {
+	return service.cloudControlDNSData.HasName(name)
+}
+
+// Determine whether the specified address belongs to a record that comes from CloudControl.
+func (service *Service) isCloudControlIPAddress(ip net.IP) bool {
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return false
+	}
+
+	return service.cloudControlDNSData.FindPTR(arpa) != nil
+}
+
+// Register DNS records for a DHCP client's lease.
+func (service *Service) registerDHCPClient(transactionID string, macAddress string, hostName string, lease Lease) string {
+	fqdn := service.dhcpClientDNSName(hostName)
+	if fqdn == "" {
+		return ""
+	}
+
+	service.acquireStateLock("registerDHCPClient")
+	defer service.releaseStateLock("registerDHCPClient")
+
+	if service.isCloudControlDNSName(fqdn) {
+		log.Printf("[TXN: %s] Not registering DNS name '%s' for client with MAC address %s (name belongs to a server in CloudControl).",
+			transactionID,
+			fqdn,
+			macAddress,
+		)
+
+		return ""
+	}
+
+	service.removeDynamicDNSRecords(func(record DynamicDNSRecord) bool {
+		return record.MACAddress == macAddress || record.Name == fqdn
+	})
+
+	record := DynamicDNSRecord{
+		Name:       fqdn,
+		IPAddress:  lease.IPAddress,
+		MACAddress: macAddress,
+		Expires:    lease.Expires,
+	}
+	service.DynamicDNSRecords[record.key()] = record
+
+	log.Printf("[TXN: %s] Registered DNS name '%s' -> %s for client with MAC address %s (until %s).",
+		transactionID,
+		fqdn,
+		lease.IPAddress,
+		macAddress,
+		lease.Expires.Format(time.RFC3339),
+	)
+
+	service.publishDNSData()
+
+	return fqdn
+}
+
+// Remove DNS records registered for a DHCP client.
+func (service *Service) unregisterDHCPClient(transactionID string, macAddress string) {
+	service.acquireStateLock("unregisterDHCPClient")
+	defer service.releaseStateLock("unregisterDHCPClient")
+
+	removed := service.removeDynamicDNSRecords(func(record DynamicDNSRecord) bool {
+		return record.MACAddress == macAddress
+	})
+	if removed == 0 {
+		return
+	}
+
+	log.Printf("[TXN: %s] Removed DNS registration for client with MAC address %s.",
+		transactionID,
+		macAddress,
+	)
+
+	service.publishDNSData()
+}
+
+// Remove dynamic records that match the specified predicate.
+//
+// The caller must hold the state lock.
+func (service *Service) removeDynamicDNSRecords(predicate func(record DynamicDNSRecord) bool) (removed int) {
+	for key, record := range service.DynamicDNSRecords {
+		if predicate(record) {
+			delete(service.DynamicDNSRecords, key)
+			removed++
+		}
+	}
+
+	return
+}
+
+// Get the fully-qualified name in the pseudo-zone for a DHCP client's host name.
+//
+// Names that are already in the pseudo-zone are used as-is; otherwise, only the first label is used.
+func (service *Service) dhcpClientDNSName(hostName string) string {
+	fqdn := dns.Fqdn(strings.ToLower(hostName))
+	if strings.HasSuffix(fqdn, "."+service.DNSDomainName) {
+		return fqdn
+	}
+
+	label := toDNSLabel(
+		strings.SplitN(hostName, ".", 2)[0],
+	)
+	if label == "" {
+		return ""
+	}
+
+	return dns.Fqdn(label + "." + service.DNSDomainName)
+}
+
+// Handle a dynamic update (RFC 2136) request.
+func (service *Service) dnsUpdate(send dns.ResponseWriter, request *dns.Msg) {
+	if !service.EnableDNSUpdate {
+		service.dnsSendRcode(dns.RcodeRefused, send, request)
+
+		return
+	}
+
+	if len(request.Question) != 1 || request.Question[0].Qtype != dns.TypeSOA {
+		service.dnsSendRcode(dns.RcodeFormatError, send, request)
+
+		return
+	}
+	if dns.Fqdn(strings.ToLower(request.Question[0].Name)) != service.DNSDomainName {
+		service.dnsSendRcode(dns.RcodeNotAuth, send, request)
+
+		return
+	}
+
+	if !service.isDNSUpdateAllowed(send, request) {
+		log.Printf("Refused dynamic update %d of '%s' from %s.",
+			request.Id,
+			request.Question[0].Name,
+			send.RemoteAddr(),
+		)
+
+		service.dnsSendRcode(dns.RcodeRefused, send, request)
+
+		return
+	}
+
+	service.acquireStateLock("dnsUpdate")
+	defer service.releaseStateLock("dnsUpdate")
+
+	rcode := service.checkDNSUpdatePrerequisites(request.Answer)
+	if rcode == dns.RcodeSuccess {
+		rcode = service.checkDNSUpdates(request.Ns)
+	}
+	if rcode != dns.RcodeSuccess {
+		log.Printf("Rejected dynamic update %d of '%s' from %s (%s).",
+			request.Id,
+			request.Question[0].Name,
+			send.RemoteAddr(),
+			dns.RcodeToString[rcode],
+		)
+
+		service.dnsSendRcode(rcode, send, request)
+
+		return
+	}
+
+	for _, update := range request.Ns {
+		service.applyDNSUpdate(update)
+	}
+	service.publishDNSData()
+
+	log.Printf("Applied dynamic update %d (%d changes) of '%s' from %s.",
+		request.Id,
+		len(request.Ns),
+		request.Question[0].Name,
+		send.RemoteAddr(),
+	)
+
+	service.dnsSendRcode(dns.RcodeSuccess, send, request)
+}
+
+// Determine whether the sender of a dynamic update is permitted to update the zone.
+//
+// Dynamic updates must always be signed with the configured TSIG key.
+func (service *Service) isDNSUpdateAllowed(send dns.ResponseWriter, request *dns.Msg) bool {
+	if service.DNSTSIGKeyName == "" {
+		return false
+	}
+
+	requestTSIG := request.IsTsig()
+	if requestTSIG == nil || !service.isDNSTSIGKeyName(requestTSIG.Hdr.Name) || send.TsigStatus() != nil {
+		return false
+	}
+
+	if len(service.DNSUpdateAllowFrom) > 0 {
+		sourceIP := remoteIP(send.RemoteAddr())
+		for _, allowedNetwork := range service.DNSUpdateAllowFrom {
+			if sourceIP != nil && allowedNetwork.Contains(sourceIP) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// Check the prerequisites of a dynamic update (RFC 2136, section 3.2).
+//
+// The caller must hold the state lock.
+func (service *Service) checkDNSUpdatePrerequisites(prerequisites []dns.RR) int {
+	data := service.DNSData
+
+	for _, prerequisite := range prerequisites {
+		header := prerequisite.Header()
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !service.isInDNSZone(header.Name) {
+			return dns.RcodeNotZone
+		}
+
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rrtype == dns.TypeANY {
+				if !data.HasName(header.Name) {
+					return dns.RcodeNameError
+				}
+			} else if len(data.FindRecords(header.Name, header.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+
+		case dns.ClassNONE:
+			if header.Rrtype == dns.TypeANY {
+				if data.HasName(header.Name) {
+					return dns.RcodeYXDomain
+				}
+			} else if len(data.FindRecords(header.Name, header.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+
+		case dns.ClassINET:
+			if !containsDNSRecord(data.FindRecords(header.Name, header.Rrtype), prerequisite) {
+				return dns.RcodeNXRrset
+			}
+
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// Check the updates in a dynamic update before applying them (RFC 2136, section 3.4.1).
+//
+// Only address (A / AAAA) records can be updated, and names that come from CloudControl cannot be updated.
+//
+// The caller must hold the state lock.
+func (service *Service) checkDNSUpdates(updates []dns.RR) int {
+	for _, update := range updates {
+		header := update.Header()
+		if !service.isInDNSZone(header.Name) {
+			return dns.RcodeNotZone
+		}
+
+		switch header.Class {
+		case dns.ClassINET, dns.ClassNONE:
+			if header.Rrtype != dns.TypeA && header.Rrtype != dns.TypeAAAA {
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if header.Rrtype != dns.TypeA && header.Rrtype != dns.TypeAAAA && header.Rrtype != dns.TypeANY {
+				return dns.RcodeRefused
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+
+		if service.isCloudControlDNSName(header.Name) {
+			return dns.RcodeRefused
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// Apply an update from a dynamic update (RFC 2136, section 3.4.2).
+//
+// The caller must hold the state lock.
+func (service *Service) applyDNSUpdate(update dns.RR) {
+	header := update.Header()
+	name := dns.Fqdn(strings.ToLower(header.Name))
+
+	switch header.Class {
+	case dns.ClassINET:
+		// Add to an RRset.
+		ip := dnsRecordIPAddress(update)
+		if ip == nil {
+			return
+		}
+
+		record := DynamicDNSRecord{
+			Name:      name,
+			IPAddress: ip,
+		}
+		service.DynamicDNSRecords[record.key()] = record
+
+	case dns.ClassANY:
+		// Delete an RRset (or all RRsets for a name).
+		service.removeDynamicDNSRecords(func(record DynamicDNSRecord) bool {
+			if record.Name != name {
+				return false
+			}
+
+			switch header.Rrtype {
+			case dns.TypeA:
+				return record.IPAddress.To4() != nil
+			case dns.TypeAAAA:
+				return record.IPAddress.To4() == nil
+			default:
+				return true
+			}
+		})
+
+	case dns.ClassNONE:
+		// Delete an RR from an RRset.
+		ip := dnsRecordIPAddress(update)
+		service.removeDynamicDNSRecords(func(record DynamicDNSRecord) bool {
+			return record.Name == name && record.IPAddress.Equal(ip)
+		})
+	}
+}
+
+// Determine whether the specified name lies within the pseudo-zone.
+func (service *Service) isInDNSZone(name string) bool {
+	fqdn := dns.Fqdn(strings.ToLower(name))
+
+	return fqdn == service.DNSDomainName || strings.HasSuffix(fqdn, "."+service.DNSDomainName)
+}
+
+// Determine whether the specified name is the apex of the pseudo-zone.
+func (service *Service) isDNSZoneApex(name string) bool {
+	return dnsName(name) == service.DNSDomainName
+}
+
+// Get the IP address from an A / AAAA record.
+func dnsRecordIPAddress(record dns.RR) net.IP {
+	switch addressRecord := record.(type) {
+	case *dns.A:
+		return addressRecord.A
+	case *dns.AAAA:
+		return addressRecord.AAAA
+	default:
+		return nil
+	}
+}
+
+// Determine whether a set of records contains the specified record (ignoring TTL and class).
+func containsDNSRecord(records []dns.RR, record dns.RR) bool {
+	recordData := dnsRecordData(record)
+	for _, existingRecord := range records {
+		if dnsRecordData(existingRecord) == recordData {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get a record's name, type, and data (but not its TTL or class) as a string.
+func dnsRecordData(record dns.RR) string {
+	header := record.Header()
+	headerText := header.String()
+
+	return fmt.Sprintf("%s %s %s",
+		strings.ToLower(header.Name),
+		dns.TypeToString[header.Rrtype],
+		strings.TrimPrefix(record.String(), headerText),
+	)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The default timeout for queries forwarded to an upstream resolver.
+const dnsForwardingTimeout = 5 * time.Second
+
+// The MIME type for DNS wire-format messages (RFC 8484).
+const dnsMessageContentType = "application/dns-message"
+
+// DNSForwarder forwards DNS queries to an upstream resolver.
+type DNSForwarder interface {
+	// Forward sends the request to the upstream resolver and returns its response.
+	Forward(request *dns.Msg) (*dns.Msg, error)
+
+	// Upstream describes the upstream resolver (for logging).
+	Upstream() string
+}
+
+// NewDNSForwarder creates a DNSForwarder for the specified upstream resolver URL.
+//
+// Supported URL schemes are "udp://" (or no scheme at all), "tcp://", "tls://" (DNS-over-TLS, RFC 7858), and "https://" (DNS-over-HTTPS, RFC 8484).
+//
+// tlsConfig is only used for "tls://" and "https://" upstreams; if nil, the system CA bundle is used.
+func NewDNSForwarder(upstream string, tlsConfig *tls.Config) (DNSForwarder, error) {
+	upstreamURL, err := parseDNSUpstream(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	switch upstreamURL.Scheme {
+	case "udp", "tcp":
+		return &dnsClientForwarder{
+			address: hostPortWithDefault(upstreamURL.Host, 53),
+			client: &dns.Client{
+				Net:     upstreamURL.Scheme,
+				Timeout: dnsForwardingTimeout,
+			},
+		}, nil
+
+	case "tls":
+		address := hostPortWithDefault(upstreamURL.Host, 853)
+
+		return &dnsClientForwarder{
+			address: address,
+			client: &dns.Client{
+				Net:       "tcp-tls",
+				TLSConfig: tlsConfigForUpstream(tlsConfig, upstreamURL),
+				Timeout:   dnsForwardingTimeout,
+			},
+		}, nil
+
+	case "https":
+		return &dnsHTTPSForwarder{
+			url: upstreamURL.String(),
+			client: &http.Client{
+				Timeout: dnsForwardingTimeout,
+				Transport: &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: tlsConfigForUpstream(tlsConfig, upstreamURL),
+				},
+			},
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported scheme '%s' for upstream DNS resolver '%s' (expected udp, tcp, tls, or https)",
+			upstreamURL.Scheme,
+			upstream,
+		)
+	}
+}
+
+// NewDNSForwardingTLSConfig creates TLS configuration for encrypted upstream resolvers.
+//
+// If caFile is specified, it must contain one or more PEM-encoded CA certificates (used instead of the system CA bundle).
+// If serverName is specified, it overrides the name used for SNI and certificate verification.
+func NewDNSForwardingTLSConfig(caFile string, serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+	}
+
+	if caFile != "" {
+		caBundle, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle '%s': %s", caFile, err.Error())
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("CA bundle '%s' does not contain any PEM-encoded certificates", caFile)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// dnsClientForwarder forwards queries using DNS over UDP, TCP, or TLS.
+type dnsClientForwarder struct {
+	address string
+	client  *dns.Client
+}
+
+var _ DNSForwarder = &dnsClientForwarder{}
+
+// Forward sends the request to the upstream resolver and returns its response.
+func (forwarder *dnsClientForwarder) Forward(request *dns.Msg) (*dns.Msg, error) {
+	response, _, err := forwarder.client.Exchange(request, forwarder.address)
+
+	return response, err
+}
+
+// Upstream describes the upstream resolver (for logging).
+func (forwarder *dnsClientForwarder) Upstream() string {
+	return fmt.Sprintf("%s://%s", forwarder.client.Net, forwarder.address)
+}
+
+// dnsHTTPSForwarder forwards queries using DNS-over-HTTPS (RFC 8484).
+type dnsHTTPSForwarder struct {
+	url    string
+	client *http.Client
+}
+
+var _ DNSForwarder = &dnsHTTPSForwarder{}
+
+// Forward sends the request to the upstream resolver and returns its response.
+func (forwarder *dnsHTTPSForwarder) Forward(request *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends a message Id of 0 to make responses cache-friendly.
+	upstreamRequest := request.Copy()
+	upstreamRequest.Id = 0
+
+	requestBody, err := upstreamRequest.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpRequest, err := http.NewRequest("POST", forwarder.url, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", dnsMessageContentType)
+	httpRequest.Header.Set("Accept", dnsMessageContentType)
+
+	httpResponse, err := forwarder.client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream resolver '%s' returned unexpected status: %s",
+			forwarder.url,
+			httpResponse.Status,
+		)
+	}
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(dns.Msg)
+	err = response.Unpack(responseBody)
+	if err != nil {
+		return nil, err
+	}
+	response.Id = request.Id
+
+	return response, nil
+}
+
+// Upstream describes the upstream resolver (for logging).
+func (forwarder *dnsHTTPSForwarder) Upstream() string {
+	return forwarder.url
+}
+
+// Parse an upstream resolver URL (a bare address is treated as "udp://address").
+func parseDNSUpstream(upstream string) (*url.URL, error) {
+	if upstream == "" {
+		return nil, fmt.Errorf("upstream DNS resolver address cannot be empty")
+	}
+
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil || upstreamURL.Host == "" {
+		// Bare address (e.g. "8.8.8.8" or "8.8.8.8:53").
+		upstreamURL, err = url.Parse("udp://" + upstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream DNS resolver '%s': %s", upstream, err.Error())
+		}
+	}
+	if upstreamURL.Host == "" {
+		return nil, fmt.Errorf("invalid upstream DNS resolver '%s' (no host specified)", upstream)
+	}
+
+	return upstreamURL, nil
+}
+
+// Append the default port to the specified host (if it does not already specify one).
+func hostPortWithDefault(host string, defaultPort int) string {
+	_, _, err := net.SplitHostPort(host)
+	if err == nil {
+		return host
+	}
+
+	return net.JoinHostPort(host, fmt.Sprintf("%d", defaultPort))
+}
+
+// Create the TLS configuration for the specified upstream resolver.
+func tlsConfigForUpstream(tlsConfig *tls.Config, upstreamURL *url.URL) *tls.Config {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+
+	// Default SNI / verification name comes from the upstream URL.
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = upstreamURL.Hostname()
+	}
+
+	return tlsConfig
+}
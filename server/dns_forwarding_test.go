@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// A stand-in upstream resolver that answers every A query with 192.0.2.1.
+func testUpstreamHandler(writer dns.ResponseWriter, request *dns.Msg) {
+	writer.WriteMsg(testUpstreamResponse(request))
+}
+
+// Create the stand-in upstream resolver's response to the specified request.
+func testUpstreamResponse(request *dns.Msg) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetReply(request)
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   request.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.ParseIP("192.0.2.1"),
+	})
+
+	return response
+}
+
+// Start an in-process DNS server on the specified listener (stopped when the test completes).
+func startTestUpstreamServer(t *testing.T, server *dns.Server) {
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	server.Handler = dns.HandlerFunc(testUpstreamHandler)
+
+	go server.ActivateAndServe()
+	<-started
+
+	t.Cleanup(func() {
+		server.Shutdown()
+	})
+}
+
+// Start a stand-in DNS-over-HTTPS resolver (stopped when the test completes).
+func startTestDoHServer(t *testing.T) *httptest.Server {
+	httpsServer := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost || request.Header.Get("Content-Type") != dnsMessageContentType {
+			http.Error(writer, "expected a POSTed DNS message", http.StatusBadRequest)
+
+			return
+		}
+
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		query := new(dns.Msg)
+		err = query.Unpack(body)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		if query.Id != 0 {
+			http.Error(writer, "expected message Id 0", http.StatusBadRequest)
+
+			return
+		}
+
+		responseBody, err := testUpstreamResponse(query).Pack()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+		writer.Header().Set("Content-Type", dnsMessageContentType)
+		writer.Write(responseBody)
+	}))
+	t.Cleanup(httpsServer.Close)
+
+	return httpsServer
+}
+
+// Create TLS configuration that trusts the stand-in resolvers' certificate.
+func testUpstreamTLSConfig(httpsServer *httptest.Server) *tls.Config {
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(httpsServer.Certificate())
+
+	return &tls.Config{
+		RootCAs: rootCAs,
+	}
+}
+
+func TestDNSForwarders(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestUpstreamServer(t, &dns.Server{PacketConn: udpConn})
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestUpstreamServer(t, &dns.Server{Listener: tcpListener})
+
+	// The DoH server's certificate (valid for 127.0.0.1) is also used by the DoT server.
+	httpsServer := startTestDoHServer(t)
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: httpsServer.TLS.Certificates,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestUpstreamServer(t, &dns.Server{Listener: tlsListener, Net: "tcp-tls"})
+
+	tlsConfig := testUpstreamTLSConfig(httpsServer)
+
+	upstreams := []string{
+		udpConn.LocalAddr().String(),
+		"udp://" + udpConn.LocalAddr().String(),
+		"tcp://" + tcpListener.Addr().String(),
+		"tls://" + tlsListener.Addr().String(),
+		httpsServer.URL + "/dns-query",
+	}
+	for _, upstream := range upstreams {
+		forwarder, err := NewDNSForwarder(upstream, tlsConfig)
+		if err != nil {
+			t.Fatalf("%s: %s", upstream, err)
+		}
+
+		request := new(dns.Msg)
+		request.SetQuestion("www.example.com.", dns.TypeA)
+
+		response, err := forwarder.Forward(request)
+		if err != nil {
+			t.Fatalf("%s: %s", upstream, err)
+		}
+		if response.Id != request.Id {
+			t.Errorf("%s: expected response Id %d, got %d", upstream, request.Id, response.Id)
+		}
+		if len(response.Answer) != 1 || response.Answer[0].String() != "www.example.com.\t60\tIN\tA\t192.0.2.1" {
+			t.Errorf("%s: unexpected answers %v", upstream, response.Answer)
+		}
+	}
+}
+
+func TestDNSForwardersRejectUntrustedCertificate(t *testing.T) {
+	httpsServer := startTestDoHServer(t)
+
+	// No CA bundle, so the test server's (self-signed) certificate is not trusted.
+	forwarder, err := NewDNSForwarder(httpsServer.URL+"/dns-query", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := new(dns.Msg)
+	request.SetQuestion("www.example.com.", dns.TypeA)
+
+	_, err = forwarder.Forward(request)
+	if err == nil {
+		t.Fatal("expected an error when the upstream resolver's certificate is not trusted")
+	}
+}
+
+func TestDNSForwarderUnsupportedScheme(t *testing.T) {
+	_, err := NewDNSForwarder("quic://127.0.0.1:853", nil)
+	if err == nil {
+		t.Fatal("expected an error for an unsupported upstream scheme")
+	}
+}
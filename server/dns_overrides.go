@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+const (
+	// DNSOverrideActionAddress answers queries for the name with the override's addresses.
+	DNSOverrideActionAddress = "address"
+
+	// DNSOverrideActionNXDomain answers queries for the name with NXDOMAIN.
+	DNSOverrideActionNXDomain = "nxdomain"
+
+	// DNSOverrideActionNoData answers queries for the name with an empty (NOERROR) response.
+	DNSOverrideActionNoData = "nodata"
+)
+
+const (
+	// DNSOverrideFormatHosts is the format for hosts files ("<address> <name> [<name>...]").
+	DNSOverrideFormatHosts = "hosts"
+
+	// DNSOverrideFormatRPZ is the format for response policy zone (RPZ) files.
+	DNSOverrideFormatRPZ = "rpz"
+)
+
+// DNSOverride represents a local override for a DNS name (and, if it is a wildcard, its sub-domains).
+type DNSOverride struct {
+	// The overridden name (wildcard names start with "*.").
+	Name string
+
+	// The action to take for queries that match the override.
+	Action string
+
+	// The addresses returned for the overridden name (if Action is DNSOverrideActionAddress).
+	Addresses []net.IP
+}
+
+// IsWildcard determines whether the override applies to the sub-domains of a name, rather than the name itself.
+func (override *DNSOverride) IsWildcard() bool {
+	return strings.HasPrefix(override.Name, "*.")
+}
+
+// DNSOverrides is a set of local overrides for DNS names (e.g. to sinkhole domains, or pin external names to internal addresses).
+type DNSOverrides struct {
+	exact     map[string]*DNSOverride
+	wildcards map[string]*DNSOverride
+}
+
+// NewDNSOverrides creates a new, empty, set of DNS overrides.
+func NewDNSOverrides() *DNSOverrides {
+	return &DNSOverrides{
+		exact:     make(map[string]*DNSOverride),
+		wildcards: make(map[string]*DNSOverride),
+	}
+}
+
+// Count gets the number of overrides in the set.
+func (overrides *DNSOverrides) Count() int {
+	return len(overrides.exact) + len(overrides.wildcards)
+}
+
+// Add an override to the set (merging its addresses with any existing override for the same name).
+func (overrides *DNSOverrides) Add(override DNSOverride) {
+	override.Name = strings.ToLower(dns.Fqdn(override.Name))
+
+	overridesByName := overrides.exact
+	name := override.Name
+	if override.IsWildcard() {
+		overridesByName = overrides.wildcards
+		name = strings.TrimPrefix(name, "*.")
+	}
+
+	existingOverride, ok := overridesByName[name]
+	if ok && existingOverride.Action == DNSOverrideActionAddress && override.Action == DNSOverrideActionAddress {
+		existingOverride.Addresses = append(existingOverride.Addresses, override.Addresses...)
+
+		return
+	}
+
+	overridesByName[name] = &override
+}
+
+// Find the override (if any) for the specified name.
+//
+// Exact matches take precedence over wildcards; the most specific matching wildcard is used.
+func (overrides *DNSOverrides) Find(name string) *DNSOverride {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	override, ok := overrides.exact[name]
+	if ok {
+		return override
+	}
+
+	labelIndexes := dns.Split(name)
+	for index := 1; index < len(labelIndexes); index++ {
+		override, ok = overrides.wildcards[name[labelIndexes[index]:]]
+		if ok {
+			return override
+		}
+	}
+
+	return nil
+}
+
+// Records gets the override's address records of the specified type (A or AAAA).
+func (override *DNSOverride) Records(name string, qtype uint16, ttl uint32) []dns.RR {
+	var records []dns.RR
+	for _, address := range override.Addresses {
+		header := dns.RR_Header{
+			Name:   name,
+			Rrtype: qtype,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		}
+
+		if qtype == dns.TypeA && address.To4() != nil {
+			records = append(records, &dns.A{Hdr: header, A: address.To4()})
+		} else if qtype == dns.TypeAAAA && address.To4() == nil {
+			records = append(records, &dns.AAAA{Hdr: header, AAAA: address})
+		}
+	}
+
+	return records
+}
+
+// Load DNS overrides from configuration ("dns.overrides.rules" and "dns.overrides.files").
+func loadDNSOverrides() (*DNSOverrides, error) {
+	overrides := NewDNSOverrides()
+
+	rulesValue := viper.Get("dns.overrides.rules")
+	if rulesValue != nil {
+		ruleValues, ok := rulesValue.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("dns.overrides.rules must be a list")
+		}
+
+		for index, ruleValue := range ruleValues {
+			rule, ok := ruleValue.(map[interface{}]interface{})
+			if !ok {
+				return nil, fmt.Errorf("dns.overrides.rules: rule %d is not a map", index+1)
+			}
+
+			override, err := parseDNSOverrideRule(rule)
+			if err != nil {
+				return nil, fmt.Errorf("dns.overrides.rules: rule %d is invalid: %s", index+1, err.Error())
+			}
+			overrides.Add(*override)
+		}
+	}
+
+	filesValue := viper.Get("dns.overrides.files")
+	if filesValue != nil {
+		fileValues, ok := filesValue.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("dns.overrides.files must be a list")
+		}
+
+		for index, fileValue := range fileValues {
+			file, ok := fileValue.(map[interface{}]interface{})
+			if !ok {
+				return nil, fmt.Errorf("dns.overrides.files: file %d is not a map", index+1)
+			}
+
+			path, _ := file["path"].(string)
+			if path == "" {
+				return nil, fmt.Errorf("dns.overrides.files: file %d must have a path", index+1)
+			}
+
+			format, _ := file["format"].(string)
+			switch format {
+			case DNSOverrideFormatHosts, "":
+				err := loadDNSOverridesFromHostsFile(path, overrides)
+				if err != nil {
+					return nil, err
+				}
+			case DNSOverrideFormatRPZ:
+				err := loadDNSOverridesFromRPZFile(path, overrides)
+				if err != nil {
+					return nil, err
+				}
+			default:
+				return nil, fmt.Errorf("dns.overrides.files: file '%s' has unsupported format '%s' (expected '%s' or '%s')",
+					path,
+					format,
+					DNSOverrideFormatHosts,
+					DNSOverrideFormatRPZ,
+				)
+			}
+		}
+	}
+
+	return overrides, nil
+}
+
+// Parse a DNS override rule from configuration.
+func parseDNSOverrideRule(rule map[interface{}]interface{}) (*DNSOverride, error) {
+	override := &DNSOverride{}
+
+	override.Name, _ = rule["name"].(string)
+	if override.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+
+	addresses, err := parseStringList(rule["addresses"])
+	if err != nil {
+		return nil, fmt.Errorf("addresses: %s", err.Error())
+	}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("'%s' is not a valid IP address", address)
+		}
+		override.Addresses = append(override.Addresses, ip)
+	}
+
+	override.Action, _ = rule["action"].(string)
+	switch override.Action {
+	case "":
+		if len(override.Addresses) == 0 {
+			return nil, fmt.Errorf("either action or addresses must be specified")
+		}
+		override.Action = DNSOverrideActionAddress
+	case DNSOverrideActionAddress:
+		if len(override.Addresses) == 0 {
+			return nil, fmt.Errorf("addresses must be specified if action is '%s'", DNSOverrideActionAddress)
+		}
+	case DNSOverrideActionNXDomain, DNSOverrideActionNoData:
+		if len(override.Addresses) > 0 {
+			return nil, fmt.Errorf("addresses cannot be specified if action is '%s'", override.Action)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported action '%s' (expected '%s', '%s', or '%s')",
+			override.Action,
+			DNSOverrideActionAddress,
+			DNSOverrideActionNXDomain,
+			DNSOverrideActionNoData,
+		)
+	}
+
+	return override, nil
+}
+
+// Load DNS overrides from a hosts file ("<address> <name> [<name>...]", with "#" comments).
+func loadDNSOverridesFromHostsFile(path string, overrides *DNSOverrides) error {
+	hostsFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer hostsFile.Close()
+
+	scanner := bufio.NewScanner(hostsFile)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := scanner.Text()
+		commentStart := strings.Index(line, "#")
+		if commentStart != -1 {
+			line = line[:commentStart]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: expected '<address> <name> [<name>...]'", path, lineNumber)
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return fmt.Errorf("%s:%d: '%s' is not a valid IP address", path, lineNumber, fields[0])
+		}
+
+		for _, name := range fields[1:] {
+			overrides.Add(DNSOverride{
+				Name:      name,
+				Action:    DNSOverrideActionAddress,
+				Addresses: []net.IP{ip},
+			})
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Load DNS overrides from a response policy zone (RPZ) file.
+//
+// Supported policies are "CNAME ." (NXDOMAIN), "CNAME *." (NODATA), and A / AAAA records (local data); names are relative to the zone's SOA record.
+func loadDNSOverridesFromRPZFile(path string, overrides *DNSOverrides) error {
+	rpzFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer rpzFile.Close()
+
+	var policyZone string
+	var parseError error
+	for token := range dns.ParseZone(rpzFile, ".", path) {
+		if token.Error != nil {
+			parseError = token.Error
+
+			continue
+		}
+		if parseError != nil {
+			continue // Drain remaining tokens.
+		}
+
+		header := token.RR.Header()
+		if header.Rrtype == dns.TypeSOA {
+			policyZone = strings.ToLower(header.Name)
+
+			continue
+		}
+
+		name := strings.ToLower(header.Name)
+		if policyZone != "" {
+			name = strings.TrimSuffix(name, policyZone)
+		}
+		if name == "" {
+			continue // Zone apex (e.g. NS records).
+		}
+
+		switch record := token.RR.(type) {
+		case *dns.CNAME:
+			switch record.Target {
+			case ".":
+				overrides.Add(DNSOverride{Name: name, Action: DNSOverrideActionNXDomain})
+			case "*.":
+				overrides.Add(DNSOverride{Name: name, Action: DNSOverrideActionNoData})
+			default:
+				log.Printf("Ignoring unsupported RPZ policy for '%s' in '%s' (CNAME %s).", name, path, record.Target)
+			}
+		case *dns.A:
+			overrides.Add(DNSOverride{Name: name, Action: DNSOverrideActionAddress, Addresses: []net.IP{record.A}})
+		case *dns.AAAA:
+			overrides.Add(DNSOverride{Name: name, Action: DNSOverrideActionAddress, Addresses: []net.IP{record.AAAA}})
+		case *dns.NS:
+			// Ignore.
+		default:
+			log.Printf("Ignoring unsupported RPZ record for '%s' in '%s' (%s).", name, path, dns.TypeToString[header.Rrtype])
+		}
+	}
+
+	return parseError
+}
+
+// ReloadDNSOverrides re-reads the configuration file and reloads DNS overrides.
+func (service *Service) ReloadDNSOverrides() error {
+	err := viper.ReadInConfig()
+	if err != nil {
+		return err
+	}
+
+	overrides, err := loadDNSOverrides()
+	if err != nil {
+		return err
+	}
+
+	service.dnsOverridesLock.Lock()
+	defer service.dnsOverridesLock.Unlock()
+
+	service.DNSOverrides = overrides
+
+	log.Printf("Loaded %d DNS overrides.", overrides.Count())
+
+	return nil
+}
+
+// Find the local override (if any) for the specified name.
+func (service *Service) findDNSOverride(name string) *DNSOverride {
+	service.dnsOverridesLock.RLock()
+	defer service.dnsOverridesLock.RUnlock()
+
+	return service.DNSOverrides.Find(name)
+}
+
+// Send a response for a name that has a local override.
+func (service *Service) dnsSendOverride(override *DNSOverride, view *DNSView, send dns.ResponseWriter, request *dns.Msg) {
+	question := request.Question[0]
+
+	rcode := dns.RcodeSuccess
+	if override.Action == DNSOverrideActionNXDomain {
+		rcode = dns.RcodeNameError
+	}
+
+	if service.EnableDebugLogging {
+		log.Printf("Replied to DNS query %d using local override '%s' (%s).", request.Id, override.Name, override.Action)
+	}
+
+	response := new(dns.Msg)
+	response.SetRcode(request, rcode)
+	response.Authoritative = true
+	if override.Action == DNSOverrideActionAddress {
+		response.Answer = override.Records(question.Name, question.Qtype, service.DNSTTL)
+	}
+
+	service.dnsWriteResponse(response, view, send, request)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSQueryLogEntry represents a single entry in the DNS query log.
+type DNSQueryLogEntry struct {
+	Time        string  `json:"time"`
+	Client      string  `json:"client"`
+	Protocol    string  `json:"protocol"`
+	View        string  `json:"view"`
+	QueryID     uint16  `json:"id"`
+	QName       string  `json:"qname"`
+	QType       string  `json:"qtype"`
+	RCode       string  `json:"rcode"`
+	LatencyMS   float64 `json:"latency_ms"`
+	Forwarded   bool    `json:"forwarded"`
+	RateLimited string  `json:"rate_limited,omitempty"`
+}
+
+// DNSQueryLog writes a structured (JSON, one entry per line) log of DNS queries.
+type DNSQueryLog struct {
+	// The fraction of queries (0.0 to 1.0) that are logged.
+	SampleRate float64
+
+	output    io.Writer
+	stateLock *sync.Mutex
+}
+
+// NewDNSQueryLog creates a new DNSQueryLog that writes to the specified file (or to standard output, if no file is specified).
+func NewDNSQueryLog(fileName string, sampleRate float64) (*DNSQueryLog, error) {
+	var output io.Writer = os.Stdout
+	if fileName != "" {
+		logFile, err := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		output = logFile
+	}
+
+	return &DNSQueryLog{
+		SampleRate: sampleRate,
+		output:     output,
+		stateLock:  &sync.Mutex{},
+	}, nil
+}
+
+// ShouldLog determines whether a query should be logged (based on the sample rate).
+func (queryLog *DNSQueryLog) ShouldLog() bool {
+	return queryLog.SampleRate >= 1.0 || rand.Float64() < queryLog.SampleRate
+}
+
+// Write an entry to the query log.
+func (queryLog *DNSQueryLog) Write(entry DNSQueryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Unable to write DNS query log entry: %s", err.Error())
+
+		return
+	}
+	line = append(line, '\n')
+
+	queryLog.stateLock.Lock()
+	defer queryLog.stateLock.Unlock()
+
+	_, err = queryLog.output.Write(line)
+	if err != nil {
+		log.Printf("Unable to write DNS query log entry: %s", err.Error())
+	}
+}
+
+// dnsResponseWriter wraps a dns.ResponseWriter to apply response-rate limiting and record query log entries.
+type dnsResponseWriter struct {
+	dns.ResponseWriter
+
+	service   *Service
+	request   *dns.Msg
+	view      *DNSView
+	received  time.Time
+	forwarded bool
+
+	response    *dns.Msg
+	rateLimited string
+}
+
+// Wrap a dns.ResponseWriter to apply response-rate limiting and query logging (returns nil if neither is enabled).
+func (service *Service) wrapDNSResponseWriter(send dns.ResponseWriter, request *dns.Msg, view *DNSView) *dnsResponseWriter {
+	if service.dnsQueryLog == nil && service.dnsRateLimiter == nil {
+		return nil
+	}
+
+	return &dnsResponseWriter{
+		ResponseWriter: send,
+		service:        service,
+		request:        request,
+		view:           view,
+		received:       time.Now(),
+	}
+}
+
+// WriteMsg writes a response (unless it is rate-limited).
+func (writer *dnsResponseWriter) WriteMsg(response *dns.Msg) error {
+	writer.response = response
+
+	rateLimiter := writer.service.dnsRateLimiter
+	if rateLimiter != nil && isUDPRequest(writer) {
+		switch rateLimiter.Check(remoteIP(writer.RemoteAddr())) {
+		case DNSRateLimitDrop:
+			writer.rateLimited = "drop"
+
+			return nil
+
+		case DNSRateLimitSlip:
+			writer.rateLimited = "slip"
+
+			truncated := new(dns.Msg)
+			truncated.SetReply(writer.request)
+			truncated.Truncated = true
+
+			return writer.ResponseWriter.WriteMsg(truncated)
+		}
+	}
+
+	return writer.ResponseWriter.WriteMsg(response)
+}
+
+// Mark the query as forwarded to the upstream resolver (for logging).
+func markDNSQueryForwarded(send dns.ResponseWriter) {
+	writer, ok := send.(*dnsResponseWriter)
+	if ok {
+		writer.forwarded = true
+	}
+}
+
+// Log the query (if query logging is enabled).
+func (writer *dnsResponseWriter) logQuery() {
+	queryLog := writer.service.dnsQueryLog
+	if queryLog == nil || !queryLog.ShouldLog() {
+		return
+	}
+
+	protocol := "tcp"
+	if isUDPRequest(writer) {
+		protocol = "udp"
+	}
+
+	entry := DNSQueryLogEntry{
+		Time:        writer.received.UTC().Format(time.RFC3339Nano),
+		Protocol:    protocol,
+		View:        writer.view.Name,
+		QueryID:     writer.request.Id,
+		LatencyMS:   float64(time.Since(writer.received)) / float64(time.Millisecond),
+		Forwarded:   writer.forwarded,
+		RateLimited: writer.rateLimited,
+	}
+	if clientIP := remoteIP(writer.RemoteAddr()); clientIP != nil {
+		entry.Client = clientIP.String()
+	}
+	if len(writer.request.Question) > 0 {
+		question := writer.request.Question[0]
+		entry.QName = question.Name
+		entry.QType = dns.TypeToString[question.Qtype]
+	}
+	if writer.response != nil {
+		entry.RCode = dns.RcodeToString[writer.response.Rcode]
+	}
+
+	queryLog.Write(entry)
+}
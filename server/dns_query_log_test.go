@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Read the entries in a DNS query log file.
+func readDNSQueryLog(t *testing.T, queryLogFile string) []DNSQueryLogEntry {
+	t.Helper()
+
+	file, err := os.Open(queryLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []DNSQueryLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry DNSQueryLogEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("invalid query log line '%s': %s", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return entries
+}
+
+func TestDNSQueryLog(t *testing.T) {
+	queryLogFile := filepath.Join(t.TempDir(), "queries.log")
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"dns.query_log.enable": true,
+		"dns.query_log.file":   queryLogFile,
+	})
+
+	request := new(dns.Msg)
+	request.SetQuestion("web1.lab.mcp.", dns.TypeA)
+	writer := &testDNSResponseWriter{
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.70.50"), Port: 5353},
+	}
+	started := time.Now()
+	service.ServeDNS(writer, request)
+
+	queryDNS(t, service, "missing.lab.mcp", dns.TypeAAAA)
+
+	entries := readDNSQueryLog(t, queryLogFile)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 query log entries, got %d", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Client != "192.168.70.50" || entry.Protocol != "udp" || entry.View != defaultDNSViewName {
+		t.Errorf("unexpected client, protocol, or view: %#v", entry)
+	}
+	if entry.QueryID != request.Id || entry.QName != "web1.lab.mcp." || entry.QType != "A" || entry.RCode != "NOERROR" {
+		t.Errorf("unexpected query or result: %#v", entry)
+	}
+	if entry.Forwarded || entry.RateLimited != "" || entry.LatencyMS < 0 {
+		t.Errorf("unexpected forwarding, rate-limiting, or latency: %#v", entry)
+	}
+	loggedTime, err := time.Parse(time.RFC3339Nano, entry.Time)
+	if err != nil {
+		t.Errorf("invalid time '%s': %s", entry.Time, err)
+	} else if loggedTime.Before(started.Add(-time.Second)) || loggedTime.After(time.Now()) {
+		t.Errorf("expected time to be when the query was received, got %s", entry.Time)
+	}
+
+	if entry := entries[1]; entry.QName != "missing.lab.mcp." || entry.QType != "AAAA" || entry.RCode != "NXDOMAIN" {
+		t.Errorf("unexpected query or result: %#v", entry)
+	}
+}
+
+func TestDNSQueryLogRateLimited(t *testing.T) {
+	queryLogFile := filepath.Join(t.TempDir(), "queries.log")
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"dns.query_log.enable":                true,
+		"dns.query_log.file":                  queryLogFile,
+		"dns.rate_limit.enable":               true,
+		"dns.rate_limit.responses_per_second": 1,
+		"dns.rate_limit.burst":                1,
+		"dns.rate_limit.slip":                 0,
+	})
+
+	writer := &testDNSResponseWriter{
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.70.50"), Port: 5353},
+	}
+	for index := 0; index < 2; index++ {
+		request := new(dns.Msg)
+		request.SetQuestion("web1.lab.mcp.", dns.TypeA)
+		service.ServeDNS(writer, request)
+	}
+	if len(writer.responses) != 1 {
+		t.Fatalf("expected 1 response (the second is rate-limited), got %d", len(writer.responses))
+	}
+
+	entries := readDNSQueryLog(t, queryLogFile)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 query log entries, got %d", len(entries))
+	}
+	if entries[0].RateLimited != "" {
+		t.Errorf("expected first query not to be rate-limited, got '%s'", entries[0].RateLimited)
+	}
+	if entries[1].RateLimited != "drop" || entries[1].RCode != "NOERROR" {
+		t.Errorf("expected second query to be logged as dropped (with the result it would have had), got %#v", entries[1])
+	}
+}
+
+func TestDNSQueryLogSampling(t *testing.T) {
+	queryLogFile := filepath.Join(t.TempDir(), "queries.log")
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"dns.query_log.enable":      true,
+		"dns.query_log.file":        queryLogFile,
+		"dns.query_log.sample_rate": 0.25,
+	})
+
+	rand.Seed(1)
+	for index := 0; index < 1000; index++ {
+		queryDNS(t, service, "web1.lab.mcp", dns.TypeA)
+	}
+
+	entries := readDNSQueryLog(t, queryLogFile)
+	if len(entries) < 150 || len(entries) > 350 {
+		t.Errorf("expected about 250 of 1000 queries to be logged, got %d", len(entries))
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// How often idle rate-limiting buckets are discarded.
+const dnsRateLimitSweepInterval = 1 * time.Minute
+
+// DNSRateLimitAction is the action to take for a rate-limited response.
+type DNSRateLimitAction int
+
+const (
+	// DNSRateLimitSend indicates that the response should be sent.
+	DNSRateLimitSend DNSRateLimitAction = iota
+
+	// DNSRateLimitDrop indicates that the response should be dropped.
+	DNSRateLimitDrop
+
+	// DNSRateLimitSlip indicates that a truncated (empty) response should be sent instead, so legitimate clients can retry using TCP.
+	DNSRateLimitSlip
+)
+
+// DNSRateLimiter limits the rate of UDP responses sent to each client network prefix (response-rate limiting, or RRL).
+type DNSRateLimiter struct {
+	// The maximum sustained number of responses per second for each client prefix.
+	ResponsesPerSecond float64
+
+	// The maximum number of responses that can be sent to a client prefix in a burst.
+	Burst float64
+
+	// The prefix length used to group IPv4 clients.
+	IPv4PrefixLength int
+
+	// The prefix length used to group IPv6 clients.
+	IPv6PrefixLength int
+
+	// Every Nth rate-limited response is replaced with a truncated response (0 means always drop).
+	Slip int
+
+	// Clients that are never rate-limited.
+	ExemptClients []*net.IPNet
+
+	bucketsByPrefix map[string]*dnsRateLimitBucket
+	lastSweep       time.Time
+	stateLock       *sync.Mutex
+}
+
+// A token bucket for a single client prefix.
+type dnsRateLimitBucket struct {
+	tokens      float64
+	lastUpdated time.Time
+	limited     int
+}
+
+// NewDNSRateLimiter creates a new DNSRateLimiter.
+func NewDNSRateLimiter(responsesPerSecond float64, burst float64, ipv4PrefixLength int, ipv6PrefixLength int, slip int, exemptClients []*net.IPNet) *DNSRateLimiter {
+	return &DNSRateLimiter{
+		ResponsesPerSecond: responsesPerSecond,
+		Burst:              burst,
+		IPv4PrefixLength:   ipv4PrefixLength,
+		IPv6PrefixLength:   ipv6PrefixLength,
+		Slip:               slip,
+		ExemptClients:      exemptClients,
+		bucketsByPrefix:    make(map[string]*dnsRateLimitBucket),
+		lastSweep:          time.Now(),
+		stateLock:          &sync.Mutex{},
+	}
+}
+
+// Check determines what to do with a response that is about to be sent to the specified client.
+func (limiter *DNSRateLimiter) Check(clientIP net.IP) DNSRateLimitAction {
+	if clientIP == nil || limiter.isExempt(clientIP) {
+		return DNSRateLimitSend
+	}
+
+	prefix := limiter.clientPrefix(clientIP)
+	now := time.Now()
+
+	limiter.stateLock.Lock()
+	defer limiter.stateLock.Unlock()
+
+	if now.Sub(limiter.lastSweep) >= dnsRateLimitSweepInterval {
+		limiter.sweep(now)
+	}
+
+	bucket, ok := limiter.bucketsByPrefix[prefix]
+	if !ok {
+		bucket = &dnsRateLimitBucket{
+			tokens:      limiter.Burst,
+			lastUpdated: now,
+		}
+		limiter.bucketsByPrefix[prefix] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.lastUpdated).Seconds() * limiter.ResponsesPerSecond
+	if bucket.tokens > limiter.Burst {
+		bucket.tokens = limiter.Burst
+	}
+	bucket.lastUpdated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.limited = 0
+
+		return DNSRateLimitSend
+	}
+
+	bucket.limited++
+	if limiter.Slip > 0 && bucket.limited%limiter.Slip == 0 {
+		return DNSRateLimitSlip
+	}
+
+	return DNSRateLimitDrop
+}
+
+// Determine whether the specified client is exempt from rate-limiting.
+func (limiter *DNSRateLimiter) isExempt(clientIP net.IP) bool {
+	for _, network := range limiter.ExemptClients {
+		if network.Contains(clientIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the network prefix used to group the specified client.
+func (limiter *DNSRateLimiter) clientPrefix(clientIP net.IP) string {
+	if clientIPv4 := clientIP.To4(); clientIPv4 != nil {
+		return clientIPv4.Mask(net.CIDRMask(limiter.IPv4PrefixLength, 8*net.IPv4len)).String()
+	}
+
+	return clientIP.Mask(net.CIDRMask(limiter.IPv6PrefixLength, 8*net.IPv6len)).String()
+}
+
+// Discard buckets that have been idle long enough to refill completely.
+//
+// The caller must hold the state lock.
+func (limiter *DNSRateLimiter) sweep(now time.Time) {
+	for prefix, bucket := range limiter.bucketsByPrefix {
+		idle := now.Sub(bucket.lastUpdated).Seconds()
+		if bucket.tokens+idle*limiter.ResponsesPerSecond >= limiter.Burst {
+			delete(limiter.bucketsByPrefix, prefix)
+		}
+	}
+
+	limiter.lastSweep = now
+}
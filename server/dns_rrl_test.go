@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Check the rate limiter repeatedly for the same client, returning the actions taken.
+func checkDNSRateLimit(limiter *DNSRateLimiter, clientIP string, count int) []DNSRateLimitAction {
+	var actions []DNSRateLimitAction
+	for index := 0; index < count; index++ {
+		actions = append(actions, limiter.Check(net.ParseIP(clientIP)))
+	}
+
+	return actions
+}
+
+func expectDNSRateLimitActions(t *testing.T, description string, actual []DNSRateLimitAction, expected ...DNSRateLimitAction) {
+	t.Helper()
+
+	if len(actual) != len(expected) {
+		t.Fatalf("%s: expected %d actions, got %d", description, len(expected), len(actual))
+	}
+	for index := range expected {
+		if actual[index] != expected[index] {
+			t.Errorf("%s: expected action %d to be %d, got %d (actions: %v)", description, index+1, expected[index], actual[index], actual)
+		}
+	}
+}
+
+func TestDNSRateLimiterSlip(t *testing.T) {
+	limiter := NewDNSRateLimiter(1, 2, 24, 56, 2, nil)
+
+	// Once the burst is exhausted, every second rate-limited response slips (is truncated) and the rest are dropped.
+	expectDNSRateLimitActions(t, "slip 2", checkDNSRateLimit(limiter, "192.168.70.50", 6),
+		DNSRateLimitSend, DNSRateLimitSend, DNSRateLimitDrop, DNSRateLimitSlip, DNSRateLimitDrop, DNSRateLimitSlip,
+	)
+
+	limiter = NewDNSRateLimiter(1, 2, 24, 56, 0, nil)
+	expectDNSRateLimitActions(t, "slip 0", checkDNSRateLimit(limiter, "192.168.70.50", 5),
+		DNSRateLimitSend, DNSRateLimitSend, DNSRateLimitDrop, DNSRateLimitDrop, DNSRateLimitDrop,
+	)
+}
+
+func TestDNSRateLimiterRefill(t *testing.T) {
+	limiter := NewDNSRateLimiter(1, 2, 24, 56, 2, nil)
+	expectDNSRateLimitActions(t, "initial burst", checkDNSRateLimit(limiter, "192.168.70.50", 3),
+		DNSRateLimitSend, DNSRateLimitSend, DNSRateLimitDrop,
+	)
+
+	// 1.5 seconds at 1 response per second refills one token; sending a response also resets the slip count.
+	bucket := limiter.bucketsByPrefix["192.168.70.0"]
+	if bucket == nil {
+		t.Fatalf("expected a bucket for prefix 192.168.70.0, got %v", limiter.bucketsByPrefix)
+	}
+	bucket.lastUpdated = bucket.lastUpdated.Add(-1500 * time.Millisecond)
+	expectDNSRateLimitActions(t, "after refill", checkDNSRateLimit(limiter, "192.168.70.50", 3),
+		DNSRateLimitSend, DNSRateLimitDrop, DNSRateLimitSlip,
+	)
+
+	// Tokens never exceed the burst, however long the bucket has been idle.
+	bucket.lastUpdated = bucket.lastUpdated.Add(-1 * time.Hour)
+	expectDNSRateLimitActions(t, "after idle", checkDNSRateLimit(limiter, "192.168.70.50", 3),
+		DNSRateLimitSend, DNSRateLimitSend, DNSRateLimitDrop,
+	)
+}
+
+func TestDNSRateLimiterSweep(t *testing.T) {
+	limiter := NewDNSRateLimiter(1, 2, 24, 56, 2, nil)
+	checkDNSRateLimit(limiter, "192.168.70.50", 3)
+	checkDNSRateLimit(limiter, "192.168.71.50", 3)
+
+	// The first bucket has been idle long enough to refill completely; the second has not.
+	limiter.bucketsByPrefix["192.168.70.0"].lastUpdated = time.Now().Add(-10 * time.Second)
+	limiter.lastSweep = time.Now().Add(-dnsRateLimitSweepInterval)
+
+	checkDNSRateLimit(limiter, "192.168.72.50", 1)
+
+	if _, ok := limiter.bucketsByPrefix["192.168.70.0"]; ok {
+		t.Errorf("expected idle bucket for prefix 192.168.70.0 to be discarded")
+	}
+	if _, ok := limiter.bucketsByPrefix["192.168.71.0"]; !ok {
+		t.Errorf("expected bucket for prefix 192.168.71.0 to be retained")
+	}
+	if _, ok := limiter.bucketsByPrefix["192.168.72.0"]; !ok {
+		t.Errorf("expected bucket for prefix 192.168.72.0 to be created")
+	}
+	if time.Since(limiter.lastSweep) >= dnsRateLimitSweepInterval {
+		t.Errorf("expected last sweep time to be updated, got %s", limiter.lastSweep)
+	}
+}
+
+func TestDNSRateLimiterExemptClients(t *testing.T) {
+	exemptClients, err := parseNetworks([]string{"192.168.70.0/24", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewDNSRateLimiter(1, 1, 24, 56, 0, exemptClients)
+
+	expectDNSRateLimitActions(t, "exempt network", checkDNSRateLimit(limiter, "192.168.70.50", 3),
+		DNSRateLimitSend, DNSRateLimitSend, DNSRateLimitSend,
+	)
+	expectDNSRateLimitActions(t, "exempt address", checkDNSRateLimit(limiter, "fd00::1", 3),
+		DNSRateLimitSend, DNSRateLimitSend, DNSRateLimitSend,
+	)
+	expectDNSRateLimitActions(t, "not exempt", checkDNSRateLimit(limiter, "fd00::2", 2),
+		DNSRateLimitSend, DNSRateLimitDrop,
+	)
+	if action := limiter.Check(nil); action != DNSRateLimitSend {
+		t.Errorf("expected response to unknown client to be sent, got %d", action)
+	}
+	if len(limiter.bucketsByPrefix) != 1 {
+		t.Errorf("expected buckets only for clients that are not exempt, got %v", limiter.bucketsByPrefix)
+	}
+}
+
+func TestDNSRateLimiterPrefixes(t *testing.T) {
+	limiter := NewDNSRateLimiter(1, 2, 24, 56, 0, nil)
+
+	// Clients in the same prefix share a bucket.
+	expectDNSRateLimitActions(t, "IPv4 client 1", checkDNSRateLimit(limiter, "192.168.70.50", 1), DNSRateLimitSend)
+	expectDNSRateLimitActions(t, "IPv4 client 2", checkDNSRateLimit(limiter, "192.168.70.51", 1), DNSRateLimitSend)
+	expectDNSRateLimitActions(t, "IPv4 client 3", checkDNSRateLimit(limiter, "192.168.70.52", 1), DNSRateLimitDrop)
+	expectDNSRateLimitActions(t, "IPv4 other prefix", checkDNSRateLimit(limiter, "192.168.71.50", 1), DNSRateLimitSend)
+
+	expectDNSRateLimitActions(t, "IPv6 client 1", checkDNSRateLimit(limiter, "2001:db8:0:1::1", 1), DNSRateLimitSend)
+	expectDNSRateLimitActions(t, "IPv6 client 2", checkDNSRateLimit(limiter, "2001:db8:0:ff:ffff::1", 1), DNSRateLimitSend)
+	expectDNSRateLimitActions(t, "IPv6 client 3", checkDNSRateLimit(limiter, "2001:db8:0:2::1", 1), DNSRateLimitDrop)
+	expectDNSRateLimitActions(t, "IPv6 other prefix", checkDNSRateLimit(limiter, "2001:db8:0:100::1", 1), DNSRateLimitSend)
+
+	for _, prefix := range []string{"192.168.70.0", "192.168.71.0", "2001:db8:0:100::", "2001:db8::"} {
+		if _, ok := limiter.bucketsByPrefix[prefix]; !ok {
+			t.Errorf("expected a bucket for prefix %s, got %v", prefix, limiter.bucketsByPrefix)
+		}
+	}
+}
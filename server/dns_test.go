@@ -0,0 +1,400 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+	"github.com/DimensionDataResearch/mcp2-dhcp-server/server/cloudcontroltest"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+)
+
+// testDNSResponseWriter captures the response to a DNS query.
+type testDNSResponseWriter struct {
+	remoteAddr net.Addr
+	responses  []*dns.Msg
+}
+
+func (writer *testDNSResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("192.168.70.2"), Port: 53}
+}
+func (writer *testDNSResponseWriter) RemoteAddr() net.Addr {
+	return writer.remoteAddr
+}
+func (writer *testDNSResponseWriter) WriteMsg(response *dns.Msg) error {
+	writer.responses = append(writer.responses, response)
+
+	return nil
+}
+func (writer *testDNSResponseWriter) Write(data []byte) (int, error) {
+	response := new(dns.Msg)
+	err := response.Unpack(data)
+	if err != nil {
+		return 0, err
+	}
+	writer.responses = append(writer.responses, response)
+
+	return len(data), nil
+}
+func (writer *testDNSResponseWriter) Close() error        { return nil }
+func (writer *testDNSResponseWriter) TsigStatus() error   { return nil }
+func (writer *testDNSResponseWriter) TsigTimersOnly(bool) {}
+func (writer *testDNSResponseWriter) Hijack()             {}
+
+// Send a DNS query to the service, returning its response.
+func queryDNS(t *testing.T, service *Service, name string, qtype uint16) *dns.Msg {
+	request := new(dns.Msg)
+	request.SetQuestion(dns.Fqdn(name), qtype)
+
+	writer := &testDNSResponseWriter{
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.70.50"), Port: 5353},
+	}
+	service.ServeDNS(writer, request)
+
+	if len(writer.responses) != 1 {
+		t.Fatalf("%s %s: expected exactly 1 response, got %d", name, dns.TypeToString[qtype], len(writer.responses))
+	}
+
+	return writer.responses[0]
+}
+
+// Get the answers in a DNS response (excluding TTLs), in a predictable order.
+func dnsAnswers(response *dns.Msg) []string {
+	var answers []string
+	for _, record := range response.Answer {
+		header := record.Header()
+		answers = append(answers, header.Name+" "+dns.TypeToString[header.Rrtype]+" "+strings.TrimPrefix(record.String(), header.String()))
+	}
+	sort.Strings(answers)
+
+	return answers
+}
+
+func TestDNSQueries(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	testCases := []struct {
+		name            string
+		qtype           uint16
+		expectedRcode   int
+		expectedAnswers []string
+	}{
+		{"web1.lab.mcp", dns.TypeA, dns.RcodeSuccess, []string{"web1.lab.mcp. A 192.168.70.10"}},
+		{"web1-nic1.lab.mcp", dns.TypeA, dns.RcodeSuccess, []string{"web1-nic1.lab.mcp. A 192.168.71.10"}},
+		{"web1.lab.mcp", dns.TypeTXT, dns.RcodeSuccess, []string{"web1.lab.mcp. TXT \"role=web\""}},
+		{"www.lab.mcp", dns.TypeA, dns.RcodeSuccess, []string{"web1.lab.mcp. A 192.168.70.10", "www.lab.mcp. CNAME web1.lab.mcp."}},
+		{"database.lab.mcp", dns.TypeAAAA, dns.RcodeSuccess, []string{"database.lab.mcp. AAAA fd00::20"}},
+		{"_postgresql._tcp.lab.mcp", dns.TypeSRV, dns.RcodeSuccess, []string{"_postgresql._tcp.lab.mcp. SRV 0 0 5432 database.lab.mcp."}},
+		{"10.70.168.192.in-addr.arpa", dns.TypePTR, dns.RcodeSuccess, []string{"10.70.168.192.in-addr.arpa. PTR web1.lab.mcp."}},
+		{"10.71.168.192.in-addr.arpa", dns.TypePTR, dns.RcodeSuccess, []string{"10.71.168.192.in-addr.arpa. PTR web1-nic1.lab.mcp."}},
+		{"db1.lab.mcp", dns.TypeA, dns.RcodeNameError, nil},
+		{"deploying.lab.mcp", dns.TypeA, dns.RcodeNameError, nil},
+		{"web1.lab.mcp", dns.TypeMX, dns.RcodeSuccess, nil},
+
+		// Names are matched case-insensitively (e.g. for resolvers that randomise query case).
+		{"WeB1.LaB.mCp", dns.TypeA, dns.RcodeSuccess, []string{"web1.lab.mcp. A 192.168.70.10"}},
+		{"WWW.lab.mcp", dns.TypeA, dns.RcodeSuccess, []string{"web1.lab.mcp. A 192.168.70.10", "www.lab.mcp. CNAME web1.lab.mcp."}},
+		{"_PostgreSQL._TCP.lab.mcp", dns.TypeSRV, dns.RcodeSuccess, []string{"_postgresql._tcp.lab.mcp. SRV 0 0 5432 database.lab.mcp."}},
+		{"Web1.Lab.Mcp", dns.TypeMX, dns.RcodeSuccess, nil},
+		{"DB1.lab.mcp", dns.TypeA, dns.RcodeNameError, nil},
+	}
+	for _, testCase := range testCases {
+		response := queryDNS(t, service, testCase.name, testCase.qtype)
+		if response.Rcode != testCase.expectedRcode {
+			t.Errorf("%s %s: expected %s, got %s",
+				testCase.name,
+				dns.TypeToString[testCase.qtype],
+				dns.RcodeToString[testCase.expectedRcode],
+				dns.RcodeToString[response.Rcode],
+			)
+
+			continue
+		}
+		if !response.Authoritative {
+			t.Errorf("%s %s: expected an authoritative answer", testCase.name, dns.TypeToString[testCase.qtype])
+		}
+
+		answers := dnsAnswers(response)
+		if strings.Join(answers, "\n") != strings.Join(testCase.expectedAnswers, "\n") {
+			t.Errorf("%s %s: expected answers %q, got %q", testCase.name, dns.TypeToString[testCase.qtype], testCase.expectedAnswers, answers)
+		}
+	}
+}
+
+func TestDNSNegativeResponseHasSOA(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"dns.negative_ttl": 30,
+	})
+
+	response := queryDNS(t, service, "missing.lab.mcp", dns.TypeA)
+	if response.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN, got %s", dns.RcodeToString[response.Rcode])
+	}
+	if len(response.Ns) != 1 {
+		t.Fatalf("expected SOA in authority section, got %v", response.Ns)
+	}
+	soa, ok := response.Ns[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("expected SOA in authority section, got %s", response.Ns[0])
+	}
+	if soa.Minttl != 30 || soa.Hdr.Ttl > 30 {
+		t.Fatalf("expected negative TTL of 30, got %s", soa)
+	}
+}
+
+func TestDNSViewsDuringRefresh(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"dns.views": []interface{}{
+			map[interface{}]interface{}{
+				"name":          "lab",
+				"match_clients": []interface{}{"192.168.70.0/24"},
+			},
+		},
+	})
+
+	// Queries are answered from a consistent view of the zone while it is being republished.
+	refreshed := make(chan error)
+	go func() {
+		var err error
+		for iteration := 0; iteration < 20 && err == nil; iteration++ {
+			err = service.RefreshServerMetadata()
+		}
+		refreshed <- err
+	}()
+
+	for iteration := 0; iteration < 100; iteration++ {
+		response := queryDNS(t, service, "web1.lab.mcp", dns.TypeA)
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+			t.Fatalf("expected 1 answer for 'web1', got %s %v", dns.RcodeToString[response.Rcode], response.Answer)
+		}
+	}
+
+	err := <-refreshed
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDNSOverridesReload(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	configFile := filepath.Join(t.TempDir(), "mcp2-dhcp-server.yml")
+	err := ioutil.WriteFile(configFile, []byte(`
+dns:
+  overrides:
+    rules:
+      - name: registry.example.com
+        addresses:
+          - 192.168.70.20
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(configFile)
+	err = service.ReloadDNSOverrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overrides are reloaded (e.g. on SIGHUP) while queries are being answered.
+	reloaded := make(chan error)
+	go func() {
+		var err error
+		for iteration := 0; iteration < 20 && err == nil; iteration++ {
+			err = service.ReloadDNSOverrides()
+		}
+		reloaded <- err
+	}()
+
+	for iteration := 0; iteration < 100; iteration++ {
+		response := queryDNS(t, service, "registry.example.com", dns.TypeA)
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+			t.Fatalf("unexpected response for 'registry.example.com': %s %v", dns.RcodeToString[response.Rcode], response.Answer)
+		}
+	}
+
+	err = <-reloaded
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := queryDNS(t, service, "registry.example.com", dns.TypeA)
+	if answers := dnsAnswers(response); len(answers) != 1 || answers[0] != "registry.example.com. A 192.168.70.20" {
+		t.Fatalf("expected override for 'registry.example.com', got %q", answers)
+	}
+}
+
+func TestDNSWildcardsAndEmptyNonTerminals(t *testing.T) {
+	data := NewDNSData(60)
+	data.Add("*.apps.lab.mcp", net.ParseIP("192.168.70.30"))
+	data.Add("a.b.apps.lab.mcp", net.ParseIP("192.168.70.31"))
+
+	testCases := []struct {
+		name             string
+		expectedExists   bool
+		expectedWildcard string
+	}{
+		{"c.apps.lab.mcp", false, "*.apps.lab.mcp."},
+		{"a.b.apps.lab.mcp", true, ""},
+		{"b.apps.lab.mcp", true, ""},    // Empty non-terminal.
+		{"c.b.apps.lab.mcp", false, ""}, // Closest encloser (b.apps) has no wildcard (RFC 4592, section 2.2.2).
+		{"C.B.Apps.lab.mcp", false, ""},
+	}
+	checkNames := func(data DNSData) {
+		for _, testCase := range testCases {
+			if exists := data.NameExists(testCase.name); exists != testCase.expectedExists {
+				t.Errorf("%s: expected exists = %t, got %t", testCase.name, testCase.expectedExists, exists)
+			}
+			if wildcard := data.FindWildcard(testCase.name); wildcard != testCase.expectedWildcard {
+				t.Errorf("%s: expected wildcard %q, got %q", testCase.name, testCase.expectedWildcard, wildcard)
+			}
+		}
+	}
+	checkNames(data)
+	checkNames(data.Clone())
+
+	// Once its only descendant is removed, the empty non-terminal no longer exists (so the wildcard applies below it).
+	data.Remove("a.b.apps.lab.mcp")
+	if data.NameExists("b.apps.lab.mcp") {
+		t.Errorf("expected 'b.apps.lab.mcp' to no longer exist")
+	}
+	if wildcard := data.FindWildcard("c.b.apps.lab.mcp"); wildcard != "*.apps.lab.mcp." {
+		t.Errorf("expected wildcard '*.apps.lab.mcp.' for 'c.b.apps.lab.mcp', got %q", wildcard)
+	}
+}
+
+func TestDNSSetTTL(t *testing.T) {
+	data := NewDNSData(60)
+	data.ReverseTTL = 30
+	data.Add("web1.lab.mcp", net.ParseIP("192.168.70.10"))
+
+	data.SetTTL("web1.lab.mcp", 300)
+
+	if records := data.FindA("web1.lab.mcp"); len(records) != 1 || records[0].Hdr.Ttl != 300 {
+		t.Errorf("expected A record with TTL 300, got %v", records)
+	}
+	// Reverse-lookup records keep the reverse TTL.
+	if record := data.FindPTR("10.70.168.192.in-addr.arpa"); record == nil || record.Hdr.Ttl != 30 {
+		t.Errorf("expected PTR record with TTL 30, got %v", record)
+	}
+}
+
+func TestDNSTTLNotAppliedToConflictingAlias(t *testing.T) {
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	// db1 claims an alias that is already web1's name (and has its own TTL).
+	fixture, err := cloudcontroltest.LoadFixture("testdata/cloudcontrol/basic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range [][2]string{{"dns_aliases", "web1"}, {"dns_ttl", "300"}} {
+		fixture.Tags = append(fixture.Tags, compute.TagDetail{
+			AssetType:    compute.AssetTypeServer,
+			AssetID:      "server-db1",
+			AssetName:    "db1",
+			DatacenterID: "AU9",
+			Name:         tag[0],
+			Value:        tag[1],
+		})
+	}
+	client.SetFixture(fixture)
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := queryDNS(t, service, "web1.lab.mcp", dns.TypeA)
+	if len(response.Answer) != 1 || response.Answer[0].Header().Ttl != 60 {
+		t.Fatalf("expected web1's A record to keep the default TTL, got %v", response.Answer)
+	}
+	response = queryDNS(t, service, "database.lab.mcp", dns.TypeA)
+	if len(response.Answer) != 1 || response.Answer[0].Header().Ttl != 300 {
+		t.Fatalf("expected db1's A record to have TTL 300, got %v", response.Answer)
+	}
+}
+
+func TestDNSTransferTSIGKeyNameIsCaseInsensitive(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"dns.tsig.key_name": "Transfer-Key.Lab.MCP",
+		"dns.tsig.secret":   "c2VjcmV0",
+	})
+
+	writer := &testDNSResponseWriter{
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.70.50"), Port: 5353},
+	}
+	for _, keyName := range []string{"transfer-key.lab.mcp.", "TRANSFER-KEY.LAB.MCP."} {
+		request := new(dns.Msg)
+		request.SetAxfr("lab.mcp.")
+		request.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+		if !service.isDNSTransferAllowed(writer, request) {
+			t.Errorf("expected zone transfer signed with key '%s' to be allowed", keyName)
+		}
+	}
+
+	request := new(dns.Msg)
+	request.SetAxfr("lab.mcp.")
+	request.SetTsig("other-key.lab.mcp.", dns.HmacSHA256, 300, time.Now().Unix())
+	if service.isDNSTransferAllowed(writer, request) {
+		t.Errorf("expected zone transfer signed with another key to be refused")
+	}
+}
+
+func TestDNSRefusedResponseIsSigned(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"dns.tsig.key_name": "transfer-key.lab.mcp",
+		"dns.tsig.secret":   "c2VjcmV0",
+	})
+
+	// Zone transfers are not enabled, so the request is refused (but the refusal must still be signed with the request's key).
+	request := new(dns.Msg)
+	request.SetAxfr("lab.mcp.")
+	request.SetTsig("transfer-key.lab.mcp.", dns.HmacSHA256, 300, time.Now().Unix())
+
+	writer := &testDNSResponseWriter{
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.70.50"), Port: 5353},
+	}
+	service.ServeDNS(writer, request)
+
+	if len(writer.responses) != 1 {
+		t.Fatalf("expected exactly 1 response, got %d", len(writer.responses))
+	}
+	response := writer.responses[0]
+	if response.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED, got %s", dns.RcodeToString[response.Rcode])
+	}
+	if responseTSIG := response.IsTsig(); responseTSIG == nil || responseTSIG.Hdr.Name != "transfer-key.lab.mcp." {
+		t.Errorf("expected response to be signed with key 'transfer-key.lab.mcp.', got %v", responseTSIG)
+	}
+}
+
+func TestDNSDataUsePublicAddresses(t *testing.T) {
+	data := NewDNSData(60)
+	data.Add("web1.lab.mcp", net.ParseIP("192.168.70.20"))
+	data.Add("web1.lab.mcp", net.ParseIP("fd00::20"))
+	data.Add("web1.public.lab.mcp", net.ParseIP("203.0.113.20"))
+	data.Add("db1.lab.mcp", net.ParseIP("192.168.70.30"))
+	data.Add("db1.lab.mcp", net.ParseIP("fd00::30"))
+
+	data.UsePublicAddresses("lab.mcp", "public.lab.mcp")
+
+	if records := data.FindA("web1.lab.mcp."); len(records) != 1 || records[0].A.String() != "203.0.113.20" {
+		t.Errorf("expected public A record for web1, got %v", records)
+	}
+	if records := data.FindAAAA("web1.lab.mcp."); len(records) != 0 {
+		t.Errorf("expected no (private) AAAA records for web1, got %v", records)
+	}
+
+	// Names without public addresses are unchanged.
+	if records := data.FindA("db1.lab.mcp."); len(records) != 1 || records[0].A.String() != "192.168.70.30" {
+		t.Errorf("expected private A record for db1, got %v", records)
+	}
+	if records := data.FindAAAA("db1.lab.mcp."); len(records) != 1 || records[0].AAAA.String() != "fd00::30" {
+		t.Errorf("expected private AAAA record for db1, got %v", records)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The maximum number of changes retained in the zone journal (for IXFR).
+const dnsJournalMaxEntries = 100
+
+// The maximum number of records sent in each message of a zone transfer.
+const dnsTransferRecordsPerMessage = 100
+
+// The TSIG fudge factor (in seconds) for signed messages.
+const dnsTSIGFudge = 300
+
+// DNSZoneChange represents the changes to the pseudo-zone between one serial number and the next.
+type DNSZoneChange struct {
+	// The zone serial number before the change.
+	FromSerial uint32
+
+	// The zone serial number after the change.
+	ToSerial uint32
+
+	// Records removed from the zone.
+	Removed []dns.RR
+
+	// Records added to the zone.
+	Added []dns.RR
+}
+
+// DNSZoneJournal tracks recent changes to the pseudo-zone (used to answer IXFR requests).
+type DNSZoneJournal struct {
+	changes []DNSZoneChange
+}
+
+// NewDNSZoneJournal creates a new DNSZoneJournal.
+func NewDNSZoneJournal() *DNSZoneJournal {
+	return &DNSZoneJournal{}
+}
+
+// Record a change to the zone.
+func (journal *DNSZoneJournal) Record(change DNSZoneChange) {
+	journal.changes = append(journal.changes, change)
+	if len(journal.changes) > dnsJournalMaxEntries {
+		journal.changes = journal.changes[len(journal.changes)-dnsJournalMaxEntries:]
+	}
+}
+
+// ChangesSince retrieves the changes made since the specified serial number.
+//
+// If the journal does not go back far enough, ok is false.
+func (journal *DNSZoneJournal) ChangesSince(serial uint32) (changes []DNSZoneChange, ok bool) {
+	for index, change := range journal.changes {
+		if change.FromSerial == serial {
+			return append([]DNSZoneChange(nil), journal.changes[index:]...), true
+		}
+	}
+
+	return nil, false
+}
+
+// Compute the changes between two sets of zone records (as returned by DNSData.ZoneRecords).
+func diffZoneRecords(oldRecords []dns.RR, newRecords []dns.RR) (removed []dns.RR, added []dns.RR) {
+	oldRecordsByKey := make(map[string]dns.RR)
+	for _, record := range oldRecords {
+		oldRecordsByKey[record.String()] = record
+	}
+	newRecordsByKey := make(map[string]dns.RR)
+	for _, record := range newRecords {
+		newRecordsByKey[record.String()] = record
+	}
+
+	for _, record := range oldRecords {
+		if _, ok := newRecordsByKey[record.String()]; !ok {
+			removed = append(removed, record)
+		}
+	}
+	for _, record := range newRecords {
+		if _, ok := oldRecordsByKey[record.String()]; !ok {
+			added = append(added, record)
+		}
+	}
+
+	return
+}
+
+// Determine the next zone serial number.
+//
+// Serial numbers are based on the current time so that they keep increasing across restarts.
+func nextZoneSerial(currentSerial uint32) uint32 {
+	nextSerial := uint32(time.Now().Unix())
+	if nextSerial <= currentSerial {
+		nextSerial = currentSerial + 1
+	}
+
+	return nextSerial
+}
+
+// Update the zone serial number of new DNS data (and record any changes in the journal).
+//
+// Returns true if the zone has changed.
+//
+// The caller must hold the state lock.
+func (service *Service) updateZoneSerial(dnsData *DNSData) bool {
+	previousData := service.DNSData
+
+	removed, added := diffZoneRecords(previousData.ZoneRecords(), dnsData.ZoneRecords())
+	if previousData.Serial != 0 && len(removed) == 0 && len(added) == 0 {
+		dnsData.Serial = previousData.Serial
+
+		return false
+	}
+
+	dnsData.Serial = nextZoneSerial(previousData.Serial)
+	if previousData.Serial != 0 {
+		service.dnsJournal.Record(DNSZoneChange{
+			FromSerial: previousData.Serial,
+			ToSerial:   dnsData.Serial,
+			Removed:    removed,
+			Added:      added,
+		})
+	}
+
+	log.Printf("DNS zone '%s' updated (serial %d, %d records removed, %d records added).",
+		service.DNSDomainName,
+		dnsData.Serial,
+		len(removed),
+		len(added),
+	)
+
+	return true
+}
+
+// The name of the pseudo-zone's name server.
+func (service *Service) dnsNameServerName() string {
+	return "ns." + service.DNSDomainName
+}
+
+// Create the SOA record for the pseudo-zone.
+func (service *Service) dnsZoneSOA(data *DNSData) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   service.DNSDomainName,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    data.DefaultTTL,
+		},
+		Ns:      service.dnsNameServerName(),
+		Mbox:    "hostmaster." + service.DNSDomainName,
+		Serial:  data.Serial,
+		Refresh: 60,
+		Retry:   30,
+		Expire:  86400,
+		Minttl:  data.NegativeTTL,
+	}
+}
+
+// Create the records at the apex of the pseudo-zone (NS and name server address).
+func (service *Service) dnsZoneApexRecords(data *DNSData) []dns.RR {
+	nameServer := service.dnsNameServerName()
+
+	records := []dns.RR{
+		&dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   service.DNSDomainName,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    data.DefaultTTL,
+			},
+			Ns: nameServer,
+		},
+	}
+
+	listenAddress := service.listeners.listenIPv4Address
+	if listenAddress != nil {
+		records = append(records, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   nameServer,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    data.DefaultTTL,
+			},
+			A: *listenAddress,
+		})
+	}
+
+	return records
+}
+
+// Handle an AXFR or IXFR request.
+func (service *Service) dnsTransfer(send dns.ResponseWriter, request *dns.Msg) {
+	question := request.Question[0]
+
+	if !service.EnableDNSTransfer || !service.isDNSZoneApex(question.Name) {
+		service.dnsSendRefused(send, request)
+
+		return
+	}
+
+	if !service.isDNSTransferAllowed(send, request) {
+		log.Printf("Refused zone transfer (%s) of '%s' to %s.",
+			dns.TypeToString[question.Qtype],
+			question.Name,
+			send.RemoteAddr(),
+		)
+
+		service.dnsSendRefused(send, request)
+
+		return
+	}
+
+	// Take a consistent snapshot of the zone (and its journal).
+	service.acquireStateLock("dnsTransfer")
+	data := service.DNSData
+	view := service.defaultDNSView()
+	var changes []DNSZoneChange
+	canSendChanges := false
+	if question.Qtype == dns.TypeIXFR && len(request.Ns) > 0 {
+		if clientSOA, ok := request.Ns[0].(*dns.SOA); ok {
+			changes, canSendChanges = service.dnsJournal.ChangesSince(clientSOA.Serial)
+			if clientSOA.Serial == data.Serial {
+				canSendChanges = true // Client is up-to-date.
+			}
+		}
+	}
+	service.releaseStateLock("dnsTransfer")
+
+	soa := service.dnsZoneSOA(&data)
+
+	if isUDPRequest(send) {
+		// Zone transfers require TCP; for IXFR, a single SOA record tells the client to retry using TCP (RFC 1995).
+		if question.Qtype == dns.TypeIXFR {
+			service.dnsSendResourceRecord(soa, view, send, request)
+		} else {
+			service.dnsSendRefused(send, request)
+		}
+
+		return
+	}
+
+	var records []dns.RR
+	if canSendChanges && len(changes) == 0 {
+		// Client is up-to-date; a single SOA record tells it so (RFC 1995).
+		records = append(records, soa)
+	} else if canSendChanges {
+		// Incremental transfer (RFC 1995): SOA, [old SOA, removed records, new SOA, added records]..., SOA
+		records = append(records, soa)
+		for _, change := range changes {
+			fromSOA := *soa
+			fromSOA.Serial = change.FromSerial
+			toSOA := *soa
+			toSOA.Serial = change.ToSerial
+
+			records = append(records, &fromSOA)
+			records = append(records, change.Removed...)
+			records = append(records, &toSOA)
+			records = append(records, change.Added...)
+		}
+		records = append(records, soa)
+	} else {
+		// Full transfer: SOA, records..., SOA
+		records = append(records, soa)
+		records = append(records, service.dnsZoneApexRecords(&data)...)
+		records = append(records, data.ZoneRecords()...)
+		records = append(records, soa)
+	}
+
+	log.Printf("Sending zone transfer (%s, serial %d, %d records) of '%s' to %s.",
+		dns.TypeToString[question.Qtype],
+		data.Serial,
+		len(records),
+		question.Name,
+		send.RemoteAddr(),
+	)
+
+	for messageStart := 0; messageStart < len(records); messageStart += dnsTransferRecordsPerMessage {
+		messageEnd := messageStart + dnsTransferRecordsPerMessage
+		if messageEnd > len(records) {
+			messageEnd = len(records)
+		}
+
+		response := new(dns.Msg)
+		response.SetReply(request)
+		response.Authoritative = true
+		response.Answer = records[messageStart:messageEnd]
+		signDNSResponse(response, request)
+
+		err := send.WriteMsg(response)
+		if err != nil {
+			log.Printf("Unable to send zone transfer of '%s' to %s: %s",
+				question.Name,
+				send.RemoteAddr(),
+				err.Error(),
+			)
+
+			return
+		}
+
+		// Only the first message needs a full TSIG (RFC 2845, section 4.4).
+		send.TsigTimersOnly(true)
+	}
+}
+
+// Determine whether the sender of a zone transfer request is permitted to receive the zone.
+func (service *Service) isDNSTransferAllowed(send dns.ResponseWriter, request *dns.Msg) bool {
+	if len(service.DNSTransferAllowFrom) > 0 {
+		sourceIP := remoteIP(send.RemoteAddr())
+		if sourceIP == nil {
+			return false
+		}
+
+		allowed := false
+		for _, allowedNetwork := range service.DNSTransferAllowFrom {
+			if allowedNetwork.Contains(sourceIP) {
+				allowed = true
+
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	if service.DNSTSIGKeyName != "" {
+		requestTSIG := request.IsTsig()
+		if requestTSIG == nil || !service.isDNSTSIGKeyName(requestTSIG.Hdr.Name) {
+			return false
+		}
+
+		return send.TsigStatus() == nil
+	}
+
+	return true
+}
+
+// Notify secondary name servers that the pseudo-zone has changed.
+func (service *Service) dnsNotifySecondaries(data DNSData) {
+	for _, secondary := range service.DNSTransferNotify {
+		go service.dnsNotify(secondary, data)
+	}
+}
+
+// Send a NOTIFY message (RFC 1996) to a secondary name server.
+func (service *Service) dnsNotify(secondary string, data DNSData) {
+	notify := new(dns.Msg)
+	notify.SetNotify(service.DNSDomainName)
+	notify.Answer = []dns.RR{
+		service.dnsZoneSOA(&data),
+	}
+
+	client := &dns.Client{
+		Net:     "udp",
+		Timeout: dnsForwardingTimeout,
+	}
+	if service.DNSTSIGKeyName != "" {
+		client.TsigSecret = service.dnsTSIGSecrets()
+		notify.SetTsig(service.DNSTSIGKeyName, service.DNSTSIGAlgorithm, dnsTSIGFudge, time.Now().Unix())
+	}
+
+	response, _, err := client.Exchange(notify, secondary)
+	if err != nil {
+		log.Printf("Unable to notify secondary name server '%s' of change to zone '%s' (serial %d): %s",
+			secondary,
+			service.DNSDomainName,
+			data.Serial,
+			err.Error(),
+		)
+
+		return
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		log.Printf("Secondary name server '%s' rejected notification of change to zone '%s' (serial %d): %s",
+			secondary,
+			service.DNSDomainName,
+			data.Serial,
+			dns.RcodeToString[response.Rcode],
+		)
+
+		return
+	}
+
+	if service.EnableDebugLogging {
+		log.Printf("Notified secondary name server '%s' of change to zone '%s' (serial %d).",
+			secondary,
+			service.DNSDomainName,
+			data.Serial,
+		)
+	}
+}
+
+// Get the TSIG secrets (if any) used by DNS servers and clients.
+func (service *Service) dnsTSIGSecrets() map[string]string {
+	if service.DNSTSIGKeyName == "" {
+		return nil
+	}
+
+	return map[string]string{
+		service.DNSTSIGKeyName: service.DNSTSIGSecret,
+	}
+}
+
+// Determine whether the specified name is the name of the configured TSIG key (key names, like other domain names, are case-insensitive).
+func (service *Service) isDNSTSIGKeyName(name string) bool {
+	return service.DNSTSIGKeyName != "" && strings.EqualFold(dns.Fqdn(name), service.DNSTSIGKeyName)
+}
+
+// Sign a response with the same TSIG key as the request (if the request was signed).
+func signDNSResponse(response *dns.Msg, request *dns.Msg) {
+	requestTSIG := request.IsTsig()
+	if requestTSIG != nil {
+		response.SetTsig(requestTSIG.Hdr.Name, requestTSIG.Algorithm, dnsTSIGFudge, time.Now().Unix())
+	}
+}
+
+// Parse a list of IP addresses and / or CIDRs.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("'%s' is not a valid IP address or CIDR", value)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			network = &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			}
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Get the IP address of a remote network address.
+func remoteIP(address net.Addr) net.IP {
+	switch remoteAddress := address.(type) {
+	case *net.UDPAddr:
+		return remoteAddress.IP
+	case *net.TCPAddr:
+		return remoteAddress.IP
+	default:
+		return nil
+	}
+}
+
+// Determine whether a DNS request was received via UDP.
+func isUDPRequest(send dns.ResponseWriter) bool {
+	_, isUDP := send.RemoteAddr().(*net.UDPAddr)
+
+	return isUDP
+}
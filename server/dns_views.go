@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// The name of the view used for clients that do not match any configured view.
+const defaultDNSViewName = "default"
+
+// DNSView is a view of the pseudo-zone (and forwarding policy) presented to a specific set of clients.
+type DNSView struct {
+	// The view name (for logging).
+	Name string
+
+	// The client addresses / networks that use this view.
+	MatchClients []*net.IPNet
+
+	// Should server names resolve to their public (NAT) addresses, where available?
+	UsePublicAddresses bool
+
+	// Should queries that cannot be answered locally be forwarded (if not, they are refused)?
+	EnableForwarding bool
+
+	// The DNS data for this view.
+	DNSData DNSData
+
+	forwarder DNSForwarder
+}
+
+// Matches determines whether the view applies to the specified client address.
+func (view *DNSView) Matches(clientIP net.IP) bool {
+	if clientIP == nil {
+		return false
+	}
+
+	for _, network := range view.MatchClients {
+		if network.Contains(clientIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the view used for clients that do not match any configured view.
+//
+// The caller must hold the state lock or the DNS view lock.
+func (service *Service) defaultDNSView() *DNSView {
+	return &DNSView{
+		Name:             defaultDNSViewName,
+		EnableForwarding: true,
+		DNSData:          service.DNSData,
+		forwarder:        service.dnsForwarder,
+	}
+}
+
+// Select the view for the client that sent a DNS request (the first matching view is used).
+//
+// Returns a copy of the view, so its DNS data does not change while the request is being handled.
+func (service *Service) selectDNSView(send dns.ResponseWriter) *DNSView {
+	service.dnsViewLock.RLock()
+	defer service.dnsViewLock.RUnlock()
+
+	clientIP := remoteIP(send.RemoteAddr())
+	for _, view := range service.DNSViews {
+		if view.Matches(clientIP) {
+			selectedView := *view
+
+			return &selectedView
+		}
+	}
+
+	return service.defaultDNSView()
+}
+
+// Publish DNS data to the default view and each configured view.
+//
+// The caller must hold the state lock.
+func (service *Service) publishDNSViews(data *DNSData) {
+	viewData := make([]DNSData, len(service.DNSViews))
+	for index, view := range service.DNSViews {
+		viewData[index] = data.Clone()
+		if view.UsePublicAddresses {
+			viewData[index].UsePublicAddresses(service.DNSDomainName, service.PublicDNSDomain)
+		}
+		service.updateZoneSignatures(&viewData[index], view.DNSData.SignedZone)
+	}
+
+	service.dnsViewLock.Lock()
+	defer service.dnsViewLock.Unlock()
+
+	service.DNSData = *data
+	for index, view := range service.DNSViews {
+		view.DNSData = viewData[index]
+	}
+}
+
+// Parse DNS views from configuration.
+func parseDNSViews(viewsValue interface{}, defaultForwarder DNSForwarder, tlsConfig *tls.Config, enablePublicDNS bool) ([]*DNSView, error) {
+	if viewsValue == nil {
+		return nil, nil
+	}
+
+	viewValues, ok := viewsValue.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of views")
+	}
+
+	var views []*DNSView
+	viewNames := make(map[string]bool)
+	for index, viewValue := range viewValues {
+		viewConfiguration, ok := viewValue.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("view %d is not a map", index+1)
+		}
+
+		view := &DNSView{
+			EnableForwarding: true,
+			DNSData:          NewDNSData(0),
+			forwarder:        defaultForwarder,
+		}
+
+		view.Name, _ = viewConfiguration["name"].(string)
+		if len(view.Name) == 0 {
+			return nil, fmt.Errorf("view %d must have a name", index+1)
+		}
+		if view.Name == defaultDNSViewName || viewNames[view.Name] {
+			return nil, fmt.Errorf("view name '%s' is already in use", view.Name)
+		}
+		viewNames[view.Name] = true
+
+		matchClients, err := parseStringList(viewConfiguration["match_clients"])
+		if err != nil {
+			return nil, fmt.Errorf("view '%s' has invalid match_clients: %s", view.Name, err.Error())
+		}
+		view.MatchClients, err = parseNetworks(matchClients)
+		if err != nil {
+			return nil, fmt.Errorf("view '%s' has invalid match_clients: %s", view.Name, err.Error())
+		}
+		if len(view.MatchClients) == 0 {
+			return nil, fmt.Errorf("view '%s' must have at least one entry in match_clients", view.Name)
+		}
+
+		view.UsePublicAddresses, _ = viewConfiguration["public_addresses"].(bool)
+		if view.UsePublicAddresses && !enablePublicDNS {
+			return nil, fmt.Errorf("view '%s' uses public addresses, but dns.public.enable / MCP_DNS_PUBLIC_ENABLE is false", view.Name)
+		}
+
+		forwardingConfiguration, _ := viewConfiguration["forwarding"].(map[interface{}]interface{})
+		if enableForwarding, ok := forwardingConfiguration["enable"].(bool); ok {
+			view.EnableForwarding = enableForwarding
+		}
+		if upstream, ok := forwardingConfiguration["upstream"].(string); ok && len(upstream) > 0 {
+			view.forwarder, err = NewDNSForwarder(upstream, tlsConfig)
+			if err != nil {
+				return nil, fmt.Errorf("view '%s' has invalid forwarding.upstream: %s", view.Name, err.Error())
+			}
+		}
+
+		views = append(views, view)
+	}
+
+	return views, nil
+}
+
+// Parse a list of strings from configuration.
+func parseStringList(value interface{}) ([]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	listValues, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list")
+	}
+
+	var list []string
+	for _, listValue := range listValues {
+		stringValue, ok := listValue.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a list of strings")
+		}
+
+		list = append(list, stringValue)
+	}
+
+	return list, nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 
 	dhcp "github.com/krolaw/dhcp4"
 	dns "github.com/miekg/dns"
@@ -16,7 +18,10 @@ type ServiceListeners struct {
 	listenInterface      *net.Interface
 	listenIPv4Address    *net.IP
 	dnsServer            *dns.Server
+	dnsTCPServer         *dns.Server
 	dhcpServerConnection *DHCPServerConnection
+	metricsServer        *http.Server
+	webhookServer        *http.Server
 	running              bool
 	errorChannel         chan error
 }
@@ -76,6 +81,19 @@ func (listeners *ServiceListeners) Start() error {
 
 	if listeners.service.EnableDNS {
 		go listeners.serveDNS()
+		go listeners.serveDNSOverTCP()
+	}
+
+	if listeners.service.MetricsListenAddress != "" {
+		// Created here (rather than in serveMetrics) so that Stop can always see it.
+		listeners.metricsServer = listeners.newMetricsServer()
+		go listeners.serveMetrics(listeners.metricsServer)
+	}
+
+	if listeners.service.WebhookListenAddress != "" {
+		// Created here (rather than in serveWebhook) so that Stop can always see it.
+		listeners.webhookServer = listeners.newWebhookServer()
+		go listeners.serveWebhook(listeners.webhookServer)
 	}
 
 	return nil
@@ -113,6 +131,30 @@ func (listeners *ServiceListeners) Stop() error {
 		listeners.dnsServer = nil
 	}
 
+	if listeners.dnsTCPServer != nil {
+		err := listeners.dnsTCPServer.Shutdown()
+		if err != nil {
+			return err
+		}
+		listeners.dnsTCPServer = nil
+	}
+
+	if listeners.metricsServer != nil {
+		err := listeners.metricsServer.Close()
+		if err != nil {
+			return err
+		}
+		listeners.metricsServer = nil
+	}
+
+	if listeners.webhookServer != nil {
+		err := listeners.webhookServer.Close()
+		if err != nil {
+			return err
+		}
+		listeners.webhookServer = nil
+	}
+
 	return nil
 }
 
@@ -155,9 +197,10 @@ func (listeners *ServiceListeners) serveDNS() {
 	mux.Handle(".", listeners.service)
 
 	listeners.dnsServer = &dns.Server{
-		Addr:    fmt.Sprintf("%s:%d", listeners.listenIPv4Address, listeners.service.DNSPort),
-		Net:     "udp",
-		Handler: mux,
+		Addr:       fmt.Sprintf("%s:%d", listeners.listenIPv4Address, listeners.service.DNSPort),
+		Net:        "udp",
+		Handler:    mux,
+		TsigSecret: listeners.service.dnsTSIGSecrets(),
 	}
 
 	err := listeners.dnsServer.ListenAndServe()
@@ -168,6 +211,66 @@ func (listeners *ServiceListeners) serveDNS() {
 	log.Printf("DNS server shutdown.")
 }
 
+// DNS over TCP is used for zone transfers (and by clients that receive truncated responses).
+func (listeners *ServiceListeners) serveDNSOverTCP() {
+	mux := dns.NewServeMux()
+	mux.Handle(".", listeners.service)
+
+	listeners.dnsTCPServer = &dns.Server{
+		Addr:       fmt.Sprintf("%s:%d", listeners.listenIPv4Address, listeners.service.DNSPort),
+		Net:        "tcp",
+		Handler:    mux,
+		TsigSecret: listeners.service.dnsTSIGSecrets(),
+	}
+
+	err := listeners.dnsTCPServer.ListenAndServe()
+	if err != nil && listeners.running {
+		listeners.errorChannel <- err
+	}
+
+	log.Printf("DNS server (TCP) shutdown.")
+}
+
+// Metrics (expvar) are served over HTTP at /debug/vars.
+func (listeners *ServiceListeners) newMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	return &http.Server{
+		Addr:    listeners.service.MetricsListenAddress,
+		Handler: mux,
+	}
+}
+
+func (listeners *ServiceListeners) serveMetrics(metricsServer *http.Server) {
+	err := metricsServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed && listeners.running {
+		listeners.errorChannel <- err
+	}
+
+	log.Printf("Metrics server shutdown.")
+}
+
+// The refresh webhook is served over HTTP at /refresh.
+func (listeners *ServiceListeners) newWebhookServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refresh", listeners.service.handleRefreshWebhook)
+
+	return &http.Server{
+		Addr:    listeners.service.WebhookListenAddress,
+		Handler: mux,
+	}
+}
+
+func (listeners *ServiceListeners) serveWebhook(webhookServer *http.Server) {
+	err := webhookServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed && listeners.running {
+		listeners.errorChannel <- err
+	}
+
+	log.Printf("Webhook server shutdown.")
+}
+
 func (listeners *ServiceListeners) findListenerInterface() error {
 	listenInterface, err := net.InterfaceByName(listeners.service.InterfaceName)
 	if err != nil {
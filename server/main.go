@@ -1,16 +1,31 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os/signal"
+	"syscall"
 
 	"os"
 )
 
+var printDS = flag.Bool("print-ds", false, "Print the DS record for the DNSSEC-signed zone (for delegation from its parent zone) and exit.")
+
 func main() {
 	log.SetFlags(0)
 	log.SetOutput(os.Stdout)
 
+	flag.Parse()
+	if *printDS {
+		err := PrintDNSSECDelegation()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
 	log.Printf("MCP 2.0 DHCP server " + ProductVersion)
 
 	fmt.Println("Server is initialising...")
@@ -25,6 +40,18 @@ func main() {
 
 	fmt.Println("Server is running.")
 
-	// Block forever.
-	select {}
+	// Reload DNS overrides on SIGHUP (runs forever).
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	for range reloadSignal {
+		if !service.EnableDNS {
+			continue
+		}
+
+		log.Printf("Reloading DNS overrides...")
+		err = service.ReloadDNSOverrides()
+		if err != nil {
+			log.Printf("Unable to reload DNS overrides: %s", err.Error())
+		}
+	}
 }
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// MetadataProviderCloudControl reads server metadata from CloudControl.
+	MetadataProviderCloudControl = "cloudcontrol"
+
+	// MetadataProviderFile reads server metadata from a YAML or JSON file.
+	MetadataProviderFile = "file"
+
+	// MetadataProviderHTTP reads server metadata (JSON) from a URL.
+	MetadataProviderHTTP = "http"
+)
+
+// MetadataProvider represents a source of server metadata (and the corresponding DNS data).
+type MetadataProvider interface {
+	// Name gets a name for the provider (used in log messages).
+	Name() string
+
+	// ReadServerMetadata reads server metadata (keyed by MAC address) and DNS data from the provider.
+	ReadServerMetadata() (map[string]ServerMetadata, *DNSData, error)
+}
+
+// CloudControlMetadataProvider provides server metadata from the servers in a CloudControl target's network domain.
+type CloudControlMetadataProvider struct {
+	service *Service
+	target  *CloudControlTarget
+}
+
+// Name gets a name for the provider (used in log messages).
+func (provider *CloudControlMetadataProvider) Name() string {
+	if provider.target.IsPrimary {
+		return MetadataProviderCloudControl
+	}
+
+	return fmt.Sprintf("%s ('%s')", MetadataProviderCloudControl, provider.target.Name)
+}
+
+// ReadServerMetadata reads server metadata (keyed by MAC address) and DNS data from CloudControl.
+func (provider *CloudControlMetadataProvider) ReadServerMetadata() (map[string]ServerMetadata, *DNSData, error) {
+	return provider.service.readCloudControlServerMetadata(provider.target)
+}
+
+// StaticReservationMetadataProvider provides server metadata from static address reservations (network.static_reservations).
+//
+// Static reservations have no DNS records of their own (although they can register names, if dns.register_dhcp_clients is enabled).
+type StaticReservationMetadataProvider struct {
+	service      *Service
+	reservations map[string]StaticReservation
+}
+
+// Name gets a name for the provider (used in log messages).
+func (provider *StaticReservationMetadataProvider) Name() string {
+	return "static"
+}
+
+// ReadServerMetadata creates server metadata (keyed by MAC address) from static reservations.
+func (provider *StaticReservationMetadataProvider) ReadServerMetadata() (map[string]ServerMetadata, *DNSData, error) {
+	serverMetadataByMACAddress := make(map[string]ServerMetadata)
+	for macAddress, staticReservation := range provider.reservations {
+		serverMetadataByMACAddress[macAddress] = ServerMetadata{
+			ID:   staticReservation.HostName,
+			Name: staticReservation.HostName,
+			IPv4ByMACAddress: map[string]net.IP{
+				macAddress: staticReservation.IPAddress,
+			},
+			IsStaticReservation: true,
+		}
+	}
+
+	dnsData := provider.service.newDNSData()
+
+	return serverMetadataByMACAddress, &dnsData, nil
+}
+
+// The server metadata (and DNS data) last read from a provider.
+type metadataProviderResult struct {
+	ServerMetadataByMACAddress map[string]ServerMetadata
+	DNSData                    *DNSData
+	Read                       time.Time
+}
+
+// The backoff state of a provider whose last read failed.
+type metadataProviderBackoff struct {
+	ConsecutiveFailures int
+	RetryAt             time.Time
+}
+
+// partialRefreshError indicates that server metadata could not be read from some providers (but was read from at least one other).
+//
+// The server metadata that was read is still applied, together with the server metadata last read from the failed providers (if any).
+type partialRefreshError struct {
+	Failures []string
+}
+
+func (err *partialRefreshError) Error() string {
+	return strings.Join(err.Failures, "; ")
+}
+
+// readServerMetadata reads server metadata (keyed by MAC address) and DNS data from the specified providers (or from all configured providers, if nil).
+//
+// Providers are read in parallel, and then merged (see mergeServerMetadata); providers that were not specified keep the server metadata last read from them (unless they have never been read, in which case they are read anyway).
+// Also returns the time when the oldest of the merged server metadata was read.
+//
+// Each provider is read independently, and backs off independently after it fails (while it is backing off, it is not read at all).
+// The server metadata last read from a failed provider is used until it can be read again; a provider that has never been read successfully contributes nothing.
+// If at least one provider was read successfully, the merged server metadata is returned with a *partialRefreshError; otherwise it is returned (if there is any) with an ordinary error.
+func (service *Service) readServerMetadata(providers []MetadataProvider) (map[string]ServerMetadata, *DNSData, time.Time, error) {
+	service.metadataProviderResultsLock.Lock()
+	defer service.metadataProviderResultsLock.Unlock()
+
+	now := time.Now()
+	providerResults := make([]metadataProviderResult, len(service.MetadataProviders))
+	providerErrors := make([]error, len(service.MetadataProviders))
+	providerSkipped := make([]bool, len(service.MetadataProviders))
+	providerNotRequested := make([]bool, len(service.MetadataProviders))
+
+	requestedProviders := make(map[MetadataProvider]bool)
+	for _, provider := range providers {
+		requestedProviders[provider] = true
+	}
+
+	var reads sync.WaitGroup
+	for index, provider := range service.MetadataProviders {
+		_, hasResult := service.metadataProviderResults[provider]
+		if providers != nil && !requestedProviders[provider] && hasResult {
+			providerNotRequested[index] = true
+
+			continue
+		}
+
+		backoff := service.metadataProviderBackoffs[provider]
+		if backoff != nil && now.Before(backoff.RetryAt) {
+			providerSkipped[index] = true
+
+			continue
+		}
+
+		reads.Add(1)
+		go func(index int, provider MetadataProvider) {
+			defer reads.Done()
+
+			providerServerMetadata, providerDNSData, err := provider.ReadServerMetadata()
+			if err != nil {
+				providerErrors[index] = err
+
+				return
+			}
+
+			providerResults[index] = metadataProviderResult{
+				ServerMetadataByMACAddress: providerServerMetadata,
+				DNSData:                    providerDNSData,
+				Read:                       time.Now(),
+			}
+		}(index, provider)
+	}
+	reads.Wait()
+
+	var failures []string
+	succeeded := 0
+	for index, provider := range service.MetadataProviders {
+		backoff := service.metadataProviderBackoffs[provider]
+
+		var failure string
+		switch {
+		case providerNotRequested[index]:
+			continue
+
+		case providerSkipped[index]:
+			failure = fmt.Sprintf("not reading server metadata from %s (backing off after %d consecutive failures; next attempt in %s)",
+				provider.Name(),
+				backoff.ConsecutiveFailures,
+				backoff.RetryAt.Sub(now)/time.Second*time.Second,
+			)
+
+		case providerErrors[index] != nil:
+			if backoff == nil {
+				backoff = &metadataProviderBackoff{}
+				service.metadataProviderBackoffs[provider] = backoff
+			}
+			backoff.ConsecutiveFailures++
+			backoff.RetryAt = time.Now().Add(
+				service.nextRefreshDelay(backoff.ConsecutiveFailures),
+			)
+
+			failure = fmt.Sprintf("failed to read server metadata from %s (%d consecutive failures): %s",
+				provider.Name(),
+				backoff.ConsecutiveFailures,
+				providerErrors[index].Error(),
+			)
+
+		default:
+			succeeded++
+			service.metadataProviderResults[provider] = providerResults[index]
+			delete(service.metadataProviderBackoffs, provider)
+
+			continue
+		}
+
+		if previousResult, ok := service.metadataProviderResults[provider]; ok {
+			failure += fmt.Sprintf(" (using server metadata read %s ago)", time.Since(previousResult.Read)/time.Second*time.Second)
+		} else {
+			failure += " (no server metadata has been read from it yet)"
+		}
+		failures = append(failures, failure)
+	}
+
+	serverMetadataByMACAddress, dnsData, oldest := service.mergeServerMetadata()
+	if serverMetadataByMACAddress == nil {
+		return nil, nil, time.Time{}, fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	if len(failures) > 0 && succeeded > 0 {
+		return serverMetadataByMACAddress, dnsData, oldest, &partialRefreshError{
+			Failures: failures,
+		}
+	}
+	if len(failures) > 0 {
+		return serverMetadataByMACAddress, dnsData, oldest, fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+
+	return serverMetadataByMACAddress, dnsData, oldest, nil
+}
+
+// Merge the server metadata last read from each provider, in priority order; if more than one provider has metadata for the same MAC address (or records for the same DNS name), the first one wins (and the conflict is logged).
+//
+// Until every provider has been read successfully, the server metadata loaded from the snapshot (if any) stands in for the providers that have not (with the lowest priority, and without logging conflicts).
+// Conflicts (and problems with server tags) are logged when they first appear.
+// Also returns the time when the oldest of the merged server metadata was read (or nil server metadata, if there is none to merge).
+//
+// The caller must hold the metadata provider results lock.
+func (service *Service) mergeServerMetadata() (map[string]ServerMetadata, *DNSData, time.Time) {
+	var (
+		sources     []metadataProviderResult
+		sourceNames []string
+	)
+	for _, provider := range service.MetadataProviders {
+		result, ok := service.metadataProviderResults[provider]
+		if ok {
+			sources = append(sources, result)
+			sourceNames = append(sourceNames, provider.Name())
+		}
+	}
+	if len(sources) == len(service.MetadataProviders) {
+		service.snapshotResult = nil // No longer needed.
+	}
+	snapshotIndex := -1
+	if service.snapshotResult != nil {
+		snapshotIndex = len(sources)
+		sources = append(sources, *service.snapshotResult)
+		sourceNames = append(sourceNames, "snapshot")
+	}
+	if len(sources) == 0 {
+		return nil, nil, time.Time{}
+	}
+
+	serverMetadataByMACAddress := make(map[string]ServerMetadata)
+	serverSourcesByMACAddress := make(map[string]string)
+	dnsData := service.newDNSData()
+	var oldest time.Time
+
+	// Warnings (e.g. conflicts) are only logged when they first appear (rather than on every refresh).
+	warnings := make(map[string]bool)
+	logWarning := func(format string, args ...interface{}) {
+		warning := fmt.Sprintf(format, args...)
+		if !service.metadataWarnings[warning] {
+			log.Print(warning)
+		}
+		warnings[warning] = true
+	}
+
+	for index, source := range sources {
+		if oldest.IsZero() || source.Read.Before(oldest) {
+			oldest = source.Read
+		}
+
+		for _, macAddress := range sortedServerMACAddresses(source.ServerMetadataByMACAddress) {
+			serverMetadata := source.ServerMetadataByMACAddress[macAddress]
+
+			existingServerMetadata, ok := serverMetadataByMACAddress[macAddress]
+			if ok {
+				if index != snapshotIndex {
+					logWarning("Conflict: ignoring server '%s' from %s for MAC address %s (already used by server '%s' from %s).",
+						serverMetadata.Name,
+						sourceNames[index],
+						macAddress,
+						existingServerMetadata.Name,
+						serverSourcesByMACAddress[macAddress],
+					)
+				}
+
+				continue
+			}
+
+			serverMetadataByMACAddress[macAddress] = serverMetadata
+			serverSourcesByMACAddress[macAddress] = sourceNames[index]
+		}
+
+		conflictingNames := dnsData.Merge(source.DNSData)
+		if index == snapshotIndex {
+			continue
+		}
+		for _, name := range conflictingNames {
+			logWarning("Conflict: ignoring DNS records for '%s' from %s (name is already in use).",
+				name,
+				sourceNames[index],
+			)
+		}
+	}
+
+	for _, macAddress := range sortedServerMACAddresses(serverMetadataByMACAddress) {
+		serverMetadata := serverMetadataByMACAddress[macAddress]
+		for _, tagWarning := range serverMetadata.TagWarnings {
+			logWarning("Server '%s' (Id = '%s') has %s.",
+				serverMetadata.Name,
+				serverMetadata.ID,
+				tagWarning,
+			)
+		}
+	}
+	service.metadataWarnings = warnings
+
+	return serverMetadataByMACAddress, &dnsData, oldest
+}
+
+// Find the provider that the server with the specified Id was last read from (nil if the server is not known).
+func (service *Service) findServerMetadataProvider(serverID string) MetadataProvider {
+	service.metadataProviderResultsLock.Lock()
+	defer service.metadataProviderResultsLock.Unlock()
+
+	for _, provider := range service.MetadataProviders {
+		for _, serverMetadata := range service.metadataProviderResults[provider].ServerMetadataByMACAddress {
+			if serverMetadata.ID == serverID {
+				return provider
+			}
+		}
+	}
+
+	return nil
+}
+
+// Determine whether the merged server metadata is missing a provider that has never been read successfully (and that the snapshot is not standing in for).
+func (service *Service) isServerMetadataIncomplete() bool {
+	service.metadataProviderResultsLock.Lock()
+	defer service.metadataProviderResultsLock.Unlock()
+
+	if service.snapshotResult != nil {
+		return false
+	}
+	for _, provider := range service.MetadataProviders {
+		if _, ok := service.metadataProviderResults[provider]; !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the MAC addresses in a set of server metadata (in sorted order).
+func sortedServerMACAddresses(serverMetadataByMACAddress map[string]ServerMetadata) []string {
+	var macAddresses []string
+	for macAddress := range serverMetadataByMACAddress {
+		macAddresses = append(macAddresses, macAddress)
+	}
+	sort.Strings(macAddresses)
+
+	return macAddresses
+}
+
+// Parse server metadata providers from configuration.
+func (service *Service) parseMetadataProviders(providersValue interface{}) ([]MetadataProvider, error) {
+	if providersValue == nil {
+		return []MetadataProvider{
+			service.newPrimaryCloudControlMetadataProvider(),
+		}, nil
+	}
+
+	providerValues, ok := providersValue.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of providers")
+	}
+	if len(providerValues) == 0 {
+		return nil, fmt.Errorf("at least one provider is required")
+	}
+
+	var providers []MetadataProvider
+	for index, providerValue := range providerValues {
+		providerConfiguration, ok := providerValue.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("provider %d is not a map", index+1)
+		}
+
+		providerType, _ := providerConfiguration["type"].(string)
+		switch strings.ToLower(providerType) {
+		case MetadataProviderCloudControl:
+			vlanID, _ := providerConfiguration["vlan_id"].(string)
+			if len(vlanID) == 0 {
+				// The primary target (network.vlan_id).
+				if service.primaryCloudControlTargetIn(providers) != nil {
+					return nil, fmt.Errorf("provider %d (%s) must have a vlan_id (only one provider can use network.vlan_id)", index+1, providerType)
+				}
+
+				providers = append(providers, service.newPrimaryCloudControlMetadataProvider())
+
+				continue
+			}
+
+			region := service.McpRegion
+			if regionValue, ok := providerConfiguration["region"].(string); ok {
+				region = regionValue
+			}
+			user := service.McpUser
+			if userValue, ok := providerConfiguration["user"].(string); ok {
+				user = userValue
+			}
+			password := service.McpPassword
+			if passwordValue, ok := providerConfiguration["password"].(string); ok {
+				password = passwordValue
+			}
+			subdomain, _ := providerConfiguration["subdomain"].(string)
+			subdomain = strings.Trim(subdomain, ".")
+			name, _ := providerConfiguration["name"].(string)
+			if len(name) == 0 {
+				name = subdomain
+			}
+			if len(name) == 0 {
+				name = vlanID
+			}
+
+			providers = append(providers, &CloudControlMetadataProvider{
+				service: service,
+				target:  NewCloudControlTarget(name, region, user, password, vlanID, subdomain),
+			})
+
+		case MetadataProviderFile:
+			fileName, _ := providerConfiguration["file"].(string)
+			if len(fileName) == 0 {
+				return nil, fmt.Errorf("provider %d (%s) must have a file", index+1, providerType)
+			}
+
+			providers = append(providers, NewFileMetadataProvider(service, fileName))
+
+		case MetadataProviderHTTP:
+			url, _ := providerConfiguration["url"].(string)
+			if len(url) == 0 {
+				return nil, fmt.Errorf("provider %d (%s) must have a url", index+1, providerType)
+			}
+
+			timeout := 30 * time.Second
+			if timeoutValue, ok := providerConfiguration["timeout"].(string); ok {
+				var err error
+				timeout, err = time.ParseDuration(timeoutValue)
+				if err != nil || timeout <= 0 {
+					return nil, fmt.Errorf("provider %d (%s) has invalid timeout '%s'", index+1, providerType, timeoutValue)
+				}
+			}
+
+			providers = append(providers, NewHTTPMetadataProvider(service, url, timeout))
+
+		default:
+			return nil, fmt.Errorf("provider %d has unsupported type '%s' (must be '%s', '%s', or '%s')",
+				index+1,
+				providerType,
+				MetadataProviderCloudControl,
+				MetadataProviderFile,
+				MetadataProviderHTTP,
+			)
+		}
+	}
+
+	return providers, nil
+}
+
+// Create a provider for the primary CloudControl target (network.vlan_id).
+func (service *Service) newPrimaryCloudControlMetadataProvider() *CloudControlMetadataProvider {
+	target := NewCloudControlTarget(MetadataProviderCloudControl,
+		service.McpRegion,
+		service.McpUser,
+		service.McpPassword,
+		viper.GetString("network.vlan_id"),
+		"", // The primary target uses the service's DNS domain.
+	)
+	target.IsPrimary = true
+
+	return &CloudControlMetadataProvider{
+		service: service,
+		target:  target,
+	}
+}
+
+// Find the primary CloudControl target (if any) in the specified providers.
+func (service *Service) primaryCloudControlTargetIn(providers []MetadataProvider) *CloudControlTarget {
+	for _, provider := range providers {
+		cloudControlProvider, ok := provider.(*CloudControlMetadataProvider)
+		if ok && cloudControlProvider.target.IsPrimary {
+			return cloudControlProvider.target
+		}
+	}
+
+	return nil
+}
+
+// Determine whether server metadata is read from CloudControl.
+func (service *Service) usesCloudControlMetadata() bool {
+	for _, provider := range service.MetadataProviders {
+		if _, ok := provider.(*CloudControlMetadataProvider); ok {
+			return true
+		}
+	}
+
+	return false
+}
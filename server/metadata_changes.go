@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ServerMetadataChangeType represents a type of change to server metadata.
+type ServerMetadataChangeType string
+
+const (
+	// ServerAdded indicates that a server has been added.
+	ServerAdded ServerMetadataChangeType = "added"
+
+	// ServerRemoved indicates that a server has been removed.
+	ServerRemoved ServerMetadataChangeType = "removed"
+
+	// ServerChanged indicates that a server's metadata (e.g. its network adapters or tags) has changed.
+	ServerChanged ServerMetadataChangeType = "changed"
+)
+
+// ServerMetadataChange represents a change to a server's metadata (detected when server metadata is refreshed).
+type ServerMetadataChange struct {
+	// The type of change.
+	Type ServerMetadataChangeType `json:"type"`
+
+	// The server Id.
+	ServerID string `json:"server_id"`
+
+	// The server name.
+	ServerName string `json:"server_name"`
+
+	// Descriptions of what changed (e.g. "MAC address 00:50:56:00:00:01 changed from 192.168.70.10 to 192.168.70.11").
+	Details []string `json:"details,omitempty"`
+
+	// MAC addresses that have been removed from the server (or whose IPv4 addresses have changed).
+	//
+	// Any lease held by these MAC addresses is no longer valid.
+	RevokedMACAddresses []string `json:"revoked_mac_addresses,omitempty"`
+
+	// The server's previous metadata (nil if the server has been added).
+	Previous *ServerMetadata `json:"-"`
+
+	// The server's current metadata (nil if the server has been removed).
+	Current *ServerMetadata `json:"-"`
+}
+
+// ServerMetadataChangeHandler reacts to changes in server metadata.
+//
+// Handlers are called with the state lock held (and so must not try to acquire it).
+type ServerMetadataChangeHandler func(service *Service, changes []ServerMetadataChange)
+
+// The handlers called when server metadata changes (in order).
+var serverMetadataChangeHandlers = []ServerMetadataChangeHandler{
+	(*Service).logServerMetadataChanges,
+	(*Service).revokeChangedLeases,
+	(*Service).runServerMetadataChangeHook,
+}
+
+// Compute the changes between two sets of server metadata (keyed by MAC address).
+func diffServerMetadata(previousByMACAddress map[string]ServerMetadata, currentByMACAddress map[string]ServerMetadata) []ServerMetadataChange {
+	previousByID := serverMetadataByID(previousByMACAddress)
+	currentByID := serverMetadataByID(currentByMACAddress)
+
+	var changes []ServerMetadataChange
+	for serverID, previous := range previousByID {
+		current, ok := currentByID[serverID]
+		if !ok {
+			previous := previous
+			changes = append(changes, ServerMetadataChange{
+				Type:                ServerRemoved,
+				ServerID:            serverID,
+				ServerName:          previous.Name,
+				RevokedMACAddresses: sortedMACAddresses(previous.IPv4ByMACAddress),
+				Previous:            &previous,
+			})
+
+			continue
+		}
+
+		details, revokedMACAddresses := diffServer(previous, current)
+		if len(details) == 0 {
+			continue
+		}
+
+		previous := previous
+		changes = append(changes, ServerMetadataChange{
+			Type:                ServerChanged,
+			ServerID:            serverID,
+			ServerName:          current.Name,
+			Details:             details,
+			RevokedMACAddresses: revokedMACAddresses,
+			Previous:            &previous,
+			Current:             &current,
+		})
+	}
+	for serverID, current := range currentByID {
+		if _, ok := previousByID[serverID]; ok {
+			continue
+		}
+
+		current := current
+		changes = append(changes, ServerMetadataChange{
+			Type:       ServerAdded,
+			ServerID:   serverID,
+			ServerName: current.Name,
+			Current:    &current,
+		})
+	}
+
+	sort.Slice(changes, func(index1 int, index2 int) bool {
+		return changes[index1].ServerID < changes[index2].ServerID
+	})
+
+	return changes
+}
+
+// Describe the differences between a server's previous and current metadata.
+func diffServer(previous ServerMetadata, current ServerMetadata) (details []string, revokedMACAddresses []string) {
+	if previous.Name != current.Name {
+		details = append(details, fmt.Sprintf("name changed from '%s' to '%s'", previous.Name, current.Name))
+	}
+
+	for _, macAddress := range sortedMACAddresses(previous.IPv4ByMACAddress) {
+		previousIPv4 := previous.IPv4ByMACAddress[macAddress]
+		currentIPv4, ok := current.IPv4ByMACAddress[macAddress]
+		if !ok {
+			details = append(details, fmt.Sprintf("MAC address %s (%s) removed", macAddress, previousIPv4))
+			revokedMACAddresses = append(revokedMACAddresses, macAddress)
+		} else if !previousIPv4.Equal(currentIPv4) {
+			details = append(details, fmt.Sprintf("MAC address %s changed from %s to %s", macAddress, previousIPv4, currentIPv4))
+			revokedMACAddresses = append(revokedMACAddresses, macAddress)
+		}
+	}
+	for _, macAddress := range sortedMACAddresses(current.IPv4ByMACAddress) {
+		if _, ok := previous.IPv4ByMACAddress[macAddress]; !ok {
+			details = append(details, fmt.Sprintf("MAC address %s (%s) added", macAddress, current.IPv4ByMACAddress[macAddress]))
+		}
+	}
+
+	// Everything else comes from the server's state or its tags.
+	settings := []struct {
+		name     string
+		previous interface{}
+		current  interface{}
+	}{
+		{"state", previous.State, current.State},
+		{"deployed", previous.Deployed, current.Deployed},
+		{"PXE boot image", previous.PXEBootImage, current.PXEBootImage},
+		{"iPXE boot script", previous.IPXEBootScript, current.IPXEBootScript},
+		{"DNS name", previous.DNSName, current.DNSName},
+		{"DNS aliases", previous.DNSAliases, current.DNSAliases},
+		{"DNS services", previous.DNSServices, current.DNSServices},
+		{"DNS text", previous.DNSText, current.DNSText},
+		{"DNS groups", previous.DNSGroups, current.DNSGroups},
+		{"DNS wildcards", previous.DNSWildcards, current.DNSWildcards},
+		{"DNS TTL", previous.DNSTTL, current.DNSTTL},
+	}
+	for _, setting := range settings {
+		if !reflect.DeepEqual(setting.previous, setting.current) {
+			details = append(details, fmt.Sprintf("%s changed from %v to %v", setting.name, setting.previous, setting.current))
+		}
+	}
+
+	return
+}
+
+// Group server metadata (keyed by MAC address) by server Id.
+func serverMetadataByID(serverMetadataByMACAddress map[string]ServerMetadata) map[string]ServerMetadata {
+	byID := make(map[string]ServerMetadata)
+	for _, serverMetadata := range serverMetadataByMACAddress {
+		byID[serverMetadata.ID] = serverMetadata
+	}
+
+	return byID
+}
+
+// Get the MAC addresses from a server's network adapters (in sorted order).
+func sortedMACAddresses(ipv4ByMACAddress map[string]net.IP) []string {
+	var macAddresses []string
+	for macAddress := range ipv4ByMACAddress {
+		macAddresses = append(macAddresses, macAddress)
+	}
+	sort.Strings(macAddresses)
+
+	return macAddresses
+}
+
+// Publish changes in server metadata to all change handlers.
+//
+// The caller must hold the state lock.
+func (service *Service) publishServerMetadataChanges(changes []ServerMetadataChange) {
+	if len(changes) == 0 {
+		return
+	}
+
+	for _, handler := range serverMetadataChangeHandlers {
+		handler(service, changes)
+	}
+}
+
+// Log changes in server metadata.
+func (service *Service) logServerMetadataChanges(changes []ServerMetadataChange) {
+	changeCounts := make(map[ServerMetadataChangeType]int)
+	for _, change := range changes {
+		changeCounts[change.Type]++
+
+		switch change.Type {
+		case ServerAdded:
+			log.Printf("Server '%s' (Id = '%s') added.", change.ServerName, change.ServerID)
+		case ServerRemoved:
+			log.Printf("Server '%s' (Id = '%s') removed.", change.ServerName, change.ServerID)
+		case ServerChanged:
+			log.Printf("Server '%s' (Id = '%s') changed: %s.", change.ServerName, change.ServerID, strings.Join(change.Details, "; "))
+		}
+	}
+
+	log.Printf("Server metadata changed (%d servers added, %d removed, %d changed).",
+		changeCounts[ServerAdded],
+		changeCounts[ServerRemoved],
+		changeCounts[ServerChanged],
+	)
+}
+
+// Revoke leases held by MAC addresses that have been removed (or whose IPv4 addresses have changed).
+//
+// The next time the client renews its lease (requesting its old address), it will receive a NAK (and then obtain a lease on its new address, if any).
+func (service *Service) revokeChangedLeases(changes []ServerMetadataChange) {
+	for _, change := range changes {
+		for _, macAddress := range change.RevokedMACAddresses {
+			lease, ok := service.LeasesByMACAddress[macAddress]
+			if !ok {
+				continue
+			}
+
+			log.Printf("Revoking lease on IPv4 address %s for MAC address %s (server '%s' has %s).",
+				lease.IPAddress,
+				macAddress,
+				change.ServerName,
+				change.Type,
+			)
+			delete(service.LeasesByMACAddress, macAddress)
+		}
+	}
+}
+
+// Run the configured hook (if any) for changes in server metadata.
+//
+// The hook is run in the background, and receives the changes (as JSON) on its standard input.
+func (service *Service) runServerMetadataChangeHook(changes []ServerMetadataChange) {
+	if len(service.ServerMetadataChangeHook) == 0 {
+		return
+	}
+
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		log.Printf("Unable to run server metadata change hook: %s", err.Error())
+
+		return
+	}
+
+	hook := service.ServerMetadataChangeHook
+	go func() {
+		command := exec.Command(hook)
+		command.Stdin = bytes.NewReader(changesJSON)
+
+		output, err := command.CombinedOutput()
+		if err != nil {
+			log.Printf("Server metadata change hook '%s' failed: %s\n%s", hook, err.Error(), output)
+		} else if service.EnableDebugLogging {
+			log.Printf("Server metadata change hook '%s' completed:\n%s", hook, output)
+		}
+	}()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+	"github.com/DimensionDataResearch/mcp2-dhcp-server/server/cloudcontroltest"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// Record the server metadata changes published (until the test completes).
+func recordServerMetadataChanges(t *testing.T) *[]ServerMetadataChange {
+	var published []ServerMetadataChange
+
+	handlers := serverMetadataChangeHandlers
+	serverMetadataChangeHandlers = append(serverMetadataChangeHandlers[:len(handlers):len(handlers)], func(service *Service, changes []ServerMetadataChange) {
+		published = append(published, changes...)
+	})
+	t.Cleanup(func() {
+		serverMetadataChangeHandlers = handlers
+	})
+
+	return &published
+}
+
+// Move web1's primary network adapter to a new IPv4 address (192.168.70.11), and remove db1.
+func changeTestServers(t *testing.T, client *cloudcontroltest.FakeClient) {
+	fixture, err := cloudcontroltest.LoadFixture("testdata/cloudcontrol/basic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []compute.Server
+	for _, server := range fixture.Servers {
+		switch server.Name {
+		case "web1":
+			newIPv4 := "192.168.70.11"
+			server.Network.PrimaryAdapter.PrivateIPv4Address = &newIPv4
+		case "db1":
+			continue
+		}
+		servers = append(servers, server)
+	}
+	fixture.Servers = servers
+
+	client.SetFixture(fixture)
+}
+
+func TestRefreshServerMetadataChanges(t *testing.T) {
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+	published := recordServerMetadataChanges(t)
+
+	response := sendDHCP(t, service, dhcp.Request, "00:50:56:00:00:01")
+	if dhcpMessageType(response) != dhcp.ACK {
+		t.Fatalf("expected ACK, got %s", dhcpMessageType(response))
+	}
+
+	changeTestServers(t, client)
+	err := service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := *published
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %#v", changes)
+	}
+	for _, change := range changes {
+		switch change.ServerName {
+		case "web1":
+			if change.Type != ServerChanged || len(change.RevokedMACAddresses) != 1 || change.RevokedMACAddresses[0] != "00:50:56:00:00:01" {
+				t.Errorf("expected web1 to be changed (revoking 00:50:56:00:00:01), got %#v", change)
+			}
+		case "db1":
+			if change.Type != ServerRemoved || len(change.RevokedMACAddresses) != 1 {
+				t.Errorf("expected db1 to be removed, got %#v", change)
+			}
+		default:
+			t.Errorf("unexpected change %#v", change)
+		}
+	}
+
+	// The lease on the old address has been revoked.
+	if lease, ok := service.LeasesByMACAddress["00:50:56:00:00:01"]; ok {
+		t.Fatalf("expected lease to be revoked, got %#v", lease)
+	}
+
+	// Renewing the lease on the old address is refused.
+	hardwareAddress, _ := net.ParseMAC("00:50:56:00:00:01")
+	renewal := dhcp.RequestPacket(dhcp.Request, hardwareAddress, net.ParseIP("192.168.70.10"), []byte{1, 2, 3, 4}, false, nil)
+	response = service.ServeDHCP(renewal, dhcp.Request, renewal.ParseOptions())
+	if dhcpMessageType(response) != dhcp.NAK {
+		t.Fatalf("expected NAK when renewing the old address, got %s", dhcpMessageType(response))
+	}
+	if _, ok := service.LeasesByMACAddress["00:50:56:00:00:01"]; ok {
+		t.Fatalf("expected no lease to be created when renewing the old address")
+	}
+
+	// The client then obtains a lease on its new address.
+	response = sendDHCP(t, service, dhcp.Discover, "00:50:56:00:00:01")
+	if dhcpMessageType(response) != dhcp.Offer || response.YIAddr().String() != "192.168.70.11" {
+		t.Fatalf("expected offer of 192.168.70.11, got %s %s", dhcpMessageType(response), response.YIAddr())
+	}
+	response = sendDHCP(t, service, dhcp.Request, "00:50:56:00:00:01")
+	if dhcpMessageType(response) != dhcp.ACK || response.YIAddr().String() != "192.168.70.11" {
+		t.Fatalf("expected ACK of 192.168.70.11, got %s %s", dhcpMessageType(response), response.YIAddr())
+	}
+
+	// Refreshing unchanged server metadata publishes no further changes.
+	*published = nil
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*published) != 0 {
+		t.Fatalf("expected no changes, got %#v", *published)
+	}
+}
+
+func TestServerMetadataChangeHook(t *testing.T) {
+	hookDirectory := t.TempDir()
+	hookOutputFile := filepath.Join(hookDirectory, "changes.json")
+	hookFile := filepath.Join(hookDirectory, "hook.sh")
+	err := ioutil.WriteFile(hookFile, []byte("#!/bin/sh\ncat > "+hookOutputFile+".tmp && mv "+hookOutputFile+".tmp "+hookOutputFile+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"metadata.change_hook": hookFile,
+	})
+
+	// Wait for the hook run for the initial refresh (all servers added).
+	waitForFile := func() []byte {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			output, err := ioutil.ReadFile(hookOutputFile)
+			if err == nil {
+				os.Remove(hookOutputFile)
+
+				return output
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for server metadata change hook")
+
+		return nil
+	}
+	waitForFile()
+
+	changeTestServers(t, client)
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []map[string]interface{}
+	err = json.Unmarshal(waitForFile(), &changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %v", changes)
+	}
+	if changes[0]["server_name"] != "db1" || changes[0]["type"] != "removed" {
+		t.Errorf("expected db1 to be removed, got %v", changes[0])
+	}
+	if changes[1]["server_name"] != "web1" || changes[1]["type"] != "changed" {
+		t.Errorf("expected web1 to be changed, got %v", changes[1])
+	}
+	if revoked, _ := changes[1]["revoked_mac_addresses"].([]interface{}); len(revoked) != 1 || revoked[0] != "00:50:56:00:00:01" {
+		t.Errorf("expected web1 to revoke 00:50:56:00:00:01, got %v", changes[1]["revoked_mac_addresses"])
+	}
+}
+
+func TestServerMetadataChangesIncludeDeployed(t *testing.T) {
+	previous := ServerMetadata{ID: "server-db1", Name: "db1"}
+	current := previous
+	current.Deployed = true
+
+	changes := diffServerMetadata(
+		map[string]ServerMetadata{"00:50:56:00:00:03": previous},
+		map[string]ServerMetadata{"00:50:56:00:00:03": current},
+	)
+	if len(changes) != 1 || changes[0].Type != ServerChanged || len(changes[0].Details) != 1 || changes[0].Details[0] != "deployed changed from false to true" {
+		t.Fatalf("expected db1 to be changed (deployed), got %#v", changes)
+	}
+}
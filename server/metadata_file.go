@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+	"github.com/spf13/viper"
+)
+
+// MetadataServer represents a server in a server metadata file (or HTTP response).
+type MetadataServer struct {
+	// The server Id (defaults to the server name).
+	ID string `mapstructure:"id"`
+
+	// The server name.
+	Name string `mapstructure:"name"`
+
+	// The server's network adapters (the first is its primary network adapter).
+	NetworkAdapters []MetadataNetworkAdapter `mapstructure:"network_adapters"`
+
+	// Tags (as for servers in CloudControl, e.g. "dns_aliases", "ipxe_profile").
+	Tags map[string]string `mapstructure:"tags"`
+}
+
+// MetadataNetworkAdapter represents a network adapter in a server metadata file (or HTTP response).
+type MetadataNetworkAdapter struct {
+	// The network adapter's MAC address.
+	MACAddress string `mapstructure:"mac"`
+
+	// The network adapter's IPv4 address.
+	IPv4Address string `mapstructure:"ipv4"`
+
+	// The network adapter's IPv6 address (if any).
+	IPv6Address string `mapstructure:"ipv6"`
+
+	// The name of the network adapter's VLAN (if any).
+	VLANName string `mapstructure:"vlan"`
+}
+
+// FileMetadataProvider provides server metadata from a YAML or JSON file.
+type FileMetadataProvider struct {
+	// The name of the file containing server metadata.
+	FileName string
+
+	service *Service
+}
+
+// NewFileMetadataProvider creates a new FileMetadataProvider.
+func NewFileMetadataProvider(service *Service, fileName string) *FileMetadataProvider {
+	return &FileMetadataProvider{
+		FileName: fileName,
+		service:  service,
+	}
+}
+
+// Name gets a name for the provider (used in log messages).
+func (provider *FileMetadataProvider) Name() string {
+	return fmt.Sprintf("file '%s'", provider.FileName)
+}
+
+// ReadServerMetadata reads server metadata (keyed by MAC address) and DNS data from the file.
+func (provider *FileMetadataProvider) ReadServerMetadata() (map[string]ServerMetadata, *DNSData, error) {
+	metadata := viper.New()
+	metadata.SetConfigFile(provider.FileName)
+	err := metadata.ReadInConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return provider.service.parseMetadataServers(metadata)
+}
+
+// HTTPMetadataProvider provides server metadata from a URL that returns JSON (in the same format as a server metadata file).
+type HTTPMetadataProvider struct {
+	// The URL that returns server metadata.
+	URL string
+
+	service *Service
+	client  *http.Client
+}
+
+// NewHTTPMetadataProvider creates a new HTTPMetadataProvider.
+func NewHTTPMetadataProvider(service *Service, url string, timeout time.Duration) *HTTPMetadataProvider {
+	return &HTTPMetadataProvider{
+		URL:     url,
+		service: service,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// Name gets a name for the provider (used in log messages).
+func (provider *HTTPMetadataProvider) Name() string {
+	return fmt.Sprintf("URL '%s'", provider.URL)
+}
+
+// ReadServerMetadata reads server metadata (keyed by MAC address) and DNS data from the URL.
+func (provider *HTTPMetadataProvider) ReadServerMetadata() (map[string]ServerMetadata, *DNSData, error) {
+	httpRequest, err := http.NewRequest("GET", provider.URL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpRequest.Header.Set("Accept", "application/json")
+
+	httpResponse, err := provider.client.Do(httpRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d (%s)", httpResponse.StatusCode, httpResponse.Status)
+	}
+
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := viper.New()
+	metadata.SetConfigType("json")
+	err = metadata.ReadConfig(bytes.NewReader(responseBody))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return provider.service.parseMetadataServers(metadata)
+}
+
+// Parse servers (the "servers" key) from server metadata, creating server metadata (keyed by MAC address) and DNS data.
+//
+// Tags are interpreted in the same way as tags on servers in CloudControl (except that they never have the tag prefix, since they are not shared with other tools).
+func (service *Service) parseMetadataServers(metadata *viper.Viper) (map[string]ServerMetadata, *DNSData, error) {
+	var servers []MetadataServer
+	err := metadata.UnmarshalKey("servers", &servers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid servers: %s", err.Error())
+	}
+
+	serverMetadataByMACAddress := make(map[string]ServerMetadata)
+	dnsData := service.newDNSData()
+	hostNamesByPrivateIPv4 := make(map[string]string)
+
+	allServerTags := make(map[string][]compute.TagDetail)
+	for index, server := range servers {
+		if len(server.Name) == 0 {
+			return nil, nil, fmt.Errorf("server %d must have a name", index+1)
+		}
+		if len(server.NetworkAdapters) == 0 {
+			return nil, nil, fmt.Errorf("server '%s' must have at least one network adapter", server.Name)
+		}
+
+		serverMetadata := &ServerMetadata{
+			ID:   server.ID,
+			Name: server.Name,
+		}
+		if len(serverMetadata.ID) == 0 {
+			serverMetadata.ID = server.Name
+		}
+
+		for tagName, tagValue := range server.Tags {
+			allServerTags[serverMetadata.ID] = append(allServerTags[serverMetadata.ID], compute.TagDetail{
+				AssetID:   serverMetadata.ID,
+				AssetName: serverMetadata.Name,
+				Name:      tagName,
+				Value:     tagValue,
+			})
+		}
+		service.parseServerTags(serverMetadata, allServerTags, "") // The tag prefix only applies to tags in CloudControl.
+
+		var networkAdapters []compute.VirtualMachineNetworkAdapter
+		for adapterIndex, adapter := range server.NetworkAdapters {
+			networkAdapter, err := adapter.toNetworkAdapter()
+			if err != nil {
+				return nil, nil, fmt.Errorf("server '%s' has invalid network adapter %d: %s", server.Name, adapterIndex+1, err.Error())
+			}
+
+			networkAdapters = append(networkAdapters, networkAdapter)
+		}
+
+		service.addServerMetadata(serverMetadata, networkAdapters, serverMetadataByMACAddress, &dnsData, hostNamesByPrivateIPv4)
+	}
+
+	return serverMetadataByMACAddress, &dnsData, nil
+}
+
+// Convert the network adapter to its CloudControl equivalent.
+func (adapter MetadataNetworkAdapter) toNetworkAdapter() (compute.VirtualMachineNetworkAdapter, error) {
+	networkAdapter := compute.VirtualMachineNetworkAdapter{}
+
+	if len(adapter.MACAddress) == 0 {
+		return networkAdapter, fmt.Errorf("mac is required")
+	}
+	macAddress := adapter.MACAddress
+	networkAdapter.MACAddress = &macAddress
+
+	ipv4 := net.ParseIP(adapter.IPv4Address)
+	if ipv4 == nil || ipv4.To4() == nil {
+		return networkAdapter, fmt.Errorf("ipv4 '%s' is not a valid IPv4 address", adapter.IPv4Address)
+	}
+	ipv4Address := ipv4.String()
+	networkAdapter.PrivateIPv4Address = &ipv4Address
+
+	if len(adapter.IPv6Address) > 0 {
+		ipv6 := net.ParseIP(adapter.IPv6Address)
+		if ipv6 == nil || ipv6.To4() != nil {
+			return networkAdapter, fmt.Errorf("ipv6 '%s' is not a valid IPv6 address", adapter.IPv6Address)
+		}
+		ipv6Address := ipv6.String()
+		networkAdapter.PrivateIPv6Address = &ipv6Address
+	}
+
+	if len(adapter.VLANName) > 0 {
+		vlanName := adapter.VLANName
+		networkAdapter.VLANName = &vlanName
+	}
+
+	return networkAdapter, nil
+}
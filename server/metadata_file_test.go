@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const testMetadataYAML = `
+servers:
+  - name: lab-server-1
+    id: lab-1
+    network_adapters:
+      - mac: 00:0C:29:C7:38:B9
+        ipv4: 192.168.70.20
+      - mac: 00:0C:29:C7:38:BA
+        ipv4: 192.168.71.20
+        ipv6: "fd00::20"
+        vlan: storage
+    tags:
+      dns_aliases: web,api
+`
+
+const testMetadataJSON = `{
+	"servers": [
+		{
+			"name": "lab-server-2",
+			"network_adapters": [
+				{ "mac": "00:0c:29:c7:38:c1", "ipv4": "192.168.70.30" }
+			]
+		}
+	]
+}`
+
+func TestFileMetadataProvider(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	metadataFile := filepath.Join(t.TempDir(), "servers.yml")
+	err := ioutil.WriteFile(metadataFile, []byte(testMetadataYAML), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverMetadataByMACAddress, dnsData, err := NewFileMetadataProvider(service, metadataFile).ReadServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both network adapters map to the same server.
+	for _, macAddress := range []string{"00:0c:29:c7:38:b9", "00:0c:29:c7:38:ba"} {
+		serverMetadata, ok := serverMetadataByMACAddress[macAddress]
+		if !ok {
+			t.Fatalf("expected server metadata for MAC address %s", macAddress)
+		}
+		if serverMetadata.ID != "lab-1" || serverMetadata.Name != "lab-server-1" {
+			t.Errorf("%s: unexpected server %s ('%s')", macAddress, serverMetadata.ID, serverMetadata.Name)
+		}
+		if !reflect.DeepEqual(serverMetadata.DNSAliases, []string{"web", "api"}) {
+			t.Errorf("%s: expected DNS aliases [web api], got %q", macAddress, serverMetadata.DNSAliases)
+		}
+	}
+	if ipv4 := serverMetadataByMACAddress["00:0c:29:c7:38:b9"].IPv4ByMACAddress["00:0c:29:c7:38:b9"]; ipv4.String() != "192.168.70.20" {
+		t.Errorf("expected primary IPv4 address 192.168.70.20, got %s", ipv4)
+	}
+
+	if records := dnsData.FindA("lab-server-1.lab.mcp."); len(records) != 1 || records[0].A.String() != "192.168.70.20" {
+		t.Errorf("expected A record for lab-server-1, got %v", records)
+	}
+	if records := dnsData.FindAAAA("lab-server-1-nic1.lab.mcp."); len(records) != 1 || records[0].AAAA.String() != "fd00::20" {
+		t.Errorf("expected AAAA record for lab-server-1-nic1, got %v", records)
+	}
+	if cname := dnsData.FindCNAME("web.lab.mcp."); cname == nil || cname.Target != "lab-server-1.lab.mcp." {
+		t.Errorf("expected CNAME web -> lab-server-1, got %v", cname)
+	}
+
+	// The tag prefix only applies to tags in CloudControl.
+	service.TagPrefix = "mcp-dhcp:"
+	serverMetadataByMACAddress, _, err = NewFileMetadataProvider(service, metadataFile).ReadServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverMetadata := serverMetadataByMACAddress["00:0c:29:c7:38:b9"]; !reflect.DeepEqual(serverMetadata.DNSAliases, []string{"web", "api"}) {
+		t.Errorf("expected DNS aliases [web api] with a tag prefix configured, got %q", serverMetadata.DNSAliases)
+	}
+
+	_, _, err = NewFileMetadataProvider(service, filepath.Join(t.TempDir(), "missing.yml")).ReadServerMetadata()
+	if err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
+
+func TestHTTPMetadataProvider(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/servers" {
+			http.NotFound(writer, request)
+
+			return
+		}
+		if request.Header.Get("Accept") != "application/json" {
+			http.Error(writer, "expected Accept: application/json", http.StatusNotAcceptable)
+
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(testMetadataJSON))
+	}))
+	defer httpServer.Close()
+
+	serverMetadataByMACAddress, dnsData, err := NewHTTPMetadataProvider(service, httpServer.URL+"/servers", 5*time.Second).ReadServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverMetadata, ok := serverMetadataByMACAddress["00:0c:29:c7:38:c1"]
+	if !ok {
+		t.Fatalf("expected server metadata for MAC address 00:0c:29:c7:38:c1")
+	}
+	if serverMetadata.ID != "lab-server-2" || serverMetadata.Name != "lab-server-2" {
+		t.Errorf("expected server Id to default to its name, got %s ('%s')", serverMetadata.ID, serverMetadata.Name)
+	}
+	if records := dnsData.FindA("lab-server-2.lab.mcp."); len(records) != 1 || records[0].A.String() != "192.168.70.30" {
+		t.Errorf("expected A record for lab-server-2, got %v", records)
+	}
+
+	_, _, err = NewHTTPMetadataProvider(service, httpServer.URL+"/missing", 5*time.Second).ReadServerMetadata()
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected an error for status 404, got %v", err)
+	}
+}
+
+func TestParseMetadataServersInvalid(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	testCases := []struct {
+		Name          string
+		JSON          string
+		ExpectedError string
+	}{
+		{"no name", `{"servers": [{"network_adapters": [{"mac": "00:0c:29:c7:38:c1", "ipv4": "192.168.70.30"}]}]}`, "server 1 must have a name"},
+		{"no adapters", `{"servers": [{"name": "lab-server-2"}]}`, "must have at least one network adapter"},
+		{"no mac", `{"servers": [{"name": "lab-server-2", "network_adapters": [{"ipv4": "192.168.70.30"}]}]}`, "mac is required"},
+		{"invalid ipv4", `{"servers": [{"name": "lab-server-2", "network_adapters": [{"mac": "00:0c:29:c7:38:c1", "ipv4": "192.168.70"}]}]}`, "not a valid IPv4 address"},
+		{"ipv6 as ipv4", `{"servers": [{"name": "lab-server-2", "network_adapters": [{"mac": "00:0c:29:c7:38:c1", "ipv4": "fd00::30"}]}]}`, "not a valid IPv4 address"},
+		{"ipv4 as ipv6", `{"servers": [{"name": "lab-server-2", "network_adapters": [{"mac": "00:0c:29:c7:38:c1", "ipv4": "192.168.70.30", "ipv6": "192.168.70.31"}]}]}`, "not a valid IPv6 address"},
+	}
+	for _, testCase := range testCases {
+		metadata := viper.New()
+		metadata.SetConfigType("json")
+		err := metadata.ReadConfig(strings.NewReader(testCase.JSON))
+		if err != nil {
+			t.Fatalf("%s: %s", testCase.Name, err)
+		}
+
+		_, _, err = service.parseMetadataServers(metadata)
+		if err == nil || !strings.Contains(err.Error(), testCase.ExpectedError) {
+			t.Errorf("%s: expected error containing '%s', got %v", testCase.Name, testCase.ExpectedError, err)
+		}
+	}
+}
+
+func TestStaticReservations(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	settings := map[string]interface{}{
+		"cloudcontrol.snapshot_file": snapshotFile,
+		"network.static_reservations": []interface{}{
+			map[interface{}]interface{}{
+				"mac":  "00:0C:29:00:00:99",
+				"name": "static1",
+				"ipv4": "192.168.70.99",
+			},
+			map[interface{}]interface{}{
+				"mac":  "00:50:56:00:00:03", // db1's MAC address
+				"name": "static2",
+				"ipv4": "192.168.70.98",
+			},
+		},
+	}
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", settings)
+
+	// Static reservations are the first provider (so they take precedence over CloudControl).
+	if _, ok := service.MetadataProviders[0].(*StaticReservationMetadataProvider); !ok {
+		t.Fatalf("expected static reservations to be the first provider, got %s", service.MetadataProviders[0].Name())
+	}
+	serverMetadata := service.FindServerMetadataByMACAddress("00:0c:29:00:00:99")
+	if serverMetadata == nil || !serverMetadata.IsStaticReservation || serverMetadata.Name != "static1" {
+		t.Fatalf("expected static reservation 'static1', got %#v", serverMetadata)
+	}
+	serverMetadata = service.FindServerMetadataByMACAddress("00:50:56:00:00:03")
+	if serverMetadata == nil || !serverMetadata.IsStaticReservation || serverMetadata.Name != "static2" {
+		t.Fatalf("expected static reservation 'static2' to take precedence over server 'db1', got %#v", serverMetadata)
+	}
+
+	snapshot, _, err := service.readServerMetadataSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snapshot.ServerMetadataByMACAddress["00:0c:29:00:00:99"]; ok {
+		t.Errorf("expected static reservation not to be part of the snapshot")
+	}
+	if serverMetadata, ok := snapshot.ServerMetadataByMACAddress["00:50:56:00:00:03"]; ok {
+		t.Errorf("expected static reservation (or the server it overrides) not to be part of the snapshot, got %#v", serverMetadata)
+	}
+
+	// Static reservations are still applied when CloudControl is unreachable and the snapshot is loaded instead.
+	restartedService, restartedClient := newTestService(t, "testdata/cloudcontrol/basic.json", settings)
+	restartedClient.SetError(fmt.Errorf("CloudControl is unreachable"))
+	err = restartedService.RefreshServerMetadata()
+	if err == nil {
+		t.Fatal("expected refresh to fail")
+	}
+	err = restartedService.loadServerMetadataSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverMetadata = restartedService.FindServerMetadataByMACAddress("00:0c:29:00:00:99")
+	if serverMetadata == nil || !serverMetadata.IsStaticReservation || serverMetadata.Name != "static1" {
+		t.Fatalf("expected static reservation 'static1' with snapshot, got %#v", serverMetadata)
+	}
+	if serverMetadata := restartedService.FindServerMetadataByMACAddress("00:50:56:00:00:01"); serverMetadata == nil || serverMetadata.Name != "web1" {
+		t.Fatalf("expected server 'web1' from snapshot, got %#v", serverMetadata)
+	}
+}
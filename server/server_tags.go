@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+)
+
+// ServerTagType represents the type of value expected for a server tag.
+type ServerTagType string
+
+const (
+	// ServerTagString is a tag whose value is used as-is.
+	ServerTagString ServerTagType = "string"
+
+	// ServerTagBoolean is a tag whose value is "true" or "false".
+	ServerTagBoolean ServerTagType = "boolean"
+
+	// ServerTagPositiveInteger is a tag whose value is a whole number greater than 0.
+	ServerTagPositiveInteger ServerTagType = "positive integer"
+
+	// ServerTagList is a tag whose value is a comma-separated list (empty items are ignored).
+	ServerTagList ServerTagType = "list"
+
+	// ServerTagDNSName is a tag whose value is a DNS name, relative to the zone (e.g. "web" or "web.apps").
+	ServerTagDNSName ServerTagType = "DNS name"
+
+	// ServerTagDNSNameList is a tag whose value is a comma-separated list of DNS names (empty items are ignored; invalid items are reported, but the valid ones are still used).
+	ServerTagDNSNameList ServerTagType = "DNS name list"
+)
+
+// A valid DNS label (letters, digits, and hyphens, not starting or ending with a hyphen).
+var dnsLabelPattern = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// ServerTag describes a supported server tag.
+type ServerTag struct {
+	// The tag name (excluding the configured tag prefix, if any).
+	Name string
+
+	// The type of value expected for the tag.
+	Type ServerTagType
+
+	// Update server metadata from the tag's (parsed and validated) value.
+	//
+	// Returns an error if the value is not valid for the tag (any part of the value that is valid is still applied).
+	Apply func(service *Service, serverMetadata *ServerMetadata, value interface{}) error
+}
+
+// The supported server tags.
+var serverTagSchema = []ServerTag{
+	{
+		Name: "dhcp_enabled",
+		Type: ServerTagBoolean,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			serverMetadata.DHCPDisabled = !value.(bool)
+
+			return nil
+		},
+	},
+	{
+		Name: "pxe_boot_image",
+		Type: ServerTagString,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			serverMetadata.PXEBootImage = value.(string)
+
+			return nil
+		},
+	},
+	{
+		Name: "ipxe_profile",
+		Type: ServerTagString,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			if serverMetadata.IPXEBootScript != "" {
+				return nil // ipxe_boot_script overrides ipxe_profile
+			}
+
+			// TODO: Add config item for URL template.
+			serverMetadata.IPXEBootScript = fmt.Sprintf("http://%s:%d/?profile=%s",
+				service.ServiceIP,
+				service.IPXEPort,
+				value.(string),
+			)
+
+			return nil
+		},
+	},
+	{
+		Name: "ipxe_boot_script",
+		Type: ServerTagString,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			serverMetadata.IPXEBootScript = value.(string)
+
+			return nil
+		},
+	},
+	{
+		Name: "dns_name",
+		Type: ServerTagDNSName,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			serverMetadata.DNSName = value.(string)
+
+			return nil
+		},
+	},
+	{
+		Name: "dns_srv",
+		Type: ServerTagList,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			var invalidServices []string
+			for _, serviceValue := range value.([]string) {
+				dnsService, err := parseDNSService(serviceValue)
+				if err != nil {
+					invalidServices = append(invalidServices, fmt.Sprintf("'%s' (%s)", serviceValue, err.Error()))
+
+					continue
+				}
+
+				serverMetadata.DNSServices = append(serverMetadata.DNSServices, *dnsService)
+			}
+			if len(invalidServices) > 0 {
+				return fmt.Errorf("invalid services %s", strings.Join(invalidServices, ", "))
+			}
+
+			return nil
+		},
+	},
+	{
+		Name: "dns_txt",
+		Type: ServerTagString,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			serverMetadata.DNSText = value.(string)
+
+			return nil
+		},
+	},
+	{
+		Name: "dns_aliases",
+		Type: ServerTagDNSNameList,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			serverMetadata.DNSAliases = append(serverMetadata.DNSAliases, value.([]string)...)
+
+			return nil
+		},
+	},
+	{
+		Name: "dns_group",
+		Type: ServerTagDNSNameList,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			serverMetadata.DNSGroups = append(serverMetadata.DNSGroups, value.([]string)...)
+
+			return nil
+		},
+	},
+	{
+		Name: "dns_ttl",
+		Type: ServerTagPositiveInteger,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			serverMetadata.DNSTTL = value.(uint32)
+
+			return nil
+		},
+	},
+	{
+		Name: "dns_wildcard",
+		Type: ServerTagList,
+		Apply: func(service *Service, serverMetadata *ServerMetadata, value interface{}) error {
+			var invalidWildcards []string
+			for _, wildcard := range value.([]string) {
+				wildcardName := strings.TrimPrefix(wildcard, "*.")
+				err := validateDNSName(wildcardName)
+				if err != nil {
+					invalidWildcards = append(invalidWildcards, fmt.Sprintf("'%s' (%s)", wildcard, err.Error()))
+
+					continue
+				}
+
+				serverMetadata.DNSWildcards = append(serverMetadata.DNSWildcards, wildcardName)
+			}
+			if len(invalidWildcards) > 0 {
+				return fmt.Errorf("invalid wildcards %s", strings.Join(invalidWildcards, ", "))
+			}
+
+			return nil
+		},
+	},
+}
+
+// Find the supported server tag with the specified name (excluding the tag prefix, if any).
+func findServerTag(name string) *ServerTag {
+	for index := range serverTagSchema {
+		if serverTagSchema[index].Name == name {
+			return &serverTagSchema[index]
+		}
+	}
+
+	return nil
+}
+
+// Parse a server tag value according to its type.
+//
+// For list types, the valid items are returned even if an error is returned for the invalid ones.
+func parseServerTagValue(tagType ServerTagType, value string) (interface{}, error) {
+	switch tagType {
+	case ServerTagString:
+		return value, nil
+
+	case ServerTagBoolean:
+		booleanValue, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("expected 'true' or 'false'")
+		}
+
+		return booleanValue, nil
+
+	case ServerTagPositiveInteger:
+		integerValue, err := strconv.ParseUint(strings.TrimSpace(value), 10, 31)
+		if err != nil || integerValue == 0 {
+			return nil, fmt.Errorf("expected a whole number greater than 0")
+		}
+
+		return uint32(integerValue), nil
+
+	case ServerTagList:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				items = append(items, item)
+			}
+		}
+
+		return items, nil
+
+	case ServerTagDNSName:
+		name := strings.TrimSpace(value)
+		err := validateDNSName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return name, nil
+
+	case ServerTagDNSNameList:
+		var names []string
+		var invalidNames []string
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+
+			err := validateDNSName(name)
+			if err != nil {
+				invalidNames = append(invalidNames, fmt.Sprintf("'%s' (%s)", name, err.Error()))
+
+				continue
+			}
+
+			names = append(names, name)
+		}
+		if len(invalidNames) > 0 {
+			return names, fmt.Errorf("invalid DNS names %s", strings.Join(invalidNames, ", "))
+		}
+
+		return names, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported tag type '%s'", tagType)
+	}
+}
+
+// Ensure that a DNS name (relative to the zone) consists of valid DNS labels.
+func validateDNSName(name string) error {
+	if name == "" {
+		return fmt.Errorf("DNS name cannot be empty")
+	}
+	if len(name) > 253 {
+		return fmt.Errorf("DNS name cannot be longer than 253 characters")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !dnsLabelPattern.MatchString(label) {
+			return fmt.Errorf("'%s' is not a valid DNS label (expected letters, digits, and hyphens)", label)
+		}
+	}
+
+	return nil
+}
+
+// Update server metadata from tags (if any) applied to the specified server.
+//
+// Only tags whose names start with the specified tag prefix (if any) are considered; unknown or malformed tags are recorded as warnings in the server metadata.
+func (service *Service) parseServerTags(serverMetadata *ServerMetadata, allServerTags map[string][]compute.TagDetail, tagPrefix string) {
+	serverTags, ok := allServerTags[serverMetadata.ID]
+	if !ok {
+		if service.EnableDebugLogging {
+			log.Printf("\tNo tags for server '%s' (Id = '%s'); assuming default configuration.",
+				serverMetadata.Name,
+				serverMetadata.ID,
+			)
+		}
+
+		return
+	}
+
+	for _, tag := range serverTags {
+		if !strings.HasPrefix(tag.Name, tagPrefix) {
+			continue // Not one of ours.
+		}
+		tagName := strings.TrimPrefix(tag.Name, tagPrefix)
+
+		serverTag := findServerTag(tagName)
+		if serverTag == nil {
+			// Without a tag prefix, we can't tell our tags apart from other tags.
+			if tagPrefix != "" {
+				serverMetadata.TagWarnings = append(serverMetadata.TagWarnings,
+					fmt.Sprintf("unknown tag '%s'", tag.Name),
+				)
+			}
+
+			continue
+		}
+
+		value, err := parseServerTagValue(serverTag.Type, tag.Value)
+		if value != nil {
+			applyErr := serverTag.Apply(service, serverMetadata, value)
+			if err == nil {
+				err = applyErr
+			}
+		}
+		if err != nil {
+			serverMetadata.TagWarnings = append(serverMetadata.TagWarnings,
+				fmt.Sprintf("invalid %s tag '%s' value '%s': %s", serverTag.Type, tag.Name, tag.Value, err.Error()),
+			)
+		}
+	}
+
+	if service.EnableDebugLogging {
+		log.Printf("\t%d tags for server '%s' (Id = '%s'):",
+			len(serverTags),
+			serverMetadata.Name,
+			serverMetadata.ID,
+		)
+
+		if serverMetadata.PXEBootImage != "" {
+			log.Printf("\t\tOverride PXE boot image: '%s'", serverMetadata.PXEBootImage)
+		}
+		if serverMetadata.IPXEBootScript != "" {
+			log.Printf("\t\tOverride iPXE boot script: '%s'", serverMetadata.IPXEBootScript)
+		}
+		if serverMetadata.DNSName != "" {
+			log.Printf("\t\tOverride DNS name: '%s'", serverMetadata.DNSName)
+		}
+		if len(serverMetadata.DNSAliases) > 0 {
+			log.Printf("\t\tDNS aliases: '%s'", strings.Join(serverMetadata.DNSAliases, "', '"))
+		}
+		for _, dnsService := range serverMetadata.DNSServices {
+			log.Printf("\t\tDNS service: '%s' (port %d)", dnsService.Name, dnsService.Port)
+		}
+		if serverMetadata.DNSText != "" {
+			log.Printf("\t\tDNS text: '%s'", serverMetadata.DNSText)
+		}
+		if len(serverMetadata.DNSGroups) > 0 {
+			log.Printf("\t\tDNS groups: '%s'", strings.Join(serverMetadata.DNSGroups, "', '"))
+		}
+		if serverMetadata.DNSTTL != 0 {
+			log.Printf("\t\tDNS TTL: %d", serverMetadata.DNSTTL)
+		}
+		if len(serverMetadata.DNSWildcards) > 0 {
+			log.Printf("\t\tDNS wildcards: '*.%s'", strings.Join(serverMetadata.DNSWildcards, "', '*."))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DimensionDataResearch/go-dd-cloud-compute/compute"
+)
+
+// Parse the specified tags (name -> value) for a server.
+func parseTestServerTags(service *Service, tags [][2]string) ServerMetadata {
+	serverMetadata := ServerMetadata{
+		ID:   "server-1",
+		Name: "server1",
+	}
+
+	var serverTags []compute.TagDetail
+	for _, tag := range tags {
+		serverTags = append(serverTags, compute.TagDetail{
+			AssetID: serverMetadata.ID,
+			Name:    tag[0],
+			Value:   tag[1],
+		})
+	}
+	service.parseServerTags(&serverMetadata, map[string][]compute.TagDetail{
+		serverMetadata.ID: serverTags,
+	}, service.TagPrefix)
+
+	return serverMetadata
+}
+
+func TestParseServerTags(t *testing.T) {
+	service := NewService()
+
+	serverMetadata := parseTestServerTags(service, [][2]string{
+		{"dns_name", " web "},
+		{"dns_aliases", "www, api,,"},
+		{"dns_srv", "_http._tcp:80,http:80"},
+		{"dns_ttl", "300"},
+		{"dns_wildcard", "*.apps"},
+		{"dhcp_enabled", "true"},
+		{"owner", "someone"}, // Not one of ours.
+	})
+	if serverMetadata.DNSName != "web" || serverMetadata.DNSTTL != 300 || serverMetadata.DHCPDisabled {
+		t.Fatalf("unexpected server metadata %#v", serverMetadata)
+	}
+	if !reflect.DeepEqual(serverMetadata.DNSAliases, []string{"www", "api"}) {
+		t.Errorf("expected DNS aliases [www api], got %q", serverMetadata.DNSAliases)
+	}
+	if !reflect.DeepEqual(serverMetadata.DNSWildcards, []string{"apps"}) {
+		t.Errorf("expected DNS wildcards [apps], got %q", serverMetadata.DNSWildcards)
+	}
+
+	// The valid service is still applied.
+	if len(serverMetadata.DNSServices) != 1 || serverMetadata.DNSServices[0].Name != "_http._tcp" {
+		t.Errorf("expected DNS service '_http._tcp', got %#v", serverMetadata.DNSServices)
+	}
+	if len(serverMetadata.TagWarnings) != 1 {
+		t.Fatalf("expected 1 tag warning (for the invalid service), got %q", serverMetadata.TagWarnings)
+	}
+
+	serverMetadata = parseTestServerTags(service, [][2]string{
+		{"dns_ttl", "-1"},
+		{"dhcp_enabled", "maybe"},
+	})
+	if serverMetadata.DNSTTL != 0 || serverMetadata.DHCPDisabled || len(serverMetadata.TagWarnings) != 2 {
+		t.Fatalf("expected malformed tags to be ignored (with warnings), got %#v", serverMetadata)
+	}
+}
+
+func TestParseServerTagsWithPrefix(t *testing.T) {
+	service := NewService()
+	service.TagPrefix = "mcp-dhcp:"
+
+	serverMetadata := parseTestServerTags(service, [][2]string{
+		{"dns_name", "ignored"},
+		{"mcp-dhcp:dns_name", "web"},
+		{"mcp-dhcp:dns_nmae", "typo"},
+		{"other-tool:dns_name", "other"},
+	})
+	if serverMetadata.DNSName != "web" {
+		t.Fatalf("expected DNS name 'web', got '%s'", serverMetadata.DNSName)
+	}
+	if len(serverMetadata.TagWarnings) != 1 {
+		t.Fatalf("expected 1 tag warning (for the unknown tag), got %q", serverMetadata.TagWarnings)
+	}
+}
+
+func TestParseServerTagsInvalidDNSNames(t *testing.T) {
+	service := NewService()
+
+	serverMetadata := parseTestServerTags(service, [][2]string{
+		{"dns_name", "web_1"},
+		{"dns_aliases", "www, -api, api.v2, bad name"},
+		{"dns_group", "workers,workers."},
+		{"dns_wildcard", "*.apps, *.bad..apps"},
+	})
+	if serverMetadata.DNSName != "" {
+		t.Errorf("expected invalid DNS name to be ignored, got '%s'", serverMetadata.DNSName)
+	}
+
+	// The valid names are still applied.
+	if !reflect.DeepEqual(serverMetadata.DNSAliases, []string{"www", "api.v2"}) {
+		t.Errorf("expected DNS aliases [www api.v2], got %q", serverMetadata.DNSAliases)
+	}
+	if !reflect.DeepEqual(serverMetadata.DNSGroups, []string{"workers"}) {
+		t.Errorf("expected DNS groups [workers], got %q", serverMetadata.DNSGroups)
+	}
+	if !reflect.DeepEqual(serverMetadata.DNSWildcards, []string{"apps"}) {
+		t.Errorf("expected DNS wildcards [apps], got %q", serverMetadata.DNSWildcards)
+	}
+	if len(serverMetadata.TagWarnings) != 4 {
+		t.Fatalf("expected 4 tag warnings (1 for each tag), got %q", serverMetadata.TagWarnings)
+	}
+	if !strings.Contains(serverMetadata.TagWarnings[1], "'-api'") || !strings.Contains(serverMetadata.TagWarnings[1], "'bad name'") {
+		t.Errorf("expected warning to list the invalid aliases, got '%s'", serverMetadata.TagWarnings[1])
+	}
+}
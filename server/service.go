@@ -23,7 +23,7 @@ type Service struct {
 
 	InterfaceName string
 
-	Client        *compute.Client
+	Client        CloudControlClient // If not set, a CloudControl API client is created during initialisation.
 	NetworkDomain *compute.NetworkDomain
 	VLAN          *compute.VLAN
 
@@ -38,14 +38,100 @@ type Service struct {
 
 	ServerMetadataByMACAddress     map[string]ServerMetadata
 	StaticReservationsByMACAddress map[string]StaticReservation
+	MetadataProviders              []MetadataProvider
+
+	// Server states (in CloudControl) for which DHCP requests are refused.
+	DeniedServerStates map[string]bool
+
+	// Are DHCP requests refused from servers (in CloudControl) that have not yet been deployed?
+	RequireDeployedServers bool
+
+	RefreshInterval     time.Duration
+	MaxRefreshBackoff   time.Duration
+	FastRefreshInterval time.Duration
+	fastRefreshLock     *sync.Mutex
+	lastFastRefresh     time.Time
+
+	// The file (if any) where a snapshot of server metadata is persisted (for use when CloudControl is unreachable at startup).
+	SnapshotFile string
+
+	// The contents (excluding its creation date) of the last snapshot written or loaded, and when it was last known to be current.
+	snapshotContents []byte
+	snapshotUpdated  time.Time
+	snapshotLock     *sync.Mutex
+
+	// The date and time when the server metadata currently in use was read from CloudControl.
+	ServerMetadataUpdated time.Time
+
+	// The command (if any) that is run when server metadata changes.
+	ServerMetadataChangeHook string
+
+	// The maximum number of servers whose tags are fetched from CloudControl at the same time.
+	TagFetchConcurrency int
+
+	// The maximum number of servers whose tags are fetched individually (above this, tags for every server in the datacenter are listed instead).
+	TagFetchMaxServers int
+
+	// How long server tags fetched from CloudControl are reused before being fetched again (0 to always fetch them).
+	TagCacheTTL time.Duration
+
+	// Creates CloudControl API clients (for CloudControl targets that do not already have one).
+	newCloudControlClient func(region string, user string, password string) CloudControlClient
+
+	// The server metadata last read from each provider, the backoff state of providers that are failing, the server metadata loaded from the snapshot (until every provider has been read), and the warnings logged when they were merged.
+	metadataProviderResults     map[MetadataProvider]metadataProviderResult
+	metadataProviderBackoffs    map[MetadataProvider]*metadataProviderBackoff
+	snapshotResult              *metadataProviderResult
+	metadataProviderResultsLock *sync.Mutex
+	metadataWarnings            map[string]bool
+
+	// The prefix (if any) for the names of server tags used by the service (e.g. "mcp-dhcp:").
+	TagPrefix string
+
+	// The address (if any) on which metrics are served over HTTP.
+	MetricsListenAddress string
+
+	// The address (if any) on which the refresh webhook is served over HTTP (and the token that callers must supply).
+	WebhookListenAddress string
+	WebhookToken         string
 
 	EnableDNS          bool
 	DNSPort            int
 	DNSDomainName      string
+	DNSAdapterNaming   string
+	EnablePublicDNS    bool
+	PublicDNSDomain    string
 	DNSData            DNSData
 	DNSTTL             uint32
+	DNSReverseTTL      uint32
+	DNSNegativeTTL     uint32
 	DNSFallbackAddress string
-	dnsFallbackClient  *dns.Client
+	dnsForwarder       DNSForwarder
+	dnsCache           *DNSCache
+	DNSViews           []*DNSView
+	dnsViewLock        *sync.RWMutex
+	DNSOverrides       *DNSOverrides
+	dnsOverridesLock   *sync.RWMutex
+	dnsQueryLog        *DNSQueryLog
+	dnsRateLimiter     *DNSRateLimiter
+
+	EnableDNSVLANSubzones          bool
+	EnableDNSNetworkDomainSubzones bool
+
+	EnableDNSTransfer    bool
+	DNSTransferAllowFrom []*net.IPNet
+	DNSTransferNotify    []string
+	DNSTSIGKeyName       string
+	DNSTSIGSecret        string
+	DNSTSIGAlgorithm     string
+	dnsJournal           *DNSZoneJournal
+
+	EnableDNSRegistration bool
+	EnableDNSUpdate       bool
+	DNSUpdateAllowFrom    []*net.IPNet
+	DynamicDNSRecords     map[string]DynamicDNSRecord
+	cloudControlDNSData   DNSData
+	dnsSigner             *DNSSigner
 
 	LeasesByMACAddress map[string]*Lease
 	LeaseDuration      time.Duration
@@ -54,8 +140,12 @@ type Service struct {
 
 	listeners     *ServiceListeners
 	stateLock     *sync.Mutex
-	refreshTimer  *time.Ticker
+	fastRefresh   chan string
 	cancelRefresh chan bool
+
+	// Requests for an immediate refresh (each with a channel that receives the result), and a channel that is closed when refreshes stop.
+	refreshRequests chan *refreshRequest
+	refreshStopped  chan struct{}
 }
 
 // NewService creates new Service state.
@@ -63,86 +153,237 @@ func NewService() *Service {
 	service := &Service{
 		ServerMetadataByMACAddress:     make(map[string]ServerMetadata),
 		StaticReservationsByMACAddress: make(map[string]StaticReservation),
+		DNSOverrides:                   NewDNSOverrides(),
 		LeasesByMACAddress:             make(map[string]*Lease),
+		DynamicDNSRecords:              make(map[string]DynamicDNSRecord),
 		LeaseDuration:                  24 * time.Hour,
 		DHCPOptions: dhcp.Options{
 			dhcp.OptionDomainNameServer: []byte{8, 8, 8, 8},
 		},
-		stateLock: &sync.Mutex{},
+		dnsJournal:       NewDNSZoneJournal(),
+		dnsViewLock:      &sync.RWMutex{},
+		dnsOverridesLock: &sync.RWMutex{},
+		fastRefreshLock:  &sync.Mutex{},
+		snapshotLock:     &sync.Mutex{},
+		stateLock:        &sync.Mutex{},
+
+		newCloudControlClient:       defaultCloudControlClient,
+		metadataProviderResults:     make(map[MetadataProvider]metadataProviderResult),
+		metadataProviderBackoffs:    make(map[MetadataProvider]*metadataProviderBackoff),
+		metadataProviderResultsLock: &sync.Mutex{},
 	}
 	service.listeners = NewServiceListeners(service)
 
 	return service
 }
 
-// Initialize the service configuration.
-func (service *Service) Initialize() error {
+// Load configuration (defaults, environment variables, and configuration file).
+func loadConfiguration() error {
+	configureDefaults()
+
+	viper.SetConfigType("yaml")
+	viper.SetConfigName("mcp2-dhcp-server")
+	viper.AddConfigPath(".")
+	viper.AddConfigPath("/etc")
+
+	return viper.ReadInConfig()
+}
+
+// Configure default values and environment variables for configuration.
+func configureDefaults() {
 	// Defaults
 	viper.SetDefault("debug", false)
+	viper.SetDefault("cloudcontrol.refresh_interval", "30s")
+	viper.SetDefault("cloudcontrol.max_refresh_backoff", "10m")
+	viper.SetDefault("cloudcontrol.fast_refresh_interval", "15s")
+	viper.SetDefault("cloudcontrol.snapshot_file", "")
+	viper.SetDefault("cloudcontrol.tag_fetch_concurrency", 5)
+	viper.SetDefault("cloudcontrol.tag_fetch_max_servers", 50)
+	viper.SetDefault("cloudcontrol.tag_cache_ttl", "5m")
+	viper.SetDefault("metrics.listen_address", "")
+	viper.SetDefault("webhook.listen_address", "")
+	viper.SetDefault("network.deny_server_states", defaultDeniedServerStates)
+	viper.SetDefault("network.require_deployed", false)
 	viper.SetDefault("dns.enable", false)
 	viper.SetDefault("dns.port", 53)
 	viper.SetDefault("dns.default_ttl", 60)
 	viper.SetDefault("dns.domain_name", "mcp.")
-	viper.SetDefault("dns.forward_to.address", "8.8.8.8")
-	viper.SetDefault("dns.forward_to.port", 53)
+	viper.SetDefault("dns.adapter_naming", DNSAdapterNamingIndex)
+	viper.SetDefault("dns.subzones.vlan", false)
+	viper.SetDefault("dns.subzones.network_domain", false)
+	viper.SetDefault("dns.public.enable", false)
+	viper.SetDefault("dns.public.subdomain", "public")
+	viper.SetDefault("dns.forwarding.to_address", "8.8.8.8")
+	viper.SetDefault("dns.forwarding.to_port", 53)
+	viper.SetDefault("dns.forwarding.cache.enable", false)
+	viper.SetDefault("dns.forwarding.cache.max_entries", 10000)
+	viper.SetDefault("dns.forwarding.cache.max_ttl", "1h")
+	viper.SetDefault("dns.query_log.enable", false)
+	viper.SetDefault("dns.query_log.sample_rate", 1.0)
+	viper.SetDefault("dns.rate_limit.enable", false)
+	viper.SetDefault("dns.rate_limit.responses_per_second", 10)
+	viper.SetDefault("dns.rate_limit.burst", 20)
+	viper.SetDefault("dns.rate_limit.ipv4_prefix_length", 24)
+	viper.SetDefault("dns.rate_limit.ipv6_prefix_length", 56)
+	viper.SetDefault("dns.rate_limit.slip", 2)
+	viper.SetDefault("dns.transfer.enable", false)
+	viper.SetDefault("dns.register_dhcp_clients", false)
+	viper.SetDefault("dns.update.enable", false)
+	viper.SetDefault("dns.tsig.algorithm", dns.HmacSHA256)
+	viper.SetDefault("dns.dnssec.enable", false)
+	viper.SetDefault("dns.dnssec.signature_validity", "336h")
 	viper.SetDefault("ipxe.enable", false)
 	viper.SetDefault("ipxe.port", 4777)
 	viper.SetDefault("ipxe.boot_image", "undionly.kpxe")
 
 	// Environment variables.
-	viper.BindEnv("MCP_USER", "mcp.user")
-	viper.BindEnv("MCP_PASSWORD", "mcp.password")
-	viper.BindEnv("MCP_REGION", "mcp.region")
-	viper.BindEnv("MCP_DHCP_DEBUG", "debug")
-	viper.BindEnv("MCP_DHCP_INTERFACE", "network.interface")
-	viper.BindEnv("MCP_DHCP_VLAN_ID", "network.vlan_id")
-	viper.BindEnv("MCP_DHCP_SERVICE_IP", "network.service_ip")
-	viper.BindEnv("MCP_DNS_ENABLE", "dns.enable")
-	viper.BindEnv("MCP_DNS_DOMAIN_NAME", "dns.domain_name")
-	viper.BindEnv("MCP_DNS_PORT", "dns.port")
-	viper.BindEnv("MCP_DNS_DEFAULT_TTP", "dns.default_ttl")
-	viper.BindEnv("MCP_DNS_FORWARDING_TO_ADDRESS", "dns.forwarding.to_address")
-	viper.BindEnv("MCP_DNS_FORWARDING_TO_PORT", "dns.forwarding.to_port")
-	viper.BindEnv("MCP_IPXE_ENABLE", "ipxe.enable")
-	viper.BindEnv("MCP_IPXE_PORT", "ipxe.port")
-	viper.BindEnv("MCP_IPXE_BOOT_IMAGE", "ipxe.boot_image")
-	viper.BindEnv("MCP_IPXE_BOOT_SCRIPT", "ipxe.boot_script")
-
-	viper.SetConfigType("yaml")
-	viper.SetConfigName("mcp2-dhcp-server")
-	viper.AddConfigPath(".")
-	viper.AddConfigPath("/etc")
+	viper.BindEnv("mcp.user", "MCP_USER")
+	viper.BindEnv("mcp.password", "MCP_PASSWORD")
+	viper.BindEnv("mcp.region", "MCP_REGION")
+	viper.BindEnv("debug", "MCP_DHCP_DEBUG")
+	viper.BindEnv("network.interface", "MCP_DHCP_INTERFACE")
+	viper.BindEnv("network.vlan_id", "MCP_DHCP_VLAN_ID")
+	viper.BindEnv("network.service_ip", "MCP_DHCP_SERVICE_IP")
+	viper.BindEnv("network.ipv4_network", "MCP_DHCP_IPV4_NETWORK")
+	viper.BindEnv("network.ipv4_gateway", "MCP_DHCP_IPV4_GATEWAY")
+	viper.BindEnv("network.deny_server_states", "MCP_DHCP_DENY_SERVER_STATES")
+	viper.BindEnv("network.require_deployed", "MCP_DHCP_REQUIRE_DEPLOYED")
+	viper.BindEnv("cloudcontrol.refresh_interval", "MCP_CLOUDCONTROL_REFRESH_INTERVAL")
+	viper.BindEnv("cloudcontrol.max_refresh_backoff", "MCP_CLOUDCONTROL_MAX_REFRESH_BACKOFF")
+	viper.BindEnv("cloudcontrol.fast_refresh_interval", "MCP_CLOUDCONTROL_FAST_REFRESH_INTERVAL")
+	viper.BindEnv("cloudcontrol.snapshot_file", "MCP_CLOUDCONTROL_SNAPSHOT_FILE")
+	viper.BindEnv("cloudcontrol.tag_fetch_concurrency", "MCP_CLOUDCONTROL_TAG_FETCH_CONCURRENCY")
+	viper.BindEnv("cloudcontrol.tag_fetch_max_servers", "MCP_CLOUDCONTROL_TAG_FETCH_MAX_SERVERS")
+	viper.BindEnv("cloudcontrol.tag_cache_ttl", "MCP_CLOUDCONTROL_TAG_CACHE_TTL")
+	viper.BindEnv("metrics.listen_address", "MCP_METRICS_LISTEN_ADDRESS")
+	viper.BindEnv("webhook.listen_address", "MCP_WEBHOOK_LISTEN_ADDRESS")
+	viper.BindEnv("webhook.token", "MCP_WEBHOOK_TOKEN")
+	viper.BindEnv("metadata.change_hook", "MCP_METADATA_CHANGE_HOOK")
+	viper.BindEnv("metadata.tag_prefix", "MCP_METADATA_TAG_PREFIX")
+	viper.BindEnv("dns.enable", "MCP_DNS_ENABLE")
+	viper.BindEnv("dns.domain_name", "MCP_DNS_DOMAIN_NAME")
+	viper.BindEnv("dns.adapter_naming", "MCP_DNS_ADAPTER_NAMING")
+	viper.BindEnv("dns.subzones.vlan", "MCP_DNS_SUBZONES_VLAN")
+	viper.BindEnv("dns.subzones.network_domain", "MCP_DNS_SUBZONES_NETWORK_DOMAIN")
+	viper.BindEnv("dns.public.enable", "MCP_DNS_PUBLIC_ENABLE")
+	viper.BindEnv("dns.public.subdomain", "MCP_DNS_PUBLIC_SUBDOMAIN")
+	viper.BindEnv("dns.port", "MCP_DNS_PORT")
+	viper.BindEnv("dns.default_ttl", "MCP_DNS_DEFAULT_TTP")
+	viper.BindEnv("dns.reverse_ttl", "MCP_DNS_REVERSE_TTL")
+	viper.BindEnv("dns.negative_ttl", "MCP_DNS_NEGATIVE_TTL")
+	viper.BindEnv("dns.forwarding.to_address", "MCP_DNS_FORWARDING_TO_ADDRESS")
+	viper.BindEnv("dns.forwarding.to_port", "MCP_DNS_FORWARDING_TO_PORT")
+	viper.BindEnv("dns.forwarding.upstream", "MCP_DNS_FORWARDING_UPSTREAM")
+	viper.BindEnv("dns.forwarding.tls.ca_file", "MCP_DNS_FORWARDING_TLS_CA_FILE")
+	viper.BindEnv("dns.forwarding.tls.server_name", "MCP_DNS_FORWARDING_TLS_SERVER_NAME")
+	viper.BindEnv("dns.forwarding.cache.enable", "MCP_DNS_FORWARDING_CACHE_ENABLE")
+	viper.BindEnv("dns.forwarding.cache.max_entries", "MCP_DNS_FORWARDING_CACHE_MAX_ENTRIES")
+	viper.BindEnv("dns.forwarding.cache.max_ttl", "MCP_DNS_FORWARDING_CACHE_MAX_TTL")
+	viper.BindEnv("dns.query_log.enable", "MCP_DNS_QUERY_LOG_ENABLE")
+	viper.BindEnv("dns.query_log.file", "MCP_DNS_QUERY_LOG_FILE")
+	viper.BindEnv("dns.query_log.sample_rate", "MCP_DNS_QUERY_LOG_SAMPLE_RATE")
+	viper.BindEnv("dns.rate_limit.enable", "MCP_DNS_RATE_LIMIT_ENABLE")
+	viper.BindEnv("dns.rate_limit.responses_per_second", "MCP_DNS_RATE_LIMIT_RESPONSES_PER_SECOND")
+	viper.BindEnv("dns.rate_limit.burst", "MCP_DNS_RATE_LIMIT_BURST")
+	viper.BindEnv("dns.rate_limit.slip", "MCP_DNS_RATE_LIMIT_SLIP")
+	viper.BindEnv("dns.transfer.enable", "MCP_DNS_TRANSFER_ENABLE")
+	viper.BindEnv("dns.register_dhcp_clients", "MCP_DNS_REGISTER_DHCP_CLIENTS")
+	viper.BindEnv("dns.update.enable", "MCP_DNS_UPDATE_ENABLE")
+	viper.BindEnv("dns.tsig.key_name", "MCP_DNS_TSIG_KEY_NAME")
+	viper.BindEnv("dns.tsig.secret", "MCP_DNS_TSIG_SECRET")
+	viper.BindEnv("dns.tsig.algorithm", "MCP_DNS_TSIG_ALGORITHM")
+	viper.BindEnv("dns.dnssec.enable", "MCP_DNS_DNSSEC_ENABLE")
+	viper.BindEnv("dns.dnssec.ksk", "MCP_DNS_DNSSEC_KSK")
+	viper.BindEnv("dns.dnssec.zsk", "MCP_DNS_DNSSEC_ZSK")
+	viper.BindEnv("dns.dnssec.signature_validity", "MCP_DNS_DNSSEC_SIGNATURE_VALIDITY")
+	viper.BindEnv("ipxe.enable", "MCP_IPXE_ENABLE")
+	viper.BindEnv("ipxe.port", "MCP_IPXE_PORT")
+	viper.BindEnv("ipxe.boot_image", "MCP_IPXE_BOOT_IMAGE")
+	viper.BindEnv("ipxe.boot_script", "MCP_IPXE_BOOT_SCRIPT")
+}
 
-	err := viper.ReadInConfig()
+// Initialize the service configuration.
+func (service *Service) Initialize() error {
+	err := loadConfiguration()
 	if err != nil {
 		panic(err)
 	}
 
+	err = service.configure()
+	if err != nil {
+		return err
+	}
+
+	err = service.listeners.Initialize()
+	if err != nil {
+		return err
+	}
+
+	go service.logListenerErrors()
+
+	return nil
+}
+
+// Configure the service from configuration (which must already have been loaded).
+func (service *Service) configure() error {
+	var err error
+
 	service.EnableDebugLogging = viper.GetBool("debug")
 
 	service.McpRegion = viper.GetString("mcp.region")
 	service.McpUser = viper.GetString("mcp.user")
 	service.McpPassword = viper.GetString("mcp.password")
-	service.Client = compute.NewClient(service.McpRegion, service.McpUser, service.McpPassword)
 
-	vlanID := viper.GetString("network.vlan_id")
-	service.VLAN, err = service.Client.GetVLAN(vlanID)
+	service.MetadataProviders, err = service.parseMetadataProviders(viper.Get("metadata.providers"))
 	if err != nil {
-		return err
-	} else if service.VLAN == nil {
-		return fmt.Errorf("Cannot find VLAN with Id '%s'", vlanID)
-	}
-	service.NetworkDomain, err = service.Client.GetNetworkDomain(service.VLAN.NetworkDomain.ID)
-	if err != nil {
-		return err
-	} else if service.NetworkDomain == nil {
-		return fmt.Errorf("Cannot find network domain with Id '%s'", service.VLAN.NetworkDomain.ID)
+		return fmt.Errorf("metadata.providers is invalid: %s", err.Error())
 	}
+	service.ServerMetadataChangeHook = viper.GetString("metadata.change_hook")
+	service.TagPrefix = viper.GetString("metadata.tag_prefix")
 
-	vlanCIDR := fmt.Sprintf("%s/%d",
-		service.VLAN.IPv4Range.BaseAddress,
-		service.VLAN.IPv4Range.PrefixSize,
+	var (
+		vlanName      string
+		vlanCIDR      string
+		vlanGatewayIP string
 	)
+	for _, target := range service.cloudControlTargets() {
+		if target.IsPrimary {
+			target.Client = service.Client
+		}
+
+		err = service.connectCloudControlTarget(target)
+		if err != nil {
+			return fmt.Errorf("CloudControl target '%s': %s", target.Name, err.Error())
+		}
+
+		if target.IsPrimary {
+			service.Client = target.Client
+			service.VLAN = target.VLAN
+			service.NetworkDomain = target.NetworkDomain
+		}
+	}
+
+	if service.primaryCloudControlTarget() != nil {
+
+		vlanName = service.VLAN.Name
+		vlanCIDR = fmt.Sprintf("%s/%d",
+			service.VLAN.IPv4Range.BaseAddress,
+			service.VLAN.IPv4Range.PrefixSize,
+		)
+		vlanGatewayIP = service.VLAN.IPv4GatewayAddress
+	} else {
+		// Without a primary CloudControl target, the network must be configured explicitly.
+		vlanName = viper.GetString("network.interface")
+		vlanCIDR = viper.GetString("network.ipv4_network")
+		if len(vlanCIDR) == 0 {
+			return fmt.Errorf("network.ipv4_network / MCP_DHCP_IPV4_NETWORK is required if the network is not configured from CloudControl (network.vlan_id)")
+		}
+		vlanGatewayIP = viper.GetString("network.ipv4_gateway")
+		if net.ParseIP(vlanGatewayIP).To4() == nil {
+			return fmt.Errorf("network.ipv4_gateway / MCP_DHCP_IPV4_GATEWAY must be a valid IPv4 address if the network is not configured from CloudControl (network.vlan_id)")
+		}
+	}
+
 	_, vlanNetwork, err := net.ParseCIDR(vlanCIDR)
 	if err != nil {
 		return err
@@ -150,7 +391,7 @@ func (service *Service) Initialize() error {
 
 	// Subnet mask and default gateway
 	service.DHCPOptions[dhcp.OptionSubnetMask] = vlanNetwork.Mask
-	service.DHCPOptions[dhcp.OptionRouter] = net.ParseIP(service.VLAN.IPv4GatewayAddress).To4()
+	service.DHCPOptions[dhcp.OptionRouter] = net.ParseIP(vlanGatewayIP).To4()
 
 	service.ServiceIP = net.ParseIP(
 		viper.GetString("network.service_ip"),
@@ -161,6 +402,43 @@ func (service *Service) Initialize() error {
 		return fmt.Errorf("network.interface / MCP_DHCP_INTERFACE is required")
 	}
 
+	service.DeniedServerStates = parseDeniedServerStates(
+		viper.GetStringSlice("network.deny_server_states"),
+	)
+	service.RequireDeployedServers = viper.GetBool("network.require_deployed")
+
+	service.RefreshInterval = viper.GetDuration("cloudcontrol.refresh_interval")
+	if service.RefreshInterval < time.Second {
+		return fmt.Errorf("cloudcontrol.refresh_interval / MCP_CLOUDCONTROL_REFRESH_INTERVAL must be at least 1s")
+	}
+	service.MaxRefreshBackoff = viper.GetDuration("cloudcontrol.max_refresh_backoff")
+	if service.MaxRefreshBackoff < service.RefreshInterval {
+		return fmt.Errorf("cloudcontrol.max_refresh_backoff / MCP_CLOUDCONTROL_MAX_REFRESH_BACKOFF cannot be less than cloudcontrol.refresh_interval")
+	}
+	service.FastRefreshInterval = viper.GetDuration("cloudcontrol.fast_refresh_interval")
+	if service.FastRefreshInterval < 0 {
+		return fmt.Errorf("cloudcontrol.fast_refresh_interval / MCP_CLOUDCONTROL_FAST_REFRESH_INTERVAL cannot be negative")
+	}
+	service.SnapshotFile = viper.GetString("cloudcontrol.snapshot_file")
+	service.TagFetchConcurrency = viper.GetInt("cloudcontrol.tag_fetch_concurrency")
+	if service.TagFetchConcurrency < 1 {
+		return fmt.Errorf("cloudcontrol.tag_fetch_concurrency / MCP_CLOUDCONTROL_TAG_FETCH_CONCURRENCY must be at least 1")
+	}
+	service.TagFetchMaxServers = viper.GetInt("cloudcontrol.tag_fetch_max_servers")
+	if service.TagFetchMaxServers < 0 {
+		return fmt.Errorf("cloudcontrol.tag_fetch_max_servers / MCP_CLOUDCONTROL_TAG_FETCH_MAX_SERVERS cannot be negative")
+	}
+	service.TagCacheTTL = viper.GetDuration("cloudcontrol.tag_cache_ttl")
+	if service.TagCacheTTL < 0 {
+		return fmt.Errorf("cloudcontrol.tag_cache_ttl / MCP_CLOUDCONTROL_TAG_CACHE_TTL cannot be negative")
+	}
+	service.MetricsListenAddress = viper.GetString("metrics.listen_address")
+	service.WebhookListenAddress = viper.GetString("webhook.listen_address")
+	service.WebhookToken = viper.GetString("webhook.token")
+	if service.WebhookListenAddress != "" && len(service.WebhookToken) < 16 {
+		return fmt.Errorf("webhook.token / MCP_WEBHOOK_TOKEN must be at least 16 characters if webhook.listen_address is specified")
+	}
+
 	service.EnableDNS = viper.GetBool("dns.enable")
 	if service.EnableDNS {
 		service.DNSPort = viper.GetInt("dns.port")
@@ -171,29 +449,197 @@ func (service *Service) Initialize() error {
 		service.DNSTTL = uint32(
 			viper.GetInt("dns.default_ttl"),
 		)
-		service.DNSData = NewDNSData(service.DNSTTL)
+		service.DNSReverseTTL = service.DNSTTL
+		if viper.IsSet("dns.reverse_ttl") {
+			service.DNSReverseTTL = uint32(
+				viper.GetInt("dns.reverse_ttl"),
+			)
+		}
+		service.DNSNegativeTTL = service.DNSTTL
+		if viper.IsSet("dns.negative_ttl") {
+			service.DNSNegativeTTL = uint32(
+				viper.GetInt("dns.negative_ttl"),
+			)
+		}
+		service.DNSData = service.newDNSData()
+		service.cloudControlDNSData = service.newDNSData()
 
 		service.DNSDomainName = viper.GetString("dns.domain_name")
 		if len(service.DNSDomainName) == 0 {
 			return fmt.Errorf("dns.domain_name / MCP_DNS_DOMAIN_NAME is optional, but cannot be empty")
 		}
-		service.DNSDomainName = dns.Fqdn(service.DNSDomainName)
+		service.DNSDomainName = dns.Fqdn(strings.ToLower(service.DNSDomainName))
+
+		service.DNSAdapterNaming = viper.GetString("dns.adapter_naming")
+		if service.DNSAdapterNaming != DNSAdapterNamingIndex && service.DNSAdapterNaming != DNSAdapterNamingVLAN {
+			return fmt.Errorf("dns.adapter_naming / MCP_DNS_ADAPTER_NAMING must be '%s' or '%s'", DNSAdapterNamingIndex, DNSAdapterNamingVLAN)
+		}
 
-		fallbackAddress := viper.GetString("dns.forwarding.to_address")
-		if len(fallbackAddress) == 0 {
-			return fmt.Errorf("dns.forwarding.to_address / MCP_DNS_FORWARD_TO_ADDRESS is optional, but cannot be empty")
+		service.EnableDNSVLANSubzones = viper.GetBool("dns.subzones.vlan")
+		service.EnableDNSNetworkDomainSubzones = viper.GetBool("dns.subzones.network_domain")
+		if service.EnableDNSNetworkDomainSubzones && !service.usesCloudControlMetadata() {
+			return fmt.Errorf("dns.subzones.network_domain / MCP_DNS_SUBZONES_NETWORK_DOMAIN requires server metadata from CloudControl")
 		}
 
-		fallbackPort := viper.GetInt("dns.forwarding.to_port")
-		if fallbackPort == 0 {
-			return fmt.Errorf("dns.forwarding.to_port / MCP_DNS_FORWARD_TO_PORT is optional, but cannot be empty")
+		service.EnablePublicDNS = viper.GetBool("dns.public.enable")
+		if service.EnablePublicDNS && !service.usesCloudControlMetadata() {
+			return fmt.Errorf("dns.public.enable / MCP_DNS_PUBLIC_ENABLE requires server metadata from CloudControl")
+		}
+		if service.EnablePublicDNS {
+			publicSubdomain := strings.Trim(viper.GetString("dns.public.subdomain"), ".")
+			if len(publicSubdomain) == 0 {
+				return fmt.Errorf("dns.public.subdomain / MCP_DNS_PUBLIC_SUBDOMAIN is optional, but cannot be empty")
+			}
+			service.PublicDNSDomain = dns.Fqdn(publicSubdomain + "." + service.DNSDomainName)
+		}
+
+		// An upstream URL (e.g. "tls://1.1.1.1", "https://dns.google/dns-query") takes precedence over address / port.
+		fallbackUpstream := viper.GetString("dns.forwarding.upstream")
+		if len(fallbackUpstream) == 0 {
+			fallbackAddress := viper.GetString("dns.forwarding.to_address")
+			if len(fallbackAddress) == 0 {
+				return fmt.Errorf("dns.forwarding.to_address / MCP_DNS_FORWARDING_TO_ADDRESS is optional, but cannot be empty")
+			}
+
+			fallbackPort := viper.GetInt("dns.forwarding.to_port")
+			if fallbackPort == 0 {
+				return fmt.Errorf("dns.forwarding.to_port / MCP_DNS_FORWARDING_TO_PORT is optional, but cannot be empty")
+			}
+
+			fallbackUpstream = "udp://" + net.JoinHostPort(fallbackAddress, fmt.Sprintf("%d", fallbackPort))
 		}
 
-		service.DNSFallbackAddress = fmt.Sprintf("%s:%d",
-			fallbackAddress, fallbackPort,
+		fallbackTLSConfig, err := NewDNSForwardingTLSConfig(
+			viper.GetString("dns.forwarding.tls.ca_file"),
+			viper.GetString("dns.forwarding.tls.server_name"),
 		)
+		if err != nil {
+			return fmt.Errorf("dns.forwarding.tls is invalid: %s", err.Error())
+		}
+
+		service.dnsForwarder, err = NewDNSForwarder(fallbackUpstream, fallbackTLSConfig)
+		if err != nil {
+			return fmt.Errorf("dns.forwarding.upstream / MCP_DNS_FORWARDING_UPSTREAM is invalid: %s", err.Error())
+		}
+		service.DNSFallbackAddress = service.dnsForwarder.Upstream()
 
-		service.dnsFallbackClient = &dns.Client{}
+		if viper.GetBool("dns.forwarding.cache.enable") {
+			maxEntries := viper.GetInt("dns.forwarding.cache.max_entries")
+			if maxEntries < 1 {
+				return fmt.Errorf("dns.forwarding.cache.max_entries / MCP_DNS_FORWARDING_CACHE_MAX_ENTRIES must be at least 1")
+			}
+			maxTTL := viper.GetDuration("dns.forwarding.cache.max_ttl")
+			if maxTTL < time.Second {
+				return fmt.Errorf("dns.forwarding.cache.max_ttl / MCP_DNS_FORWARDING_CACHE_MAX_TTL must be at least 1s")
+			}
+
+			service.dnsCache = NewDNSCache(maxEntries, maxTTL)
+		}
+
+		service.DNSViews, err = parseDNSViews(viper.Get("dns.views"), service.dnsForwarder, fallbackTLSConfig, service.EnablePublicDNS)
+		if err != nil {
+			return fmt.Errorf("dns.views is invalid: %s", err.Error())
+		}
+
+		service.DNSOverrides, err = loadDNSOverrides()
+		if err != nil {
+			return err
+		}
+
+		if viper.GetBool("dns.query_log.enable") {
+			sampleRate := viper.GetFloat64("dns.query_log.sample_rate")
+			if sampleRate <= 0 || sampleRate > 1 {
+				return fmt.Errorf("dns.query_log.sample_rate / MCP_DNS_QUERY_LOG_SAMPLE_RATE must be greater than 0 and no more than 1")
+			}
+
+			service.dnsQueryLog, err = NewDNSQueryLog(viper.GetString("dns.query_log.file"), sampleRate)
+			if err != nil {
+				return fmt.Errorf("dns.query_log.file / MCP_DNS_QUERY_LOG_FILE is invalid: %s", err.Error())
+			}
+		}
+
+		if viper.GetBool("dns.rate_limit.enable") {
+			responsesPerSecond := viper.GetFloat64("dns.rate_limit.responses_per_second")
+			if responsesPerSecond <= 0 {
+				return fmt.Errorf("dns.rate_limit.responses_per_second / MCP_DNS_RATE_LIMIT_RESPONSES_PER_SECOND must be greater than 0")
+			}
+			burst := viper.GetFloat64("dns.rate_limit.burst")
+			if burst < 1 {
+				return fmt.Errorf("dns.rate_limit.burst / MCP_DNS_RATE_LIMIT_BURST must be at least 1")
+			}
+			ipv4PrefixLength := viper.GetInt("dns.rate_limit.ipv4_prefix_length")
+			if ipv4PrefixLength < 0 || ipv4PrefixLength > 32 {
+				return fmt.Errorf("dns.rate_limit.ipv4_prefix_length must be between 0 and 32")
+			}
+			ipv6PrefixLength := viper.GetInt("dns.rate_limit.ipv6_prefix_length")
+			if ipv6PrefixLength < 0 || ipv6PrefixLength > 128 {
+				return fmt.Errorf("dns.rate_limit.ipv6_prefix_length must be between 0 and 128")
+			}
+			slip := viper.GetInt("dns.rate_limit.slip")
+			if slip < 0 {
+				return fmt.Errorf("dns.rate_limit.slip / MCP_DNS_RATE_LIMIT_SLIP cannot be negative")
+			}
+			exemptClients, err := parseNetworks(
+				viper.GetStringSlice("dns.rate_limit.exempt_clients"),
+			)
+			if err != nil {
+				return fmt.Errorf("dns.rate_limit.exempt_clients is invalid: %s", err.Error())
+			}
+
+			service.dnsRateLimiter = NewDNSRateLimiter(responsesPerSecond, burst, ipv4PrefixLength, ipv6PrefixLength, slip, exemptClients)
+		}
+
+		tsigKeyName := viper.GetString("dns.tsig.key_name")
+		if len(tsigKeyName) > 0 {
+			service.DNSTSIGKeyName = dns.Fqdn(strings.ToLower(tsigKeyName))
+			service.DNSTSIGAlgorithm = dns.Fqdn(strings.ToLower(viper.GetString("dns.tsig.algorithm")))
+			service.DNSTSIGSecret = viper.GetString("dns.tsig.secret")
+			if len(service.DNSTSIGSecret) == 0 {
+				return fmt.Errorf("dns.tsig.secret / MCP_DNS_TSIG_SECRET must be set if dns.tsig.key_name / MCP_DNS_TSIG_KEY_NAME is set")
+			}
+		}
+
+		service.EnableDNSTransfer = viper.GetBool("dns.transfer.enable")
+		if service.EnableDNSTransfer {
+			service.DNSTransferAllowFrom, err = parseNetworks(
+				viper.GetStringSlice("dns.transfer.allow_from"),
+			)
+			if err != nil {
+				return fmt.Errorf("dns.transfer.allow_from is invalid: %s", err.Error())
+			}
+			if len(service.DNSTransferAllowFrom) == 0 && len(service.DNSTSIGKeyName) == 0 {
+				return fmt.Errorf("dns.transfer.allow_from and / or dns.tsig.key_name must be set if dns.transfer.enable / MCP_DNS_TRANSFER_ENABLE is true")
+			}
+
+			for _, secondary := range viper.GetStringSlice("dns.transfer.notify") {
+				service.DNSTransferNotify = append(service.DNSTransferNotify,
+					hostPortWithDefault(secondary, 53),
+				)
+			}
+		}
+
+		if viper.GetBool("dns.dnssec.enable") {
+			service.dnsSigner, err = loadDNSSigner(service.DNSDomainName)
+			if err != nil {
+				return err
+			}
+		}
+
+		service.EnableDNSRegistration = viper.GetBool("dns.register_dhcp_clients")
+
+		service.EnableDNSUpdate = viper.GetBool("dns.update.enable")
+		if service.EnableDNSUpdate {
+			if len(service.DNSTSIGKeyName) == 0 {
+				return fmt.Errorf("dns.tsig.key_name / MCP_DNS_TSIG_KEY_NAME must be set if dns.update.enable / MCP_DNS_UPDATE_ENABLE is true")
+			}
+
+			service.DNSUpdateAllowFrom, err = parseNetworks(
+				viper.GetStringSlice("dns.update.allow_from"),
+			)
+			if err != nil {
+				return fmt.Errorf("dns.update.allow_from is invalid: %s", err.Error())
+			}
+		}
 	}
 
 	service.EnableIPXE = viper.GetBool("ipxe.enable")
@@ -238,6 +684,15 @@ func (service *Service) Initialize() error {
 	} else {
 		fmt.Printf("No static reservations.\n")
 	}
+	if len(service.StaticReservationsByMACAddress) > 0 {
+		// Static reservations take precedence over all other server metadata.
+		service.MetadataProviders = append([]MetadataProvider{
+			&StaticReservationMetadataProvider{
+				service:      service,
+				reservations: service.StaticReservationsByMACAddress,
+			},
+		}, service.MetadataProviders...)
+	}
 
 	// Ignore IP range if we have static reservations.
 	if len(service.StaticReservationsByMACAddress) == 0 {
@@ -245,18 +700,11 @@ func (service *Service) Initialize() error {
 			return fmt.Errorf("Service IP address %s does not lie within the IP network (%s) of the target VLAN ('%s')",
 				service.ServiceIP.String(),
 				vlanCIDR,
-				service.VLAN.Name,
+				vlanName,
 			)
 		}
 	}
 
-	err = service.listeners.Initialize()
-	if err != nil {
-		return err
-	}
-
-	go service.logListenerErrors()
-
 	return nil
 }
 
@@ -266,45 +714,33 @@ func (service *Service) Start() error {
 	defer service.releaseStateLock("Start")
 
 	log.Printf("Initialising CloudControl metadata cache...")
-	err := service.refreshServerMetadataInternal(false /* we already have the state lock */)
+	consecutiveFailures := 0
+	err := service.refreshServerMetadataInternal(false /* we already have the state lock */, nil)
 	if err != nil {
+		if _, isPartial := err.(*partialRefreshError); !isPartial {
+			consecutiveFailures++ // Providers that failed back off independently.
+		}
+
 		log.Printf("Error refreshing servers: %s",
 			err.Error(),
 		)
+
+		if service.SnapshotFile != "" {
+			err = service.loadServerMetadataSnapshot()
+			if err != nil {
+				log.Printf("Unable to load server metadata snapshot from '%s': %s",
+					service.SnapshotFile,
+					err.Error(),
+				)
+			}
+		}
 	}
 
 	log.Printf("All caches initialised.")
 
-	service.cancelRefresh = make(chan bool, 1)
-	service.refreshTimer = time.NewTicker(30 * time.Second)
-
-	go func() {
-		cancelRefresh := service.cancelRefresh
-		refreshTimer := service.refreshTimer.C
-
-		for {
-			select {
-			case <-cancelRefresh:
-				return // Stopped
-
-			case <-refreshTimer:
-				if service.EnableDebugLogging {
-					log.Printf("Refreshing server MAC addresses...")
-				}
-
-				err := service.RefreshServerMetadata()
-				if err != nil {
-					log.Printf("Error refreshing servers: %s",
-						err.Error(),
-					)
-				}
-
-				if service.EnableDebugLogging {
-					log.Printf("Refreshed server MAC addresses.")
-				}
-			}
-		}
-	}()
+	service.publishRefreshMetrics()
+
+	service.startRefreshing(consecutiveFailures)
 
 	err = service.listeners.Start()
 	if err != nil {
@@ -326,13 +762,7 @@ func (service *Service) Stop() error {
 		return err
 	}
 
-	if service.cancelRefresh != nil {
-		service.cancelRefresh <- true
-	}
-	service.cancelRefresh = nil
-
-	service.refreshTimer.Stop()
-	service.refreshTimer = nil
+	service.stopRefreshing()
 
 	return nil
 }
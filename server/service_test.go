@@ -0,0 +1,190 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DimensionDataResearch/mcp2-dhcp-server/server/cloudcontroltest"
+	"github.com/spf13/viper"
+)
+
+// Create a Service whose server metadata comes from the specified CloudControl fixture (via the fake CloudControl API).
+//
+// Settings override the default test configuration.
+func newTestService(t *testing.T, fixtureFile string, settings map[string]interface{}) (*Service, *cloudcontroltest.FakeClient) {
+	clientsByRegion := newTestClients(t, map[string]string{"": fixtureFile})
+
+	return newTestServiceWithClients(t, clientsByRegion, settings), clientsByRegion[""]
+}
+
+// Create fake CloudControl API clients (keyed by region) for the specified fixtures (keyed by region).
+func newTestClients(t *testing.T, fixtureFilesByRegion map[string]string) map[string]*cloudcontroltest.FakeClient {
+	clientsByRegion := make(map[string]*cloudcontroltest.FakeClient)
+	for region, fixtureFile := range fixtureFilesByRegion {
+		fixture, err := cloudcontroltest.LoadFixture(fixtureFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientsByRegion[region] = cloudcontroltest.NewFakeClient(fixture)
+	}
+
+	return clientsByRegion
+}
+
+// Create a Service whose server metadata comes from the specified fake CloudControl API clients (keyed by region; the primary target uses region "").
+func newTestServiceWithClients(t *testing.T, clientsByRegion map[string]*cloudcontroltest.FakeClient, settings map[string]interface{}) *Service {
+	viper.Reset()
+	configureDefaults()
+	viper.Set("network.interface", "eth0")
+	viper.Set("network.vlan_id", "vlan-1")
+	viper.Set("network.service_ip", "192.168.70.2")
+	viper.Set("dns.enable", true)
+	viper.Set("dns.domain_name", "lab.mcp")
+	viper.Set("cloudcontrol.tag_cache_ttl", "0s") // Tests that change tags expect to see the changes on the next refresh.
+	for key, value := range settings {
+		viper.Set(key, value)
+	}
+
+	service := NewService()
+	service.newCloudControlClient = func(region string, user string, password string) CloudControlClient {
+		client, ok := clientsByRegion[region]
+		if !ok {
+			t.Fatalf("no fake CloudControl client for region '%s'", region)
+		}
+
+		return client
+	}
+
+	err := service.configure()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return service
+}
+
+func TestConfigureFromCloudControl(t *testing.T) {
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	if service.VLAN == nil || service.VLAN.ID != "vlan-1" {
+		t.Fatalf("expected VLAN 'vlan-1', got %#v", service.VLAN)
+	}
+	if service.NetworkDomain == nil || service.NetworkDomain.ID != "nd-1" {
+		t.Fatalf("expected network domain 'nd-1', got %#v", service.NetworkDomain)
+	}
+}
+
+func TestRefreshServerMetadataPaging(t *testing.T) {
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	// 3 servers in the network domain (2 per page); tags are only fetched for those servers (web1 has 3 tags, db1 has 2, and deploying has none).
+	if calls := client.Calls("ListServersInNetworkDomain"); calls != 3 {
+		t.Errorf("expected 3 calls to ListServersInNetworkDomain, got %d", calls)
+	}
+	if calls := client.Calls("GetAssetTags"); calls != 4 {
+		t.Errorf("expected 4 calls to GetAssetTags, got %d", calls)
+	}
+
+	expectedServerNamesByMACAddress := map[string]string{
+		"00:50:56:00:00:01": "web1",
+		"00:50:56:00:00:02": "web1",
+		"00:50:56:00:00:03": "db1",
+	}
+	if len(service.ServerMetadataByMACAddress) != len(expectedServerNamesByMACAddress) {
+		t.Fatalf("expected %d MAC addresses, got %d", len(expectedServerNamesByMACAddress), len(service.ServerMetadataByMACAddress))
+	}
+	for macAddress, expectedServerName := range expectedServerNamesByMACAddress {
+		serverMetadata := service.FindServerMetadataByMACAddress(macAddress)
+		if serverMetadata == nil {
+			t.Errorf("no server metadata for MAC address %s", macAddress)
+
+			continue
+		}
+		if serverMetadata.Name != expectedServerName {
+			t.Errorf("expected server '%s' for MAC address %s, got '%s'", expectedServerName, macAddress, serverMetadata.Name)
+		}
+	}
+
+	// Tags from the last (partial) page must have been applied.
+	serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:00:03")
+	if serverMetadata.HostName() != "database" || len(serverMetadata.DNSServices) != 1 {
+		t.Errorf("expected tags for server 'db1' to be applied, got %#v", serverMetadata)
+	}
+}
+
+func TestRefreshServerMetadataTagCache(t *testing.T) {
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"cloudcontrol.tag_cache_ttl": "1h",
+	})
+	if calls := client.Calls("GetAssetTags"); calls != 4 {
+		t.Fatalf("expected 4 calls to GetAssetTags, got %d", calls)
+	}
+
+	// Tags are reused from the cache.
+	err := service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := client.Calls("GetAssetTags"); calls != 4 {
+		t.Fatalf("expected tags to be reused from the cache, got %d calls to GetAssetTags", calls)
+	}
+	serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:00:03")
+	if serverMetadata == nil || serverMetadata.HostName() != "database" {
+		t.Fatalf("expected cached tags for server 'db1' to be applied, got %#v", serverMetadata)
+	}
+
+	// Unless they have expired.
+	service.TagCacheTTL = 0
+	err = service.RefreshServerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := client.Calls("GetAssetTags"); calls != 8 {
+		t.Fatalf("expected tags to be fetched again, got %d calls to GetAssetTags", calls)
+	}
+}
+
+func TestRefreshServerMetadataDatacenterTags(t *testing.T) {
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", map[string]interface{}{
+		"cloudcontrol.tag_fetch_max_servers": 1,
+	})
+
+	// Tags for more than tag_fetch_max_servers servers are listed for the whole datacenter (rather than fetched for each server).
+	if calls := client.Calls("GetAssetTags"); calls != 0 {
+		t.Fatalf("expected no calls to GetAssetTags, got %d", calls)
+	}
+	if calls := client.Calls("GetAssetTagsByType"); calls == 0 {
+		t.Fatalf("expected tags to be listed for the datacenter")
+	}
+
+	serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:00:03")
+	if serverMetadata == nil || serverMetadata.HostName() != "database" {
+		t.Fatalf("expected tags for server 'db1' to be applied, got %#v", serverMetadata)
+	}
+	serverMetadata = service.FindServerMetadataByMACAddress("00:50:56:00:00:01")
+	if serverMetadata == nil || len(serverMetadata.DNSAliases) != 1 || serverMetadata.DNSAliases[0] != "www" {
+		t.Fatalf("expected tags for server 'web1' to be applied, got %#v", serverMetadata)
+	}
+}
+
+func TestConfigureFromEnvironment(t *testing.T) {
+	t.Setenv("MCP_DHCP_DENY_SERVER_STATES", "PENDING_DELETE,failed_add")
+	t.Setenv("MCP_DHCP_REQUIRE_DEPLOYED", "true")
+	t.Setenv("MCP_CLOUDCONTROL_TAG_FETCH_MAX_SERVERS", "7")
+
+	service, _ := newTestService(t, "testdata/cloudcontrol/basic.json", nil)
+
+	if len(service.DeniedServerStates) != 2 || !service.DeniedServerStates["PENDING_DELETE"] || !service.DeniedServerStates["FAILED_ADD"] {
+		t.Errorf("expected denied server states PENDING_DELETE and FAILED_ADD, got %v", service.DeniedServerStates)
+	}
+	if !service.RequireDeployedServers {
+		t.Errorf("expected MCP_DHCP_REQUIRE_DEPLOYED to be applied")
+	}
+	if service.TagFetchMaxServers != 7 {
+		t.Errorf("expected tag_fetch_max_servers of 7, got %d", service.TagFetchMaxServers)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The response from the refresh webhook.
+type refreshWebhookResponse struct {
+	// When server metadata was last refreshed.
+	Updated time.Time `json:"updated"`
+
+	// The server (if one was requested).
+	Server *refreshWebhookServer `json:"server,omitempty"`
+
+	// The error (if any).
+	Error string `json:"error,omitempty"`
+}
+
+// A server in the response from the refresh webhook.
+type refreshWebhookServer struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	IPv4ByMACAddress map[string]net.IP `json:"ipv4_by_mac_address"`
+}
+
+// Handle a request to the refresh webhook ("POST /refresh[?server_id=<id>]").
+//
+// Server metadata is refreshed immediately by the periodic refresh loop (concurrent requests are coalesced) and the response is sent once the refresh is complete.
+// If refreshes are backing off after consecutive failures, no refresh is performed and the response has status 503 (with Retry-After).
+// If only some providers failed, the response has status 200 (and includes the error).
+// If a server Id is specified, its tags are always fetched (even if they are cached) and the response includes its metadata (or 404 if the server is still unknown after the refresh).
+// In that case, only the provider that the server was last read from is refreshed (all providers are refreshed if the server is not known yet).
+func (service *Service) handleRefreshWebhook(writer http.ResponseWriter, request *http.Request) {
+	if !service.isAuthorizedWebhookRequest(request) {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writeRefreshWebhookResponse(writer, http.StatusUnauthorized, refreshWebhookResponse{
+			Error: "missing or invalid token",
+		})
+
+		return
+	}
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writeRefreshWebhookResponse(writer, http.StatusMethodNotAllowed, refreshWebhookResponse{
+			Error: "use POST to refresh server metadata",
+		})
+
+		return
+	}
+
+	var providers []MetadataProvider
+	serverID := request.URL.Query().Get("server_id")
+	if serverID != "" {
+		provider := service.findServerMetadataProvider(serverID)
+		if provider != nil {
+			providers = append(providers, provider)
+		}
+		service.invalidateServerTags(serverID, provider)
+	}
+
+	if len(providers) > 0 {
+		log.Printf("Refreshing server metadata from %s (requested via webhook by %s for server '%s').", providers[0].Name(), request.RemoteAddr, serverID)
+	} else {
+		log.Printf("Refreshing server metadata (requested via webhook by %s).", request.RemoteAddr)
+	}
+	err := service.RequestRefresh(providers...)
+	if backoffErr, ok := err.(*refreshBackoffError); ok {
+		log.Printf("Not refreshing servers (requested via webhook): %s", err.Error())
+
+		writer.Header().Set("Retry-After", strconv.Itoa(int((backoffErr.RetryAfter+time.Second-1)/time.Second)))
+		writeRefreshWebhookResponse(writer, http.StatusServiceUnavailable, refreshWebhookResponse{
+			Updated: service.serverMetadataUpdated(),
+			Error:   err.Error(),
+		})
+
+		return
+	}
+	_, isPartial := err.(*partialRefreshError)
+	if err != nil && !isPartial {
+		log.Printf("Error refreshing servers (requested via webhook): %s", err.Error())
+
+		writeRefreshWebhookResponse(writer, http.StatusBadGateway, refreshWebhookResponse{
+			Updated: service.serverMetadataUpdated(),
+			Error:   err.Error(),
+		})
+
+		return
+	}
+
+	response := refreshWebhookResponse{
+		Updated: service.serverMetadataUpdated(),
+	}
+	if isPartial {
+		response.Error = err.Error() // The providers that did not fail were still refreshed.
+	}
+	if serverID == "" {
+		writeRefreshWebhookResponse(writer, http.StatusOK, response)
+
+		return
+	}
+
+	serverMetadata := service.FindServerMetadataByServerID(serverID)
+	if serverMetadata == nil {
+		response.Error = "server not found"
+		writeRefreshWebhookResponse(writer, http.StatusNotFound, response)
+
+		return
+	}
+
+	response.Server = &refreshWebhookServer{
+		ID:               serverMetadata.ID,
+		Name:             serverMetadata.Name,
+		IPv4ByMACAddress: serverMetadata.IPv4ByMACAddress,
+	}
+	writeRefreshWebhookResponse(writer, http.StatusOK, response)
+}
+
+// Determine whether a webhook request carries the configured token (as "Authorization: Bearer <token>").
+func (service *Service) isAuthorizedWebhookRequest(request *http.Request) bool {
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(service.WebhookToken)) == 1
+}
+
+// Write a response from the refresh webhook.
+func writeRefreshWebhookResponse(writer http.ResponseWriter, statusCode int, response refreshWebhookResponse) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+
+	err := json.NewEncoder(writer).Encode(response)
+	if err != nil {
+		log.Printf("Unable to write webhook response: %s", err.Error())
+	}
+}
+
+// Discard cached tags (if any) for the specified server, so they are fetched again on the next refresh.
+//
+// If the provider that the server was last read from is known, the tags are only discarded for that provider's CloudControl target (if any); otherwise, they are discarded for every CloudControl target.
+func (service *Service) invalidateServerTags(serverID string, provider MetadataProvider) {
+	targets := service.cloudControlTargets()
+	if provider != nil {
+		targets = nil
+		if cloudControlProvider, ok := provider.(*CloudControlMetadataProvider); ok {
+			targets = append(targets, cloudControlProvider.target)
+		}
+	}
+
+	for _, target := range targets {
+		target.serverTagCacheLock.Lock()
+		delete(target.serverTagCache, serverID)
+		target.serverTagCacheLock.Unlock()
+	}
+}
+
+// Get the date and time when the server metadata currently in use was read.
+func (service *Service) serverMetadataUpdated() time.Time {
+	service.acquireStateLock("serverMetadataUpdated")
+	defer service.releaseStateLock("serverMetadataUpdated")
+
+	return service.ServerMetadataUpdated
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DimensionDataResearch/mcp2-dhcp-server/server/cloudcontroltest"
+)
+
+const testWebhookToken = "0123456789abcdef"
+
+// Settings for a service with the refresh webhook enabled (and no periodic refreshes during the test).
+var webhookSettings = map[string]interface{}{
+	"webhook.listen_address":           "127.0.0.1:0",
+	"webhook.token":                    testWebhookToken,
+	"cloudcontrol.refresh_interval":    "1h",
+	"cloudcontrol.max_refresh_backoff": "2h",
+}
+
+// A metadata provider whose reads are held up until the test releases them.
+type testMetadataProvider struct {
+	// Receives a value when each read starts.
+	reads chan bool
+
+	// Each read returns the next error (or nil) sent here.
+	results chan error
+}
+
+// Name gets a name for the provider (used in log messages).
+func (provider *testMetadataProvider) Name() string {
+	return "test"
+}
+
+// ReadServerMetadata waits for the test to release the read.
+func (provider *testMetadataProvider) ReadServerMetadata() (map[string]ServerMetadata, *DNSData, error) {
+	provider.reads <- true
+	err := <-provider.results
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dnsData := NewDNSData(60)
+
+	return make(map[string]ServerMetadata), &dnsData, nil
+}
+
+// Create a service with the refresh webhook enabled (refreshing in the background until the test completes).
+func newTestWebhookService(t *testing.T) (*Service, *cloudcontroltest.FakeClient) {
+	service, client := newTestService(t, "testdata/cloudcontrol/basic.json", webhookSettings)
+
+	service.startRefreshing(0)
+	t.Cleanup(service.stopRefreshing)
+
+	return service, client
+}
+
+// Send a request to the refresh webhook.
+func callRefreshWebhook(service *Service, method string, url string, token string) (*httptest.ResponseRecorder, refreshWebhookResponse) {
+	request := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	service.handleRefreshWebhook(recorder, request)
+
+	var response refreshWebhookResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+
+	return recorder, response
+}
+
+func TestRefreshWebhook(t *testing.T) {
+	service, client := newTestWebhookService(t)
+	initialCalls := client.Calls("ListServersInNetworkDomain")
+
+	recorder, _ := callRefreshWebhook(service, http.MethodPost, "/refresh", "")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", recorder.Code)
+	}
+	recorder, _ = callRefreshWebhook(service, http.MethodPost, "/refresh", "not-the-token")
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with an invalid token, got %d", recorder.Code)
+	}
+	recorder, _ = callRefreshWebhook(service, http.MethodGet, "/refresh", testWebhookToken)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET, got %d", recorder.Code)
+	}
+	if calls := client.Calls("ListServersInNetworkDomain"); calls != initialCalls {
+		t.Fatalf("expected no refresh for rejected requests, got %d calls to ListServersInNetworkDomain", calls-initialCalls)
+	}
+
+	// A newly-deployed server becomes known immediately.
+	fixture, err := cloudcontroltest.LoadFixture("testdata/cloudcontrol/basic.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := range fixture.Servers {
+		if fixture.Servers[index].Name == "deploying" {
+			macAddress := "00:50:56:00:00:04"
+			ipv4 := "192.168.70.30"
+			fixture.Servers[index].Network.PrimaryAdapter.MACAddress = &macAddress
+			fixture.Servers[index].Network.PrimaryAdapter.PrivateIPv4Address = &ipv4
+			fixture.Servers[index].State = "NORMAL"
+		}
+	}
+	client.SetFixture(fixture)
+
+	recorder, response := callRefreshWebhook(service, http.MethodPost, "/refresh?server_id=server-deploying", testWebhookToken)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", recorder.Code, recorder.Body.String())
+	}
+	if response.Server == nil || response.Server.Name != "deploying" || len(response.Server.IPv4ByMACAddress) != 1 {
+		t.Fatalf("expected server 'deploying' in response, got %s", recorder.Body.String())
+	}
+
+	recorder, _ = callRefreshWebhook(service, http.MethodPost, "/refresh?server_id=server-missing", testWebhookToken)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown server, got %d", recorder.Code)
+	}
+}
+
+func TestRefreshWebhookCoalescesRequests(t *testing.T) {
+	service, _ := newTestWebhookService(t)
+	provider := &testMetadataProvider{
+		reads:   make(chan bool),
+		results: make(chan error),
+	}
+	service.MetadataProviders = []MetadataProvider{provider}
+
+	var callers sync.WaitGroup
+	callers.Add(1)
+	go func() {
+		defer callers.Done()
+		callRefreshWebhook(service, http.MethodPost, "/refresh", testWebhookToken)
+	}()
+	<-provider.reads
+
+	// While the first refresh is in progress, further requests share a single follow-up refresh.
+	for caller := 0; caller < 5; caller++ {
+		callers.Add(1)
+		go func() {
+			defer callers.Done()
+			callRefreshWebhook(service, http.MethodPost, "/refresh", testWebhookToken)
+		}()
+	}
+	for len(service.refreshRequests) < 5 {
+		time.Sleep(time.Millisecond)
+	}
+
+	provider.results <- nil
+	<-provider.reads
+	provider.results <- nil
+	callers.Wait()
+
+	select {
+	case <-provider.reads:
+		t.Fatalf("expected 2 refreshes, got at least 3")
+	default:
+	}
+}
+
+func TestRefreshWebhookBacksOff(t *testing.T) {
+	service, _ := newTestWebhookService(t)
+	provider := &testMetadataProvider{
+		reads:   make(chan bool, 1),
+		results: make(chan error, 1),
+	}
+	service.MetadataProviders = []MetadataProvider{provider}
+
+	provider.results <- fmt.Errorf("CloudControl is unavailable")
+	recorder, response := callRefreshWebhook(service, http.MethodPost, "/refresh", testWebhookToken)
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 for a failed refresh, got %d (%s)", recorder.Code, recorder.Body.String())
+	}
+	<-provider.reads
+
+	// While refreshes are backing off, the webhook does not trigger another refresh.
+	recorder, response = callRefreshWebhook(service, http.MethodPost, "/refresh", testWebhookToken)
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 (with Retry-After) while backing off, got %d (%s)", recorder.Code, recorder.Body.String())
+	}
+	if response.Error == "" {
+		t.Errorf("expected an error in the response")
+	}
+	select {
+	case <-provider.reads:
+		t.Fatalf("expected no refresh while backing off")
+	default:
+	}
+}
+
+func TestRefreshWebhookRefreshesServerProvider(t *testing.T) {
+	clientsByRegion := newTestClients(t, map[string]string{
+		"":   "testdata/cloudcontrol/basic.json",
+		"NA": "testdata/cloudcontrol/na.json",
+	})
+	settings := make(map[string]interface{})
+	for key, value := range multiTargetSettings {
+		settings[key] = value
+	}
+	for key, value := range webhookSettings {
+		settings[key] = value
+	}
+	service := newTestServiceWithClients(t, clientsByRegion, settings)
+	service.startRefreshing(0)
+	t.Cleanup(service.stopRefreshing)
+
+	// Only the target that the server belongs to is refreshed.
+	primaryCalls := clientsByRegion[""].Calls("ListServersInNetworkDomain")
+	naCalls := clientsByRegion["NA"].Calls("ListServersInNetworkDomain")
+	recorder, response := callRefreshWebhook(service, http.MethodPost, "/refresh?server_id=server-app1", testWebhookToken)
+	if recorder.Code != http.StatusOK || response.Server == nil || response.Server.Name != "app1" {
+		t.Fatalf("expected server 'app1', got %d %#v", recorder.Code, response)
+	}
+	if calls := clientsByRegion["NA"].Calls("ListServersInNetworkDomain"); calls == naCalls {
+		t.Errorf("expected the server's target to be refreshed")
+	}
+	if calls := clientsByRegion[""].Calls("ListServersInNetworkDomain"); calls != primaryCalls {
+		t.Errorf("expected the other target not to be refreshed, got %d calls to ListServersInNetworkDomain", calls-primaryCalls)
+	}
+	if serverMetadata := service.FindServerMetadataByMACAddress("00:50:56:00:00:01"); serverMetadata == nil || serverMetadata.Name != "web1" {
+		t.Fatalf("expected server 'web1' from the other target to be retained, got %#v", serverMetadata)
+	}
+
+	// Every target is refreshed for a server that is not known yet.
+	primaryCalls = clientsByRegion[""].Calls("ListServersInNetworkDomain")
+	naCalls = clientsByRegion["NA"].Calls("ListServersInNetworkDomain")
+	recorder, _ = callRefreshWebhook(service, http.MethodPost, "/refresh?server_id=server-unknown", testWebhookToken)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown server, got %d", recorder.Code)
+	}
+	if clientsByRegion[""].Calls("ListServersInNetworkDomain") == primaryCalls || clientsByRegion["NA"].Calls("ListServersInNetworkDomain") == naCalls {
+		t.Errorf("expected every target to be refreshed for an unknown server")
+	}
+
+	// If only some targets fail, the others are still refreshed (and the error is reported).
+	clientsByRegion["NA"].SetError(fmt.Errorf("region unavailable"))
+	recorder, response = callRefreshWebhook(service, http.MethodPost, "/refresh", testWebhookToken)
+	if recorder.Code != http.StatusOK || !strings.Contains(response.Error, "region unavailable") {
+		t.Fatalf("expected 200 with the failed target's error, got %d %#v", recorder.Code, response)
+	}
+}
+
+func TestCombineRefreshProviders(t *testing.T) {
+	providerA := &testMetadataProvider{}
+	providerB := &testMetadataProvider{}
+
+	providers := combineRefreshProviders([]*refreshRequest{
+		{Providers: []MetadataProvider{providerA}},
+		{Providers: []MetadataProvider{providerB, providerA}},
+	})
+	if len(providers) != 2 || providers[0] != providerA || providers[1] != providerB {
+		t.Errorf("expected both providers (once each), got %v", providers)
+	}
+
+	providers = combineRefreshProviders([]*refreshRequest{
+		{Providers: []MetadataProvider{providerA}},
+		{},
+	})
+	if providers != nil {
+		t.Errorf("expected all providers to be refreshed if any request is for all of them, got %v", providers)
+	}
+}